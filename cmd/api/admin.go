@@ -0,0 +1,287 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// GET /v1/admin/users
+func (app *application) listUsersHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Query     string
+		Activated *bool
+		Blocked   *bool
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	// The q parameter is matched against both the name and the email address.
+	input.Query = app.readString(qs, "q", "")
+	input.Activated = app.readBool(qs, "activated", v)
+	input.Blocked = app.readBool(qs, "blocked", v)
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "id")
+
+	input.Filters.SortSafeList = []string{"id", "name", "email", "created_at", "-id", "-name", "-email", "-created_at"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	users, metadata, err := app.models.Users.GetAll(r.Context(), input.Query, input.Activated, input.Blocked, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"metadata": metadata, "users": users}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/admin/users/:id
+func (app *application) showUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PATCH /v1/admin/users/:id
+func (app *application) updateUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	// Just like updateMovieHandler, we use pointers so that we can tell which fields
+	// were provided in the request body.
+	var input struct {
+		Name      *string `json:"name"`
+		Email     *string `json:"email"`
+		Activated *bool   `json:"activated"`
+		Blocked   *bool   `json:"blocked"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	// Record which fields actually change, so that the audit trail shows the before
+	// and after values.
+	changes := map[string]any{}
+
+	if input.Name != nil && *input.Name != user.Name {
+		changes["name"] = map[string]any{"from": user.Name, "to": *input.Name}
+		user.Name = *input.Name
+	}
+	if input.Email != nil && *input.Email != user.Email {
+		changes["email"] = map[string]any{"from": user.Email, "to": *input.Email}
+		user.Email = *input.Email
+	}
+	if input.Activated != nil && *input.Activated != user.Activated {
+		changes["activated"] = map[string]any{"from": user.Activated, "to": *input.Activated}
+		user.Activated = *input.Activated
+	}
+	if input.Blocked != nil && *input.Blocked != user.Blocked {
+		changes["blocked"] = map[string]any{"from": user.Blocked, "to": *input.Blocked}
+		user.Blocked = *input.Blocked
+	}
+
+	v := validator.New()
+
+	// Admins can't block themselves, otherwise it would be easy to lose the last
+	// account which is able to unblock anybody else.
+	if user.Blocked && user.ID == app.contextGetUser(r).ID {
+		v.AddError("blocked", "you cannot block your own account")
+	}
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Blocking or deactivating a user stops them from logging in, and also revokes all
+	// of their existing credentials so that they are signed out straight away. Signed
+	// access tokens aren't stored, but the authenticate middleware checks the user's
+	// current state before accepting one.
+	_, blocked := changes["blocked"]
+	_, activated := changes["activated"]
+	revoke := (blocked && user.Blocked) || (activated && !user.Activated)
+
+	// The update, the revocation and the audit event are all saved together, or not at
+	// all.
+	var event *data.AuditEvent
+	if len(changes) > 0 {
+		event = app.newAuditEvent(r, "user.updated", user.ID, changes)
+	}
+
+	err = app.models.Users.AdminUpdate(r.Context(), user, revoke, event)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, data.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.cache.invalidateUser(user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/admin/users/:id
+func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	if user.ID == app.contextGetUser(r).ID {
+		app.errorResponse(w, r, http.StatusConflict, "you cannot delete your own account")
+		return
+	}
+
+	// The user record will be gone, so we keep their email address in the audit trail
+	// to show who was deleted. The event is saved in the same transaction as the
+	// deletion, so a user is never deleted without it being audited.
+	event := app.newAuditEvent(r, "user.deleted", user.ID, map[string]any{"email": user.Email})
+
+	err := app.models.Users.AdminDelete(r.Context(), user.ID, event)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.cache.invalidateUser(user.ID)
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "user successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/admin/audit-events
+func (app *application) listAuditEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TargetUserID *int64
+		data.Filters
+	}
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	if qs.Has("user_id") {
+		id := int64(app.readInt(qs, "user_id", 0, v))
+		input.TargetUserID = &id
+	}
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// Audit events are always listed newest first.
+	input.Filters.Sort = "-id"
+	input.Filters.SortSafeList = []string{"-id"}
+
+	if data.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.models.Audit.GetAll(input.TargetUserID, input.Filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"metadata": metadata, "audit_events": events}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The readUserParam() helper looks up the user identified by the "id" URL parameter,
+// sending a 404 Not Found response if there isn't one. It returns false if a response
+// has already been sent to the client.
+func (app *application) readUserParam(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+	id, err := app.readIdParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return nil, false
+	}
+
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, false
+	}
+
+	return user, true
+}
+
+// The audit() helper records an administrative action in the audit trail. The actor is
+// the authenticated user making the request. Actions which aren't performed on a
+// particular user, like creating a role, pass a targetUserID of 0.
+func (app *application) audit(r *http.Request, action string, targetUserID int64, details map[string]any) error {
+	return app.models.Audit.Insert(app.newAuditEvent(r, action, targetUserID, details))
+}
+
+// The newAuditEvent() helper returns the audit event for an action, for handlers which
+// save it in the same transaction as the change itself.
+func (app *application) newAuditEvent(r *http.Request, action string, targetUserID int64, details map[string]any) *data.AuditEvent {
+	actor := app.contextGetUser(r)
+
+	event := &data.AuditEvent{
+		Action:    action,
+		IPAddress: app.clientIP(r),
+		Details:   details,
+	}
+
+	if targetUserID > 0 {
+		event.TargetUserID = &targetUserID
+	}
+
+	if !actor.IsAnonymous() {
+		event.ActorID = &actor.ID
+	}
+
+	if event.Details == nil {
+		event.Details = map[string]any{}
+	}
+
+	return event
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// POST /v1/api-keys
+func (app *application) createAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string     `json:"name"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	key := &data.APIKey{
+		Name:        input.Name,
+		UserID:      user.ID,
+		Permissions: input.Permissions,
+		ExpiryTime:  input.Expiry,
+	}
+
+	v := validator.New()
+
+	if data.ValidateAPIKey(v, key); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// An API key can only ever be granted a subset of the permissions that the caller
+	// holds, otherwise it would be a way for users to escalate their own privileges.
+	// The route only accepts the user's own session, but we still check against the
+	// permissions in the request context if the authenticate middleware restricted
+	// them, rather than everything the owner holds, so that a restricted credential
+	// can never be turned into a broader one.
+	permissions, ok := app.contextGetPermissions(r)
+	if !ok {
+		permissions, err = app.models.Permissions.GetAllForUser(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	for _, code := range key.Permissions {
+		if !permissions.Include(code) {
+			v.AddError("permissions", fmt.Sprintf("must be a subset of your own permissions (%q is not held)", code))
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Requests made with an API key skip the two-factor check in requirePermission(),
+	// so permissions which need a second factor can only be delegated by users who
+	// have one.
+	if slices.ContainsFunc(key.Permissions, func(code string) bool {
+		return slices.Contains(app.config.totp.requiredPermissions, code)
+	}) {
+		enabled, err := app.models.TOTP.IsEnabled(user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !enabled {
+			app.twoFactorRequiredResponse(w, r)
+			return
+		}
+	}
+
+	key, err = app.models.APIKeys.New(user.ID, key.Name, key.Permissions, key.ExpiryTime)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// This is the only response which ever includes the plaintext key, so the client
+	// must store it now.
+	err = app.writeJSON(w, http.StatusCreated, envelop{"api_key": key}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/api-keys
+func (app *application) listAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	keys, err := app.models.APIKeys.GetAllForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"api_keys": keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/api-keys/:id
+func (app *application) deleteAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	err = app.models.APIKeys.Delete(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "api key successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
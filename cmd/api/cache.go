@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thecodephilic-guy/greenlight/internal/cache"
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+)
+
+// The channel that the database triggers send cache invalidation notifications on.
+const cacheInvalidationChannel = "cache_invalidation"
+
+// Define an authCache struct to hold the caches used by the authenticate and
+// requirePermission middleware. Users are cached by the SHA-256 hash of their
+// authentication token, and again by user ID for signed access tokens (which only
+// need the user's current state), and permissions by user ID. Entries are dropped whenever the
+// data behind them changes, but they can still be served until the TTL runs out in the
+// meantime, so the TTL should be kept short.
+type authCache struct {
+	users       *cache.Cache[[sha256.Size]byte, data.User]
+	accounts    *cache.Cache[int64, data.User]
+	permissions *cache.Cache[int64, data.Permissions]
+}
+
+func newAuthCache(ttl time.Duration, size int) *authCache {
+	return &authCache{
+		users:       cache.New[[sha256.Size]byte, data.User](ttl, size),
+		accounts:    cache.New[int64, data.User](ttl, size),
+		permissions: cache.New[int64, data.Permissions](ttl, size),
+	}
+}
+
+// The userForToken() method returns the user for an authentication token, from the
+// cache if possible. A copy of the cached user is returned, so that callers are free
+// to change it.
+func (c *authCache) userForToken(ctx context.Context, models data.Models, token string) (*data.User, error) {
+	key := sha256.Sum256([]byte(token))
+
+	if user, ok := c.users.Get(key); ok {
+		return &user, nil
+	}
+
+	user, err := models.Users.GetForToken(ctx, data.ScopeAuthentication, token)
+	if err != nil {
+		return nil, err
+	}
+
+	c.users.Set(key, *user)
+
+	return user, nil
+}
+
+// The userForID() method returns the user with the given ID, from the cache if
+// possible. Just like userForToken(), a copy of the cached user is returned.
+func (c *authCache) userForID(ctx context.Context, models data.Models, userID int64) (*data.User, error) {
+	if user, ok := c.accounts.Get(userID); ok {
+		return &user, nil
+	}
+
+	user, err := models.Users.Get(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.accounts.Set(userID, *user)
+
+	return user, nil
+}
+
+// The permissionsForUser() method returns the permissions for a user, from the cache if
+// possible.
+func (c *authCache) permissionsForUser(ctx context.Context, models data.Models, userID int64) (data.Permissions, error) {
+	if permissions, ok := c.permissions.Get(userID); ok {
+		return permissions, nil
+	}
+
+	permissions, err := models.Permissions.GetAllForUser(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	c.permissions.Set(userID, permissions)
+
+	return permissions, nil
+}
+
+// The invalidateUser() method drops every cache entry for a user. We don't know the
+// user's token hashes, so the user cache has to be searched.
+func (c *authCache) invalidateUser(userID int64) {
+	c.permissions.Delete(userID)
+	c.accounts.Delete(userID)
+	c.users.DeleteFunc(func(_ [sha256.Size]byte, user data.User) bool {
+		return user.ID == userID
+	})
+}
+
+// The invalidateAll() method empties both caches.
+func (c *authCache) invalidateAll() {
+	c.permissions.Purge()
+	c.accounts.Purge()
+	c.users.Purge()
+}
+
+// The stats() method returns the hit and miss counters for the expvar metrics.
+func (c *authCache) stats() map[string]cache.Stats {
+	return map[string]cache.Stats{
+		"users":       c.users.Stats(),
+		"accounts":    c.accounts.Stats(),
+		"permissions": c.permissions.Stats(),
+	}
+}
+
+// The listenForCacheInvalidation() method listens for the notifications sent by the
+// database triggers, and drops the matching cache entries. Because the triggers fire
+// for every change, no matter which instance (or psql session) made it, this keeps the
+// caches on all running instances in step. If the connection is lost we may have
+// missed notifications, so the caches are emptied whenever it is re-established.
+func (app *application) listenForCacheInvalidation() error {
+	listener := pq.NewListener(app.config.db.dsn, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.PrintError(err, map[string]string{"listener": cacheInvalidationChannel})
+		}
+
+		if event == pq.ListenerEventReconnected {
+			app.cache.invalidateAll()
+		}
+	})
+
+	err := listener.Listen(cacheInvalidationChannel)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+
+	go func() {
+		for {
+			select {
+			case notification := <-listener.Notify:
+				// A nil notification is sent after reconnecting, which has already
+				// been dealt with in the event callback.
+				if notification != nil {
+					app.handleCacheInvalidation(notification.Extra)
+				}
+			case <-time.After(90 * time.Second):
+				// Ping the connection every now and then, so that a dead connection
+				// is noticed even when nothing is changing.
+				go listener.Ping()
+			}
+		}
+	}()
+
+	return nil
+}
+
+// The handleCacheInvalidation() method drops the cache entries named in a notification
+// payload, which is either "user:<id>" or "all".
+func (app *application) handleCacheInvalidation(payload string) {
+	if idString, ok := strings.CutPrefix(payload, "user:"); ok {
+		id, err := strconv.ParseInt(idString, 10, 64)
+		if err == nil {
+			app.cache.invalidateUser(id)
+			return
+		}
+	}
+
+	app.cache.invalidateAll()
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+// The realIP() middleware works out the IP address of the client that made the request,
+// and stores it in the request context for everything downstream (the rate limiter, the
+// access log, login history and so on) to read with app.clientIP().
+//
+// When the API runs behind a reverse proxy like Caddy, every request comes from the
+// proxy, so r.RemoteAddr is always something like 127.0.0.1. The proxy passes the real
+// client's address along in a header, but anybody can send those headers, so we only
+// believe them when the request came from one of the trusted proxies.
+func (app *application) realIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := resolveClientIP(r, app.config.proxy.trusted, app.config.proxy.header)
+		next.ServeHTTP(w, app.contextSetClientIP(r, ip))
+	})
+}
+
+// The resolveClientIP() function returns the IP address of the client that made the
+// request, given the networks of the proxies that are trusted to report it and the
+// header they report it in.
+//
+// Only that one header is ever read. Proxies generally set (or add to) the header they
+// use themselves, but pass the others through from the client untouched, so believing
+// any other header would let the client choose its own address.
+//
+// Each proxy adds the address it received the request from to the end of the list in
+// the Forwarded or X-Forwarded-For header. Working back from the end, the first
+// address which isn't a trusted proxy is the client: anything before it was sent by
+// the client itself, and could be made up. X-Real-IP only holds a single address.
+func resolveClientIP(r *http.Request, trusted []netip.Prefix, header string) string {
+	remote, ok := parseIP(r.RemoteAddr)
+	if !ok {
+		return r.RemoteAddr
+	}
+
+	if !isTrustedProxy(remote, trusted) {
+		return remote.String()
+	}
+
+	var hops []string
+	switch http.CanonicalHeaderKey(header) {
+	case "Forwarded":
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case "X-Forwarded-For":
+		for _, value := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+	case "X-Real-Ip":
+		if value := r.Header.Get("X-Real-IP"); value != "" {
+			hops = []string{value}
+		}
+	}
+
+	client := remote
+
+	for _, hop := range slices.Backward(hops) {
+		ip, ok := parseIP(strings.TrimSpace(hop))
+		if !ok {
+			// The proxy (or somebody) wrote something that isn't an address, like
+			// "unknown". We can't tell who's behind it, so we stop at the last hop we
+			// do know about.
+			break
+		}
+
+		client = ip
+
+		if !isTrustedProxy(ip, trusted) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+// The isTrustedProxy() helper reports whether ip is in one of the trusted networks.
+func isTrustedProxy(ip netip.Addr, trusted []netip.Prefix) bool {
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// The parseIP() helper parses an IP address which might have a port on the end, and
+// might be in square brackets (like "[2001:db8::1]:4711"). IPv4 addresses mapped into
+// IPv6 are unmapped, so that they match IPv4 networks.
+func parseIP(s string) (netip.Addr, bool) {
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+
+	ip, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return ip.Unmap(), true
+}
+
+// The forwardedFor() helper returns the "for" parameters of the RFC 7239 Forwarded
+// header, like:
+//
+//	Forwarded: for=192.0.2.60;proto=http;by=203.0.113.43, for="[2001:db8:cafe::17]:4711"
+//
+// An element without a "for" parameter gives an empty string, which stops the search
+// for the client at that point.
+func forwardedFor(values []string) []string {
+	var hops []string
+
+	for _, value := range values {
+		for _, element := range strings.Split(value, ",") {
+			hop := ""
+
+			for _, pair := range strings.Split(element, ";") {
+				key, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hop = strings.Trim(val, `"`)
+				}
+			}
+
+			hops = append(hops, hop)
+		}
+	}
+
+	return hops
+}
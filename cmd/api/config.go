@@ -0,0 +1,550 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/joho/godotenv"
+	"github.com/thecodephilic-guy/greenlight/internal/jsonlog"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+	"gopkg.in/yaml.v3"
+)
+
+// Every setting is a command-line flag, and the same settings can also be given in a
+// config file and in environment variables. They're applied in this order, with later
+// ones winning:
+//
+//  1. The defaults, as defined with the flags in main().
+//  2. The config file named by -config (or GREENLIGHT_CONFIG), if there is one. It can
+//     be YAML, TOML or JSON, and its keys are the flag names. Nested keys are joined
+//     with a dash, so {"db": {"dsn": "..."}} sets -db-dsn.
+//  3. Environment variables named after the flags, like GREENLIGHT_DB_DSN for -db-dsn.
+//     GREENLIGHT_DB_DSN_FILE names a file to read the value from instead, which is how
+//     secrets are usually handed to containers.
+//  4. The flags given on the command line.
+//
+// Variables in a .env file in the working directory are added to the environment
+// first, unless they're already set.
+
+// The prefix of the environment variables which configure the application.
+const envPrefix = "GREENLIGHT_"
+
+// Settings which were read from environment variables with other names before the
+// GREENLIGHT_ ones existed. They're still read, but the new names win.
+var legacyEnv = map[string]string{
+	"db-dsn":             "DATABASE_URL",
+	"smtp-username":      "SMTP_USERNAME",
+	"smtp-password":      "SMTP_PASSWORD",
+	"jwt-keys":           "JWT_KEYS",
+	"oidc-client-secret": "OIDC_CLIENT_SECRET",
+}
+
+// Settings which hold secrets, and are hidden by -print-config. The DSN only has its
+// password hidden, if it's a URL.
+var secretSettings = []string{"db-dsn", "smtp-password", "jwt-keys", "oidc-client-secret"}
+
+// Settings which can only be given on the command line.
+var commandLineOnly = []string{"config", "print-config", "version"}
+
+// The envName() helper returns the environment variable for a flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// The loadConfig() function applies the config file and environment variables to the
+// flags in fs, which must already have been parsed. Flags given on the command line
+// are left alone.
+func loadConfig(fs *flag.FlagSet) error {
+	// A missing .env file is fine (and normal in production), but one which can't be
+	// read is a mistake worth stopping for.
+	err := godotenv.Load()
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("loading .env file: %w", err)
+	}
+
+	setOnCommandLine := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		setOnCommandLine[f.Name] = true
+	})
+
+	env, err := readEnv(fs)
+	if err != nil {
+		return err
+	}
+
+	path := fs.Lookup("config").Value.String()
+	if !setOnCommandLine["config"] && env["config"].value != "" {
+		path = env["config"].value
+	}
+
+	file := map[string]setting{}
+	if path != "" {
+		file, err = readConfigFile(path)
+		if err != nil {
+			return err
+		}
+
+		for name, s := range file {
+			if fs.Lookup(name) == nil || slices.Contains(commandLineOnly, name) {
+				return fmt.Errorf("%s: unknown setting %q", s.source, name)
+			}
+		}
+	}
+
+	// Apply the file first, and then the environment, so that the environment wins.
+	for _, layer := range []map[string]setting{file, env} {
+		for _, name := range slices.Sorted(maps.Keys(layer)) {
+			if setOnCommandLine[name] || slices.Contains(commandLineOnly, name) {
+				continue
+			}
+
+			s := layer[name]
+
+			err := fs.Set(name, s.value)
+			if err != nil {
+				return fmt.Errorf("%s: invalid value %q for %s: %w", s.source, s.value, name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Define a setting struct to hold a value read from a config file or the environment,
+// along with where it came from, for error messages.
+type setting struct {
+	value  string
+	source string
+}
+
+// The readEnv() function returns the settings for the flags in fs which are given in
+// environment variables.
+func readEnv(fs *flag.FlagSet) (map[string]setting, error) {
+	settings := map[string]setting{}
+
+	var err error
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil {
+			return
+		}
+
+		name := envName(f.Name)
+
+		if value, ok := os.LookupEnv(name); ok {
+			settings[f.Name] = setting{value, name}
+		} else if value, ok := os.LookupEnv(name + "_FILE"); ok {
+			var b []byte
+			b, err = os.ReadFile(value)
+			if err != nil {
+				err = fmt.Errorf("%s_FILE: %w", name, err)
+				return
+			}
+			// Files written by hand nearly always end with a newline, which isn't part
+			// of the secret.
+			settings[f.Name] = setting{strings.TrimRight(string(b), "\r\n"), name + "_FILE"}
+		} else if legacy, ok := legacyEnv[f.Name]; ok {
+			if value, ok := os.LookupEnv(legacy); ok {
+				settings[f.Name] = setting{value, legacy}
+			}
+		}
+	})
+
+	return settings, err
+}
+
+// The readConfigFile() function reads the settings in a config file. The format is
+// decided by the file's extension.
+func readConfigFile(path string) (map[string]setting, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]any
+
+	switch ext := filepath.Ext(path); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(b, &doc)
+	case ".toml":
+		err = toml.Unmarshal(b, &doc)
+	case ".json":
+		err = json.Unmarshal(b, &doc)
+	default:
+		return nil, fmt.Errorf("%s: unsupported config file format %q (use .yaml, .toml or .json)", path, ext)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	settings := map[string]setting{}
+
+	err = flattenConfig(settings, path, "", doc)
+	if err != nil {
+		return nil, err
+	}
+
+	return settings, nil
+}
+
+// The flattenConfig() function adds the values in a config file document to settings,
+// joining nested keys with a dash. Underscores in keys are treated as dashes, so both
+// max_open_conns and max-open-conns work. Lists become space-separated strings, which
+// is what the list flags expect.
+func flattenConfig(settings map[string]setting, path, prefix string, doc map[string]any) error {
+	for key, value := range doc {
+		name := prefix + strings.ReplaceAll(key, "_", "-")
+
+		switch v := value.(type) {
+		case map[string]any:
+			err := flattenConfig(settings, path, name+"-", v)
+			if err != nil {
+				return err
+			}
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				s, err := configScalar(item)
+				if err != nil {
+					return fmt.Errorf("%s: %s: %w", path, name, err)
+				}
+				if strings.ContainsAny(s, " \t\n") {
+					return fmt.Errorf("%s: %s: list items cannot contain spaces", path, name)
+				}
+				items[i] = s
+			}
+			settings[name] = setting{strings.Join(items, " "), path}
+		default:
+			s, err := configScalar(v)
+			if err != nil {
+				return fmt.Errorf("%s: %s: %w", path, name, err)
+			}
+			settings[name] = setting{s, path}
+		}
+	}
+
+	return nil
+}
+
+// The configScalar() helper returns a single value from a config file as a string.
+func configScalar(value any) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value of type %T", value)
+	}
+}
+
+// The validateConfig() function checks that the settings make sense together, so
+// that mistakes are caught when the server starts rather than when the setting is
+// first used. The keys of the errors are the flag names.
+func validateConfig(cfg config) error {
+	v := validator.New()
+
+	v.Check(cfg.port > 0 && cfg.port <= 65535, "port", "must be between 1 and 65535")
+	v.Check(validator.In(cfg.env, "development", "staging", "production"), "env", "must be development, staging or production")
+
+	v.Check(cfg.db.dsn != "", "db-dsn", "must be provided")
+	if cfg.db.dsn != "" {
+		v.Check(validDSN(cfg.db.dsn), "db-dsn", "must be a postgres:// URL or a list of key=value pairs")
+	}
+	maxIdleTime, err := time.ParseDuration(cfg.db.maxIdleTime)
+	v.Check(err == nil && maxIdleTime >= 0, "db-max-idle-time", "must be a duration, like 15m")
+
+	if cfg.limiter.enabled {
+		v.Check(cfg.limiter.rps > 0, "limiter-rps", "must be greater than zero")
+		v.Check(cfg.limiter.burst > 0, "limiter-burst", "must be greater than zero")
+	}
+
+	v.Check(cfg.smtp.port > 0 && cfg.smtp.port <= 65535, "smtp-port", "must be between 1 and 65535")
+
+	for _, origin := range cfg.cors.trustedOrigins {
+		v.Check(validOrigin(origin), "cors-trusted-origins", fmt.Sprintf("%q must be a scheme and host, like https://example.com", origin))
+	}
+
+	v.Check(validator.In(http.CanonicalHeaderKey(cfg.proxy.header), "X-Forwarded-For", "Forwarded", "X-Real-Ip"), "trusted-proxy-header", "must be X-Forwarded-For, Forwarded or X-Real-IP")
+
+	v.Check(cfg.token.jwt.ttl > 0, "jwt-ttl", "must be greater than zero")
+	v.Check(cfg.oauth.accessTokenTTL > 0, "oauth-access-token-ttl", "must be greater than zero")
+	v.Check(cfg.cache.ttl >= 0, "cache-ttl", "must not be negative")
+
+	v.Check(cfg.login.backoffBase > 0, "login-backoff-base", "must be greater than zero")
+	v.Check(cfg.login.backoffMax >= cfg.login.backoffBase, "login-backoff-max", "must not be less than login-backoff-base")
+	v.Check(cfg.login.lockout > 0, "login-lockout", "must be greater than zero")
+	v.Check(cfg.login.window > 0, "login-failure-window", "must be greater than zero")
+
+	for name, u := range map[string]string{
+		"magic-link-url":    cfg.magicLink.url,
+		"login-revoke-url":  cfg.login.revokeURL,
+		"oidc-issuer":       cfg.oidc.issuer,
+		"oidc-redirect-url": cfg.oidc.redirectURL,
+	} {
+		if u != "" {
+			v.Check(validAbsoluteURL(u), name, "must be an absolute http or https URL")
+		}
+	}
+
+	v.Check(cfg.accessLog.sampleRate >= 0 && cfg.accessLog.sampleRate <= 1, "access-log-sample-rate", "must be between 0 and 1")
+	v.Check(cfg.accessLog.slowThreshold >= 0, "access-log-slow-threshold", "must not be negative")
+	v.Check(cfg.tracing.sampleRatio >= 0 && cfg.tracing.sampleRatio <= 1, "trace-sample-ratio", "must be between 0 and 1")
+
+	v.Check(cfg.log.bufferSize >= 0, "log-buffer", "must not be negative")
+	v.Check(cfg.log.file.maxSize >= 0, "log-file-max-size", "must not be negative")
+	v.Check(cfg.log.file.rotateInterval >= 0, "log-file-rotate-interval", "must not be negative")
+	v.Check(cfg.log.file.maxAge >= 0, "log-file-max-age", "must not be negative")
+	v.Check(cfg.log.errors.window >= 0, "log-error-window", "must not be negative")
+	v.Check(cfg.log.errors.burst >= 0, "log-error-burst", "must not be negative")
+
+	if v.Valid() {
+		return nil
+	}
+
+	problems := make([]string, 0, len(v.Errors))
+	for _, name := range slices.Sorted(maps.Keys(v.Errors)) {
+		problems = append(problems, fmt.Sprintf("  -%s: %s", name, v.Errors[name]))
+	}
+
+	return fmt.Errorf("invalid configuration:\n%s", strings.Join(problems, "\n"))
+}
+
+// The validDSN() helper reports whether a DSN looks like one that lib/pq accepts: either
+// a postgres:// URL, or space-separated key=value pairs.
+func validDSN(dsn string) bool {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		return err == nil && u.Host != ""
+	}
+
+	for _, pair := range strings.Fields(dsn) {
+		if !strings.Contains(pair, "=") {
+			return false
+		}
+	}
+
+	return true
+}
+
+// The validOrigin() helper reports whether s is an origin, as sent by browsers in the
+// Origin header: a scheme and host, with an optional port and nothing else.
+func validOrigin(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+
+	return (u.Scheme == "http" || u.Scheme == "https") && u.Host != "" &&
+		u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil
+}
+
+// The validAbsoluteURL() helper reports whether s is an absolute http or https URL.
+func validAbsoluteURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// The configValues() function returns the values of the settings in fs, keyed by
+// flag name. Secrets are redacted if redact is set.
+func configValues(fs *flag.FlagSet, redact bool) map[string]any {
+	values := map[string]any{}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(commandLineOnly, f.Name) {
+			return
+		}
+
+		var value any = f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			switch v := getter.Get().(type) {
+			case bool, int, uint, float64, []string:
+				value = v
+			}
+		}
+
+		if redact && slices.Contains(secretSettings, f.Name) {
+			value = redactSetting(f.Name, value)
+		}
+
+		values[f.Name] = value
+	})
+
+	return values
+}
+
+// The printConfig() function writes the effective settings to w as JSON, in a form
+// which can be used as a config file. Secrets are redacted.
+func printConfig(w io.Writer, fs *flag.FlagSet) error {
+	settings := configValues(fs, true)
+
+	// Don't escape HTML characters, since the output is for people (and for reading
+	// back in as a config file), not for a web page.
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+
+	return enc.Encode(settings)
+}
+
+// The redactSetting() helper hides a secret, keeping just enough to show whether it
+// has been set. For the DSN, only the password is hidden.
+func redactSetting(name string, value any) any {
+	switch v := value.(type) {
+	case string:
+		if v == "" {
+			return ""
+		}
+		if name == "db-dsn" {
+			if u, err := url.Parse(v); err == nil && u.Scheme != "" {
+				return u.Redacted()
+			}
+		}
+		return "xxxxx"
+	case []string:
+		redacted := make([]string, len(v))
+		for i := range v {
+			redacted[i] = "xxxxx"
+		}
+		return redacted
+	}
+
+	return "xxxxx"
+}
+
+// The following types implement flag.Getter for the settings which aren't one of the
+// types that the flag package supports directly. Unlike flag.Func(), they know their
+// current value, so that the defaults appear in -help and -print-config.
+
+// Define a stringList type for space-separated lists of values.
+type stringList struct{ p *[]string }
+
+func (l stringList) String() string {
+	if l.p == nil {
+		return ""
+	}
+	return strings.Join(*l.p, " ")
+}
+
+func (l stringList) Set(s string) error {
+	*l.p = strings.Fields(s)
+	return nil
+}
+
+func (l stringList) Get() any { return append([]string{}, *l.p...) }
+
+// Define a prefixList type for space-separated lists of IP networks. Single addresses
+// are accepted too, and treated as a network of just that address.
+type prefixList struct{ p *[]netip.Prefix }
+
+func (l prefixList) String() string {
+	if l.p == nil {
+		return ""
+	}
+	return strings.Join(l.Get().([]string), " ")
+}
+
+func (l prefixList) Set(s string) error {
+	var prefixes []netip.Prefix
+
+	for _, field := range strings.Fields(s) {
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			ip, ipErr := netip.ParseAddr(field)
+			if ipErr != nil {
+				return err
+			}
+			prefix = netip.PrefixFrom(ip.Unmap(), ip.Unmap().BitLen())
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	*l.p = prefixes
+	return nil
+}
+
+func (l prefixList) Get() any {
+	s := []string{}
+	for _, prefix := range *l.p {
+		s = append(s, prefix.String())
+	}
+	return s
+}
+
+// Define a levelValue type for log levels.
+type levelValue struct{ p *jsonlog.Level }
+
+func (l levelValue) String() string {
+	if l.p == nil {
+		return ""
+	}
+	return strings.ToLower(l.p.String())
+}
+
+func (l levelValue) Set(s string) error {
+	level, err := jsonlog.ParseLevel(s)
+	if err != nil {
+		return err
+	}
+	*l.p = level
+	return nil
+}
+
+func (l levelValue) Get() any { return l.String() }
+
+// Define a formatValue type for log formats.
+type formatValue struct{ p *jsonlog.Format }
+
+func (f formatValue) String() string {
+	if f.p == nil {
+		return ""
+	}
+	return f.p.String()
+}
+
+func (f formatValue) Set(s string) error {
+	format, err := jsonlog.ParseFormat(s)
+	if err != nil {
+		return err
+	}
+	*f.p = format
+	return nil
+}
+
+func (f formatValue) Get() any { return f.String() }
+
+// Define a stackModeValue type for the stack trace modes of error log entries.
+type stackModeValue struct{ p *jsonlog.StackMode }
+
+func (m stackModeValue) String() string {
+	if m.p == nil {
+		return ""
+	}
+	return m.p.String()
+}
+
+func (m stackModeValue) Set(s string) error {
+	mode, err := jsonlog.ParseStackMode(s)
+	if err != nil {
+		return err
+	}
+	*m.p = mode
+	return nil
+}
+
+func (m stackModeValue) Get() any { return m.String() }
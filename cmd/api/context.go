@@ -15,9 +15,48 @@ type contextKey string
 // in the request context.
 const userContextKey = contextKey("user")
 
+// The requestIDContextKey holds the ID of the request, which is included in every log
+// entry written while handling it (see the requestID middleware).
+const requestIDContextKey = contextKey("request_id")
+
+// The clientIPContextKey holds the IP address of the client, as worked out by the
+// realIP middleware from the connection and any headers set by trusted proxies.
+const clientIPContextKey = contextKey("client_ip")
+
+// The permissionsContextKey is used when the permissions for the request are already
+// known up front (for example, from the claims of a signed access token), so that
+// requirePermission() doesn't need to look them up in the database.
+const permissionsContextKey = contextKey("permissions")
+
+// The twoFactorContextKey records whether the request was authenticated by a user who
+// completed a second factor, when the authenticate middleware already knows.
+const twoFactorContextKey = contextKey("two_factor")
+
+// The delegatedContextKey marks requests which were authenticated with a credential
+// that the user handed to someone else, like an API key or an OAuth access token.
+const delegatedContextKey = contextKey("delegated")
+
+// The routePatternContextKey holds a pointer to a string, which the router fills in
+// with the pattern of the route that matched the request (like "/v1/movies/:id"). The
+// metrics middleware puts it in the context on the way in, and reads it on the way
+// out. Labelling metrics with the pattern rather than the URL path keeps the number of
+// series fixed, however many movies there are.
+const routePatternContextKey = contextKey("route_pattern")
+
+// The accessLogUserContextKey holds a pointer to an int64, which contextSetUser() fills
+// in with the ID of the authenticated user. Like the route pattern, it's put in the
+// context by middleware near the top of the chain (accessLog) so that the user can be
+// read on the way out, after the request copy holding the user has gone.
+const accessLogUserContextKey = contextKey("access_log_user")
+
 // The contextSetUser() method returns a new copy of the request with the provided
 // User struct added to the context. Note that we use the userContextKey constant as the key
 func (app *application) contextSetUser(r *http.Request, user *data.User) *http.Request {
+	// Record the user's ID for the access log too, if it's being written.
+	if userID, ok := r.Context().Value(accessLogUserContextKey).(*int64); ok && !user.IsAnonymous() {
+		*userID = user.ID
+	}
+
 	ctx := context.WithValue(r.Context(), userContextKey, user)
 	return r.WithContext(ctx)
 }
@@ -34,3 +73,85 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 
 	return user
 }
+
+// The contextSetRequestID() method returns a new copy of the request with the provided
+// request ID added to the context.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// The contextGetRequestID() method retrieves the request ID from the request context.
+// It returns the empty string for requests which didn't pass through the requestID
+// middleware.
+func (app *application) contextGetRequestID(r *http.Request) string {
+	id, _ := r.Context().Value(requestIDContextKey).(string)
+	return id
+}
+
+// The contextSetClientIP() method returns a new copy of the request with the client's IP
+// address added to the context.
+func (app *application) contextSetClientIP(r *http.Request, ip string) *http.Request {
+	ctx := context.WithValue(r.Context(), clientIPContextKey, ip)
+	return r.WithContext(ctx)
+}
+
+// The contextSetPermissions() method returns a new copy of the request with the
+// provided Permissions added to the context.
+func (app *application) contextSetPermissions(r *http.Request, permissions data.Permissions) *http.Request {
+	ctx := context.WithValue(r.Context(), permissionsContextKey, permissions)
+	return r.WithContext(ctx)
+}
+
+// The contextGetPermissions() method retrieves the Permissions from the request context.
+// Unlike contextGetUser() it is perfectly normal for there to be no value, in which
+// case the second return value is false.
+func (app *application) contextGetPermissions(r *http.Request) (data.Permissions, bool) {
+	permissions, ok := r.Context().Value(permissionsContextKey).(data.Permissions)
+	return permissions, ok
+}
+
+// The contextSetTwoFactor() method returns a new copy of the request recording whether
+// the user completed a second factor when they logged in.
+func (app *application) contextSetTwoFactor(r *http.Request, enabled bool) *http.Request {
+	ctx := context.WithValue(r.Context(), twoFactorContextKey, enabled)
+	return r.WithContext(ctx)
+}
+
+// The contextGetTwoFactor() method retrieves the two-factor flag from the request
+// context. The second return value is false if it isn't known.
+func (app *application) contextGetTwoFactor(r *http.Request) (bool, bool) {
+	enabled, ok := r.Context().Value(twoFactorContextKey).(bool)
+	return enabled, ok
+}
+
+// The contextSetDelegated() method returns a new copy of the request marked as being
+// authenticated with a delegated credential.
+func (app *application) contextSetDelegated(r *http.Request) *http.Request {
+	ctx := context.WithValue(r.Context(), delegatedContextKey, true)
+	return r.WithContext(ctx)
+}
+
+// The contextIsDelegated() method reports whether the request was authenticated with a
+// delegated credential.
+func (app *application) contextIsDelegated(r *http.Request) bool {
+	delegated, _ := r.Context().Value(delegatedContextKey).(bool)
+	return delegated
+}
+
+// The withRoutePattern() helper returns a new copy of the request with somewhere for
+// the router to record the route pattern, and a pointer to it.
+func withRoutePattern(r *http.Request) (*http.Request, *string) {
+	pattern := new(string)
+	ctx := context.WithValue(r.Context(), routePatternContextKey, pattern)
+	return r.WithContext(ctx), pattern
+}
+
+// The withAccessLogUser() helper returns a new copy of the request with somewhere for
+// contextSetUser() to record the user's ID, and a pointer to it. The ID stays zero for
+// anonymous requests.
+func withAccessLogUser(r *http.Request) (*http.Request, *int64) {
+	userID := new(int64)
+	ctx := context.WithValue(r.Context(), accessLogUserContextKey, userID)
+	return r.WithContext(ctx), userID
+}
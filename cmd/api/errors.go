@@ -3,13 +3,15 @@ package main
 import (
 	"fmt"
 	"net/http"
+	"time"
 )
 
 // The logError() method is a generic helper for logging an error message. Later
 // we'll upgrade this to use structured logging, and record additional information
-// about the request including the HTTP method and URL.
+// about the request including the HTTP method and URL. The request logger adds the
+// request ID and user ID, so the entry can be matched up with a client's report.
 func (app *application) logError(r *http.Request, err error) {
-	app.logger.PrintError(err, map[string]string{
+	app.requestLogger(r).PrintError(err, map[string]string{
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
@@ -78,6 +80,13 @@ func (app *application) reateLimitExceededResponse(w http.ResponseWriter, r *htt
 	app.errorResponse(w, r, http.StatusTooManyRequests, message)
 }
 
+func (app *application) tooManyLoginAttemptsResponse(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+	w.Header().Set("Retry-After", retryAfter(wait))
+
+	message := "too many failed login attempts, please try again later"
+	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+}
+
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -90,6 +99,13 @@ func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
 }
 
+func (app *application) invalidAPIKeyResponse(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "ApiKey")
+
+	message := "invalid, expired or missing api key"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
 	app.errorResponse(w, r, http.StatusUnauthorized, message)
@@ -100,7 +116,51 @@ func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.R
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
 
+func (app *application) blockedAccountResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been blocked"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
 func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account doesn't have the necessary permissions to access this resource"
 	app.errorResponse(w, r, http.StatusForbidden, message)
 }
+
+func (app *application) delegatedCredentialResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this resource can't be accessed with an api key or oauth access token"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) twoFactorRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account must have two-factor authentication enabled to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, message)
+}
+
+func (app *application) invalidTwoFactorCodeResponse(w http.ResponseWriter, r *http.Request) {
+	message := "invalid or already used two-factor authentication code"
+	app.errorResponse(w, r, http.StatusUnauthorized, message)
+}
+
+// The oauthErrorResponse() method sends an error from one of the OAuth endpoints. These
+// use the format from RFC 6749 rather than our usual envelope, since that's what OAuth
+// client libraries expect. Clients which failed to authenticate are told to use HTTP
+// basic authentication.
+func (app *application) oauthErrorResponse(w http.ResponseWriter, r *http.Request, status int, code, description string) {
+	headers := http.Header{}
+	headers.Set("Cache-Control", "no-store")
+
+	if status == http.StatusUnauthorized {
+		headers.Set("WWW-Authenticate", `Basic realm="oauth"`)
+	}
+
+	env := envelop{"error": code}
+	if description != "" {
+		env["error_description"] = description
+	}
+
+	err := app.writeJSON(w, status, env, headers)
+	if err != nil {
+		app.logError(r, err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
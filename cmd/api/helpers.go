@@ -6,12 +6,15 @@ import (
 	"fmt"
 	"io"
 	"maps"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
 
 	"github.com/julienschmidt/httprouter"
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/jsonlog"
 	"github.com/thecodephilic-guy/greenlight/internal/validator"
 )
 
@@ -194,17 +197,79 @@ func (app *application) readInt(qs url.Values, key string, defaultValue int, v *
 	return i
 }
 
-// The background() helper accepts an arbitrary function as parameter.
-func (app *application) background(fn func()) {
+// The readBool() helper reads an optional boolean value from the query string. It
+// returns nil if no matching key could be found, so that callers can tell the
+// difference between "false" and not filtering at all. If the value couldn't be
+// converted to a boolean, then we record an error message in the provided Validator
+// instance.
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+
+	return &b
+}
+
+// The clientIP() helper returns the IP address of the client that made the request. This
+// is the address worked out by the realIP middleware, which takes trusted proxies into
+// account. Requests which didn't pass through it fall back to the connection's address.
+func (app *application) clientIP(r *http.Request) string {
+	if ip, ok := r.Context().Value(clientIPContextKey).(string); ok {
+		return ip
+	}
+
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+
+	return ip
+}
+
+// The requestLogger() helper returns a logger which adds the request ID and, once the
+// request has been authenticated, the user's ID to every log entry. Anything logged
+// while handling a request should go through it, so that all the entries for one
+// request can be found together.
+func (app *application) requestLogger(r *http.Request) *jsonlog.Logger {
+	var attrs []jsonlog.Attr
+
+	if id := app.contextGetRequestID(r); id != "" {
+		attrs = append(attrs, jsonlog.String("request_id", id))
+	}
+
+	// Unlike contextGetUser(), this mustn't panic, as errors can be logged before the
+	// authenticate middleware has run.
+	if user, ok := r.Context().Value(userContextKey).(*data.User); ok && !user.IsAnonymous() {
+		attrs = append(attrs, jsonlog.Int64("user_id", user.ID))
+	}
+
+	return app.logger.With(attrs...)
+}
+
+// The background() helper accepts an arbitrary function as parameter, which is run on
+// behalf of the request r. A panic in the function is logged with the request's ID, and
+// the function should use app.requestLogger(r) for its own logging too.
+func (app *application) background(r *http.Request, fn func()) {
 	// Increment the WaitGroup counter to hault the graceful shutdown of server:
 	app.wg.Add(1)
+	// Also count the task for the metrics, which can't read the WaitGroup counter.
+	app.backgroundTasks.Add(1)
 	// Launch a background goroutine.
 	go func() {
 		//Use defer to decrement the WaitGroup counter before goroutine returns.
 		defer app.wg.Done()
+		defer app.backgroundTasks.Add(-1)
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.PrintError(fmt.Errorf("%s", err), nil)
+				app.requestLogger(r).PrintError(fmt.Errorf("%s", err), nil)
 			}
 		}()
 
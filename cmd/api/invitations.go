@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// POST /v1/invitations
+func (app *application) createInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email       string     `json:"email"`
+		Permissions []string   `json:"permissions"`
+		Expiry      *time.Time `json:"expiry"`
+		MaxUses     *int       `json:"max_uses"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	invitation := &data.Invitation{
+		CreatedBy:   &user.ID,
+		Email:       input.Email,
+		Permissions: input.Permissions,
+		ExpiryTime:  input.Expiry,
+		MaxUses:     input.MaxUses,
+	}
+
+	v := validator.New()
+
+	data.ValidateInvitation(v, invitation)
+
+	err = app.validatePermissionCodes(r.Context(), v, invitation.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.Invitations.Insert(invitation)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.audit(r, "invitation.created", 0, map[string]any{
+		"invitation_id": invitation.ID,
+		"email":         invitation.Email,
+		"permissions":   invitation.Permissions,
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// If the invitation is bound to an email address, send the code there. Otherwise
+	// it's up to the admin to pass the code on.
+	if invitation.Email != "" {
+		app.background(r, func() {
+			data := map[string]any{
+				"invitationCode": invitation.Plaintext,
+				"expiry":         invitation.ExpiryTime,
+			}
+
+			err := app.mailer().Send(r.Context(), invitation.Email, "user_invitation.html", data)
+			if err != nil {
+				app.requestLogger(r).PrintError(err, nil)
+			}
+		})
+	}
+
+	// This is the only time the plaintext code is ever shown.
+	err = app.writeJSON(w, http.StatusCreated, envelop{"invitation": invitation}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/invitations
+func (app *application) listInvitationsHandler(w http.ResponseWriter, r *http.Request) {
+	invitations, err := app.models.Invitations.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"invitations": invitations}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/invitations/:id
+func (app *application) deleteInvitationHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	err = app.models.Invitations.Delete(id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.audit(r, "invitation.deleted", 0, map[string]any{"invitation_id": id})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "invitation successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
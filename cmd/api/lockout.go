@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+)
+
+// The loginPolicy() helper returns the throttling policy for failed logins, using the
+// IP address limit if ip is true and the per-account limit otherwise.
+func (app *application) loginPolicy(ip bool) data.ThrottlePolicy {
+	policy := data.ThrottlePolicy{
+		MaxFailures: app.config.login.maxFailures,
+		BaseDelay:   app.config.login.backoffBase,
+		MaxDelay:    app.config.login.backoffMax,
+		Lockout:     app.config.login.lockout,
+		Window:      app.config.login.window,
+	}
+
+	if ip {
+		policy.MaxFailures = app.config.login.ipMaxFailures
+	}
+
+	return policy
+}
+
+// The checkLoginThrottle() helper checks whether login attempts for the email address
+// or the client's IP address are currently blocked. If they are, it sends a 429 Too
+// Many Requests response and returns false. Note that this behaves in exactly the same
+// way whether or not there is an account with that email address.
+func (app *application) checkLoginThrottle(w http.ResponseWriter, r *http.Request, email string) bool {
+	blockedUntil, err := app.models.Logins.BlockedUntil(data.EmailThrottleKey(email), data.IPThrottleKey(app.clientIP(r)))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !blockedUntil.IsZero() {
+		app.tooManyLoginAttemptsResponse(w, r, time.Until(blockedUntil))
+		return false
+	}
+
+	return true
+}
+
+// The recordLoginFailure() helper adds a failed login to the login history, and counts
+// it against both the email address and the client's IP address. If the failure locks
+// out an existing account, the owner is sent a notification email in the background.
+func (app *application) recordLoginFailure(r *http.Request, method, email string, user *data.User) error {
+	ip := app.clientIP(r)
+
+	err := app.recordLoginAttempt(r, method, data.LoginFailure, email, user)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = app.models.Logins.RecordFailure(data.IPThrottleKey(ip), app.loginPolicy(true))
+	if err != nil {
+		return err
+	}
+
+	throttle, locked, err := app.models.Logins.RecordFailure(data.EmailThrottleKey(email), app.loginPolicy(false))
+	if err != nil {
+		return err
+	}
+
+	if locked && user != nil {
+		app.background(r, func() {
+			data := map[string]any{
+				"ipAddress":   ip,
+				"lockedUntil": throttle.BlockedUntil.UTC().Format(time.RFC1123),
+			}
+
+			err := app.mailer().Send(r.Context(), user.Email, "account_locked.html", data)
+			if err != nil {
+				app.requestLogger(r).PrintError(err, nil)
+			}
+		})
+	}
+
+	return nil
+}
+
+// DELETE /v1/admin/users/:id/lockout
+func (app *application) unlockUserHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.models.Logins.Reset(data.EmailThrottleKey(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.audit(r, "user.unlocked", user.ID, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "user account successfully unlocked"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The retryAfter() helper formats a duration as a whole number of seconds for the
+// Retry-After header, rounding up so that clients never retry too early.
+func retryAfter(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/jsonlog"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// GET /v1/admin/log-level
+func (app *application) showLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelop{"level": strings.ToLower(app.logger.Level().String())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/admin/log-level
+//
+// The new level takes effect straight away for every logger, including the request
+// loggers and the slog handler, but it isn't saved anywhere: the -log-level setting
+// decides the level again when the server restarts, or when a reload changes it.
+func (app *application) updateLogLevelHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Level string `json:"level"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	// Turning logging off (or down to fatal only) would hide the errors we rely on, so
+	// the lowest it can go is error.
+	level, err := jsonlog.ParseLevel(input.Level)
+	v.Check(err == nil && level <= jsonlog.LevelError, "level", "must be one of debug, info, warn or error")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	previous := app.logger.Level()
+	app.logger.SetLevel(level)
+
+	err = app.audit(r, "log.level_changed", 0, map[string]any{
+		"from": strings.ToLower(previous.String()),
+		"to":   strings.ToLower(level.String()),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"level": strings.ToLower(level.String())}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/admin/errors
+//
+// Lists the errors which have been logged most often, grouped by fingerprint, so that
+// a flood of the same error can be spotted without reading through the logs. Only
+// errors seen within the last "since" (24 hours by default) are included. The counts
+// start again when the server restarts.
+func (app *application) listErrorsHandler(w http.ResponseWriter, r *http.Request) {
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	limit := app.readInt(qs, "limit", 20, v)
+	v.Check(limit > 0 && limit <= 100, "limit", "must be between 1 and 100")
+
+	since, err := time.ParseDuration(app.readString(qs, "since", "24h"))
+	v.Check(err == nil && since > 0, "since", "must be a positive duration, like 1h or 30m")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	stats := app.logger.TopErrors(limit, time.Now().Add(-since))
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"errors": stats}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// The ways of logging in, as recorded in the login history.
+const (
+	loginMethodPassword  = "password"
+	loginMethodTOTP      = "totp"
+	loginMethodMagicLink = "magic-link"
+	loginMethodOIDC      = "oidc"
+)
+
+// The networkFor() helper returns the network that an IP address belongs to: the /24
+// for IPv4 addresses and the /48 for IPv6 addresses. Home and mobile connections get a
+// new address every so often, but usually stay in the same network, so comparing
+// networks rather than addresses avoids sending an alert every time that happens.
+func networkFor(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+
+	if v4 := addr.To4(); v4 != nil {
+		return (&net.IPNet{IP: v4.Mask(net.CIDRMask(24, 32)), Mask: net.CIDRMask(24, 32)}).String()
+	}
+
+	return (&net.IPNet{IP: addr.Mask(net.CIDRMask(48, 128)), Mask: net.CIDRMask(48, 128)}).String()
+}
+
+// The newLoginEvent() helper returns a login event for the request, with the client's
+// IP address and user agent filled in.
+func (app *application) newLoginEvent(r *http.Request, method, outcome, email string, user *data.User) *data.LoginEvent {
+	ip := app.clientIP(r)
+
+	event := &data.LoginEvent{
+		Email:     email,
+		Method:    method,
+		Outcome:   outcome,
+		IPAddress: ip,
+		Network:   networkFor(ip),
+		UserAgent: r.UserAgent(),
+	}
+
+	if user != nil {
+		event.UserID = &user.ID
+		event.Email = user.Email
+	}
+
+	return event
+}
+
+// The recordLoginAttempt() helper adds a failed or blocked login to the history. The
+// user is nil if the email address doesn't belong to an account.
+func (app *application) recordLoginAttempt(r *http.Request, method, outcome, email string, user *data.User) error {
+	return app.models.LoginEvents.Insert(app.newLoginEvent(r, method, outcome, email, user))
+}
+
+// The recordLoginSuccess() helper adds a successful login to the history. If the user
+// has logged in before, but never from this device or network, they are sent an email
+// about it in the background, with a link that ends the new session.
+//
+// Signed access tokens aren't stored, so there is nothing to delete to end their
+// session. For those the email doesn't include a link, rather than one which would
+// claim to log the device out without doing so.
+func (app *application) recordLoginSuccess(r *http.Request, method string, user *data.User, token *data.Token) error {
+	event := app.newLoginEvent(r, method, data.LoginSuccess, "", user)
+	event.SessionHash = token.Hash
+
+	var (
+		notify     bool
+		revokeCode string
+	)
+
+	if app.config.login.notifyNewDevice {
+		seenUser, seenDevice, seenNetwork, err := app.models.LoginEvents.Familiarity(user.ID, event.UserAgent, event.Network)
+		if err != nil {
+			return err
+		}
+
+		// There's nothing to compare the very first login with, so it never counts as
+		// coming from somewhere new.
+		notify = seenUser && (!seenDevice || !seenNetwork)
+
+		if notify && token.Hash != nil {
+			revokeCode, err = event.NewRevokeCode()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := app.models.LoginEvents.Insert(event)
+	if err != nil {
+		return err
+	}
+
+	if notify {
+		app.background(r, func() {
+			data := map[string]any{
+				"ipAddress":  event.IPAddress,
+				"userAgent":  event.UserAgent,
+				"loginTime":  event.CreatedAt.UTC().Format(time.RFC1123),
+				"revokeCode": revokeCode,
+			}
+
+			if app.config.login.revokeURL != "" && revokeCode != "" {
+				data["revokeURL"] = app.config.login.revokeURL + url.QueryEscape(revokeCode)
+			}
+
+			err := app.mailer().Send(r.Context(), user.Email, "new_login.html", data)
+			if err != nil {
+				app.requestLogger(r).PrintError(err, nil)
+			}
+		})
+	}
+
+	return nil
+}
+
+// GET /v1/users/me/logins
+func (app *application) listMyLoginsHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeLoginHistory(w, r, app.contextGetUser(r))
+}
+
+// GET /v1/admin/users/:id/logins
+func (app *application) listUserLoginsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeLoginHistory(w, r, user)
+}
+
+// The writeLoginHistory() helper sends a page of a user's login history, newest first.
+func (app *application) writeLoginHistory(w http.ResponseWriter, r *http.Request, user *data.User) {
+	var filters data.Filters
+
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	filters.Page = app.readInt(qs, "page", 1, v)
+	filters.PageSize = app.readInt(qs, "page_size", 20, v)
+
+	// The history is always listed newest first.
+	filters.Sort = "-id"
+	filters.SortSafeList = []string{"-id"}
+
+	if data.ValidateFilters(v, filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	events, metadata, err := app.models.LoginEvents.GetAllForUser(user.ID, filters)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"metadata": metadata, "logins": events}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/tokens/authentication/revoke
+func (app *application) revokeLoginSessionHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Code != "", "code", "must be provided")
+	v.Check(len(input.Code) == 26, "code", "must be 26 bytes long")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The code is only ever sent to the user's email address, so having it is enough
+	// to end the session without logging in.
+	userID, err := app.models.LoginEvents.RevokeSession(input.Code)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("code", "invalid or already used code")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.cache.invalidateUser(userID)
+
+	// Note that signed access tokens aren't stored, so there is nothing to delete for
+	// them and they stay valid until they expire. That's why no revoke code is handed
+	// out for them in the first place.
+	env := envelop{"message": "the session has been revoked, if this login wasn't you then please reset your password as well"}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
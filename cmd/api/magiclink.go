@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// POST /v1/tokens/magic-link
+func (app *application) createMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateEmail(v, input.Email); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The response is the same whether or not the email address belongs to an account,
+	// so that it can't be used to find out which addresses are registered.
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if user != nil && !user.Blocked {
+		token, err := app.models.Tokens.New(r.Context(), user.ID, 15*time.Minute, data.ScopeMagicLink)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.background(r, func() {
+			data := map[string]any{
+				"magicLinkToken": token.Plaintext,
+			}
+
+			if app.config.magicLink.url != "" {
+				data["magicLinkURL"] = app.config.magicLink.url + url.QueryEscape(token.Plaintext)
+			}
+
+			err := app.mailer().Send(r.Context(), user.Email, "token_magic_link.html", data)
+			if err != nil {
+				app.requestLogger(r).PrintError(err, nil)
+			}
+		})
+	}
+
+	env := envelop{"message": "if the email address belongs to an account, an email will be sent to it containing a login link"}
+
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/tokens/magic-link/redeem
+func (app *application) redeemMagicLinkTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Using the token deletes it, which is what makes the link single-use.
+	userID, err := app.models.Tokens.Use(r.Context(), data.ScopeMagicLink, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired login link")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.models.Users.Get(r.Context(), userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The link proves that the user controls their email address, which stands in for
+	// the password as the first factor, so from here on it's a normal login.
+	app.completeLogin(w, r, loginMethodMagicLink, user)
+}
@@ -7,10 +7,14 @@ import (
 	"expvar"
 	"flag"
 	"fmt"
+	"log/slog"
+	"net/netip"
 	"os"
+	"reflect"
 	"runtime"
-	"strings"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	// Import the pq driver so that it can register itself with the database/sql
@@ -19,9 +23,12 @@ import (
 	_ "github.com/lib/pq"
 	"github.com/thecodephilic-guy/greenlight/internal/data"
 	"github.com/thecodephilic-guy/greenlight/internal/jsonlog"
-	"github.com/thecodephilic-guy/greenlight/internal/mailer"
+	"github.com/thecodephilic-guy/greenlight/internal/jwt"
+	"github.com/thecodephilic-guy/greenlight/internal/metrics"
+	"github.com/thecodephilic-guy/greenlight/internal/oidc"
+	"github.com/thecodephilic-guy/greenlight/internal/tracing"
 
-	godotenv "github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // Declare a string containing the application version number. Later in the book we'll
@@ -65,6 +72,140 @@ type config struct {
 	cors struct {
 		trustedOrigins []string
 	}
+	// Requests from the trusted proxies (like Caddy in production) have their client's
+	// IP address taken from the header named here: X-Forwarded-For, Forwarded or
+	// X-Real-IP.
+	proxy struct {
+		trusted []netip.Prefix
+		header  string
+	}
+	// The token format decides what createAuthenticationTokenHandler hands out:
+	// "opaque" tokens are random strings looked up in the tokens table, while "jwt"
+	// tokens are signed and carry everything the authenticate middleware needs.
+	token struct {
+		format string
+		jwt    struct {
+			issuer string
+			ttl    time.Duration
+			keys   []string
+		}
+	}
+	totp struct {
+		issuer              string
+		requiredPermissions []string
+	}
+	password struct {
+		minScore int
+		pwnedDir string
+		hasher   string
+		bcrypt   struct {
+			cost int
+		}
+		argon2id struct {
+			memory      uint
+			iterations  uint
+			parallelism uint
+		}
+	}
+	// When inviteOnly is set, new users can only register with an invitation code.
+	registration struct {
+		inviteOnly bool
+	}
+	// Passwordless login links are only sent when enabled. If url is set, the email
+	// contains a link to it with the token appended, for a frontend to redeem.
+	magicLink struct {
+		enabled bool
+		url     string
+	}
+	// Users can log in with an external OpenID Connect provider when an issuer is set.
+	// If autoProvision is set, users are created for identities with verified email
+	// addresses that don't belong to any account yet.
+	oidc struct {
+		issuer        string
+		clientID      string
+		clientSecret  string
+		redirectURL   string
+		scopes        []string
+		autoProvision bool
+	}
+	// Access tokens issued to third-party OAuth clients last for accessTokenTTL.
+	oauth struct {
+		accessTokenTTL time.Duration
+	}
+	// Authenticated users and their permissions are cached in memory for up to ttl,
+	// with at most size entries in each cache. Setting either to zero disables caching.
+	cache struct {
+		ttl  time.Duration
+		size int
+	}
+	login struct {
+		maxFailures   int
+		ipMaxFailures int
+		backoffBase   time.Duration
+		backoffMax    time.Duration
+		lockout       time.Duration
+		window        time.Duration
+		// Users are emailed when they log in from a new device or network. If
+		// revokeURL is set, the email links to it with the revoke code appended, for
+		// a frontend to redeem.
+		notifyNewDevice bool
+		revokeURL       string
+	}
+	// Log entries below level are discarded. The level can be changed while the
+	// server is running, through the admin API. Entries are written to each of the
+	// enabled sinks which they reach the level of, through a buffer of bufferSize
+	// entries (or directly, if bufferSize is zero).
+	log struct {
+		level      jsonlog.Level
+		format     jsonlog.Format
+		bufferSize int
+		stdout     struct {
+			enabled bool
+			level   jsonlog.Level
+		}
+		// The file is rotated when it reaches maxSize megabytes, and every
+		// rotateInterval. Rotated files beyond maxBackups, or older than maxAge, are
+		// deleted.
+		file struct {
+			path           string
+			level          jsonlog.Level
+			maxSize        int
+			rotateInterval time.Duration
+			maxBackups     int
+			maxAge         time.Duration
+			compress       bool
+		}
+		syslog struct {
+			enabled bool
+			address string
+			tag     string
+			level   jsonlog.Level
+		}
+		// Repeats of the same error are limited to burst entries per window, and
+		// stack decides which of them include a stack trace.
+		errors struct {
+			stack  jsonlog.StackMode
+			window time.Duration
+			burst  int
+		}
+	}
+	// Every request is written to the access log when it's enabled, except that only a
+	// sampleRate fraction of successful requests which are faster than slowThreshold
+	// are written. The values of the redactParams query parameters are hidden.
+	accessLog struct {
+		enabled       bool
+		sampleRate    float64
+		slowThreshold time.Duration
+		redactParams  []string
+	}
+	// Spans are exported to stdout, to an OTLP collector at otlpEndpoint, or not at all.
+	// New traces are sampled with probability sampleRatio, and traces started by a
+	// client follow the client's sampling decision.
+	tracing struct {
+		exporter     string
+		otlpEndpoint string
+		sampleRatio  float64
+	}
 }
 
 // Define an application struct to hold the dependencies for our HTTP handlers, helpers,
@@ -73,53 +214,31 @@ type config struct {
 // Add a models field to hold our new Models struct.
 // sync.WaitGroup helps to keep the background task in sync with graceful shutdown of server
 type application struct {
-	config config
-	logger *jsonlog.Logger
-	models data.Models
-	mailer mailer.Mailer
-	wg     sync.WaitGroup
+	config   config
+	logger   *jsonlog.Logger
+	models   data.Models
+	jwtKeys  *jwt.KeySet
+	oidc     *oidc.Provider
+	cache    *authCache
+	registry *metrics.Registry
+	tracer   *tracing.Tracer
+	wg       sync.WaitGroup
+	// The number of background tasks currently running, for the metrics.
+	backgroundTasks atomic.Int64
+	// The settings which can be changed without a restart (see reload.go).
+	live atomic.Pointer[liveConfig]
 }
 
 func main() {
-	//Laod env varialbles:
-	err := godotenv.Load()
-
 	// Declare an instance of the config struct.
 	var cfg config
 
-	// Read the value of the port and env command-line flags into the config struct. We
-	// default to using the port number 4000 and the environment "development" if no
-	// corresponding flags are provided.
-	flag.IntVar(&cfg.port, "port", 4000, "API server port")
-	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
-	// Read the DSN value from the db-dsn command-line flag into the config struct. We
-	// default to using our development DSN if no flag is provided.
-	flag.StringVar(&cfg.db.dsn, "db-dsn", os.Getenv("DATABASE_URL"), "PostgreSQL DSN")
-
-	flag.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 100, "PostgreSQL max open connections")
-	flag.IntVar(&cfg.db.maxIdleConns, "db-max_idle-conns", 50, "PostgreSQL max idle connections")
-	flag.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
-
-	flag.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
-	flag.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
-	flag.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
-
-	flag.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
-	flag.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.smtp.username, "smtp-username", os.Getenv("SMTP_USERNAME"), "SMTP username")
-	flag.StringVar(&cfg.smtp.password, "smtp-password", os.Getenv("SMTP_PASSWORD"), "SMTP password")
-	flag.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.sohail.world>", "SMTP sender")
-
-	// Use the flag.Func() function to process the -cors-trusted-origins command line
-	// flag. In this we use the strings.Fields() function to split the flag value into a
-	// slice based on whitespace characters and assign it to our config struct.
-	// Importantly, if the -cors-trusted-origins flag is not present, contains the empty
-	// string, or contains only whitespace, then strings.Fields() will return an empty
-	// []string slice.
-	flag.Func("cors-trusted-origins", "Trusted CORS origins (space separated)", func(s string) error {
-		cfg.cors.trustedOrigins = strings.Fields(s)
-		return nil
-	})
+	// Define the flags for every setting. Their values can also come from a config file
+	// and environment variables (see config.go). -print-config shows the result of
+	// merging them all.
+	defineFlags(flag.CommandLine, &cfg)
+
+	displayConfig := flag.Bool("print-config", false, "Display the effective configuration, with secrets redacted, and exit")
 
 	// Create a new version boolean flag with the default value of false.
 	displayVersion := flag.Bool("version", false, "Display version and exit")
@@ -133,18 +252,69 @@ func main() {
 		os.Exit(0)
 	}
 
-	// Initialize a new jsonlog.Logger which writes messages *at or above* the INFO
-	// severity level to the strandard out stream.
-	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
-
+	// Apply the config file and environment variables, and check the result. We can't
+	// log anything until the logger has been configured, so any errors go straight to
+	// stderr.
+	err := loadConfig(flag.CommandLine)
+	if err == nil {
+		err = validateConfig(cfg)
+	}
 	if err != nil {
-		if cfg.env == "production" {
-			// In production, it's expected that .env might not exist
-			logger.PrintInfo("No .env file found, relying on system environment variables", nil)
-		} else {
-			// In development (or default), a missing .env is a critical error
-			logger.PrintFatal(errors.New("error loading .env file"), nil)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if *displayConfig {
+		err = printConfig(os.Stdout, flag.CommandLine)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
 		}
+		os.Exit(0)
+	}
+
+	// Initialize a new jsonlog.Logger which writes messages *at or above* the configured
+	// severity level to the configured sinks.
+	logger, err := openLogger(cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	// Close the logger when main() returns, so that buffered entries are written out
+	// and the log file is closed.
+	defer logger.Close()
+
+	// Send anything logged with the log/slog package (by us or by a library) through
+	// the same logger, so that it's all in one format.
+	slog.SetDefault(slog.New(logger.Handler()))
+
+	// Configure the password hasher before anything can hash a password.
+	hasher, err := newPasswordHasher(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+	data.SetPasswordHasher(hasher)
+
+	// Load the signing keys for stateless access tokens. It's fine for keys to be
+	// configured while the opaque format is in use (so that tokens issued before a
+	// switch back keep working), but the jwt format can't work without them.
+	jwtKeys, err := openJWTKeys(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Set up the OpenID Connect provider, if one is configured.
+	oidcProvider, err := openOIDCProvider(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	// Start exporting trace spans, if an exporter is configured. This happens before
+	// anything else can start a span.
+	tracer, err := openTracer(cfg)
+	if err != nil {
+		logger.PrintFatal(err, nil)
 	}
 
 	// Call the openDB() helper function (see below) to create the connection pool,
@@ -175,10 +345,33 @@ func main() {
 	// Declare an instance of the application struct, containing the config struct and
 	// the logger.
 	app := &application{
-		config: cfg,
-		logger: logger,
-		models: data.NewModels(db),
-		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		config:   cfg,
+		logger:   logger,
+		models:   data.NewModels(db),
+		jwtKeys:  jwtKeys,
+		oidc:     oidcProvider,
+		cache:    newAuthCache(cfg.cache.ttl, cfg.cache.size),
+		registry: metrics.New(),
+		tracer:   tracer,
+	}
+
+	// Store the settings which can be reloaded while the server is running.
+	app.live.Store(newLiveConfig(cfg, configValues(flag.CommandLine, false)))
+
+	// Register the metrics which are exposed at /metrics in the Prometheus format.
+	app.registerMetrics(db)
+
+	expvar.Publish("auth_cache", expvar.Func(func() any { // authentication cache hits and misses
+		return app.cache.stats()
+	}))
+
+	// Only listen for invalidations if the cache is enabled, since there is nothing to
+	// invalidate otherwise.
+	if cfg.cache.ttl > 0 && cfg.cache.size > 0 {
+		err = app.listenForCacheInvalidation()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
 	}
 
 	err = app.server()
@@ -187,6 +380,328 @@ func main() {
 	}
 }
 
+// The defineFlags() function defines the flags for every setting on fs, storing their
+// values in cfg. It's used both when the server starts and when the config is reloaded.
+func defineFlags(fs *flag.FlagSet, cfg *config) {
+	// Read the value of the port and env command-line flags into the config struct. We
+	// default to using the port number 4000 and the environment "development" if no
+	// corresponding flags are provided.
+	fs.IntVar(&cfg.port, "port", 4000, "API server port")
+	fs.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
+
+	cfg.log.level = jsonlog.LevelInfo
+	fs.Var(levelValue{&cfg.log.level}, "log-level", "Minimum log level (debug|info|warn|error)")
+
+	// Log entries can be written to stdout, a rotating file and syslog, all at once.
+	// Each sink has a minimum level of its own, on top of -log-level, so that (for
+	// example) only errors go to syslog.
+	fs.Var(formatValue{&cfg.log.format}, "log-format", "Format of log entries written to stdout and the log file (json|console)")
+	fs.IntVar(&cfg.log.bufferSize, "log-buffer", 1024, "Number of log entries to buffer, dropping entries when full (0 writes synchronously)")
+
+	fs.BoolVar(&cfg.log.stdout.enabled, "log-stdout", true, "Write log entries to stdout")
+	cfg.log.stdout.level = jsonlog.LevelDebug
+	fs.Var(levelValue{&cfg.log.stdout.level}, "log-stdout-level", "Minimum level of log entries written to stdout")
+
+	fs.StringVar(&cfg.log.file.path, "log-file", "", "Write log entries to this file (disabled if empty)")
+	cfg.log.file.level = jsonlog.LevelDebug
+	fs.Var(levelValue{&cfg.log.file.level}, "log-file-level", "Minimum level of log entries written to the log file")
+	fs.IntVar(&cfg.log.file.maxSize, "log-file-max-size", 100, "Rotate the log file when it reaches this many megabytes (0 disables)")
+	fs.DurationVar(&cfg.log.file.rotateInterval, "log-file-rotate-interval", 0, "Rotate the log file at this interval, e.g. 24h for daily (0 disables)")
+	fs.IntVar(&cfg.log.file.maxBackups, "log-file-max-backups", 7, "Number of rotated log files to keep (0 keeps all)")
+	fs.DurationVar(&cfg.log.file.maxAge, "log-file-max-age", 0, "Delete rotated log files older than this (0 keeps all)")
+	fs.BoolVar(&cfg.log.file.compress, "log-file-compress", true, "Compress rotated log files with gzip")
+
+	fs.BoolVar(&cfg.log.syslog.enabled, "log-syslog", false, "Write log entries to the local syslog daemon")
+	fs.StringVar(&cfg.log.syslog.address, "log-syslog-address", "", "Unix socket of the syslog daemon (the usual places are tried if empty)")
+	fs.StringVar(&cfg.log.syslog.tag, "log-syslog-tag", "greenlight", "Tag written in front of syslog messages")
+	cfg.log.syslog.level = jsonlog.LevelWarn
+	fs.Var(levelValue{&cfg.log.syslog.level}, "log-syslog-level", "Minimum level of log entries written to syslog")
+
+	cfg.log.errors.stack = jsonlog.StackFirst
+	fs.Var(stackModeValue{&cfg.log.errors.stack}, "log-error-stack", "Which error log entries include a stack trace (always|first|off)")
+	fs.DurationVar(&cfg.log.errors.window, "log-error-window", time.Minute, "Window for rate limiting repeats of the same error")
+	fs.IntVar(&cfg.log.errors.burst, "log-error-burst", 10, "Repeats of the same error logged per window before the rest are suppressed (0 disables)")
+
+	// Read the DSN value from the db-dsn command-line flag into the config struct. There
+	// is no default, so it must be given in one of the ways described in config.go.
+	fs.StringVar(&cfg.db.dsn, "db-dsn", "", "PostgreSQL DSN")
+
+	fs.IntVar(&cfg.db.maxOpenConns, "db-max-open-conns", 100, "PostgreSQL max open connections")
+	fs.IntVar(&cfg.db.maxIdleConns, "db-max-idle-conns", 50, "PostgreSQL max idle connections")
+	fs.StringVar(&cfg.db.maxIdleTime, "db-max-idle-time", "15m", "PostgreSQL max connection idle time")
+
+	fs.Float64Var(&cfg.limiter.rps, "limiter-rps", 2, "Rate limiter maximum requests per second")
+	fs.IntVar(&cfg.limiter.burst, "limiter-burst", 4, "Rate limiter maximum burst")
+	fs.BoolVar(&cfg.limiter.enabled, "limiter-enabled", true, "Enable rate limiter")
+
+	fs.StringVar(&cfg.smtp.host, "smtp-host", "smtp.mailtrap.io", "SMTP host")
+	fs.IntVar(&cfg.smtp.port, "smtp-port", 25, "SMTP port")
+	fs.StringVar(&cfg.smtp.username, "smtp-username", "", "SMTP username")
+	fs.StringVar(&cfg.smtp.password, "smtp-password", "", "SMTP password")
+	fs.StringVar(&cfg.smtp.sender, "smtp-sender", "Greenlight <no-reply@greenlight.sohail.world>", "SMTP sender")
+
+	// Use a stringList value to process the -cors-trusted-origins command line flag.
+	// It uses the strings.Fields() function to split the flag value into a slice based
+	// on whitespace characters and assign it to our config struct. Importantly, if the
+	// -cors-trusted-origins flag is not present, contains the empty string, or contains
+	// only whitespace, then we end up with an empty []string slice.
+	fs.Var(stringList{&cfg.cors.trustedOrigins}, "cors-trusted-origins", "Trusted CORS origins (space separated)")
+
+	fs.Var(prefixList{&cfg.proxy.trusted}, "trusted-proxies", "IP addresses or CIDR networks of reverse proxies whose forwarding headers are trusted (space separated)")
+	fs.StringVar(&cfg.proxy.header, "trusted-proxy-header", "X-Forwarded-For", "Header the trusted proxies report the client's IP address in (X-Forwarded-For|Forwarded|X-Real-IP)")
+
+	fs.StringVar(&cfg.token.format, "token-format", "opaque", "Authentication token format (opaque|jwt)")
+	fs.StringVar(&cfg.token.jwt.issuer, "jwt-issuer", "greenlight", "Issuer claim for signed access tokens")
+	fs.DurationVar(&cfg.token.jwt.ttl, "jwt-ttl", time.Hour, "Lifetime of signed access tokens")
+
+	// The signing keys are given as a space separated list of kid:alg:base64 entries.
+	// The first key signs new tokens, and any others are only used to verify tokens
+	// that were issued before the keys were rotated.
+	fs.Var(stringList{&cfg.token.jwt.keys}, "jwt-keys", "Signing keys for access tokens as kid:alg:base64 (space separated, first signs)")
+
+	// Users holding any of these permissions must have two-factor authentication
+	// enabled before they can use them.
+	fs.StringVar(&cfg.totp.issuer, "totp-issuer", "Greenlight", "Issuer name shown in authenticator apps")
+	cfg.totp.requiredPermissions = []string{"movies:write"}
+	fs.Var(stringList{&cfg.totp.requiredPermissions}, "totp-required-permissions", "Permissions that require two-factor authentication (space separated)")
+
+	// New passwords must reach a minimum strength score (0-4), must not be in the
+	// bundled list of common passwords and, if a directory of Have I Been Pwned range
+	// files is configured, must not have appeared in a data breach.
+	fs.IntVar(&cfg.password.minScore, "password-min-score", 2, "Minimum password strength score (0-4)")
+	fs.StringVar(&cfg.password.pwnedDir, "password-pwned-dir", "", "Directory of Have I Been Pwned SHA-1 range files (disabled if empty)")
+
+	// New passwords are hashed with the configured algorithm. Existing hashes record the
+	// algorithm and parameters they were created with, and are upgraded automatically
+	// the next time the user logs in.
+	fs.StringVar(&cfg.password.hasher, "password-hasher", "bcrypt", "Password hashing algorithm (bcrypt|argon2id)")
+	fs.IntVar(&cfg.password.bcrypt.cost, "bcrypt-cost", 12, "bcrypt cost")
+	fs.UintVar(&cfg.password.argon2id.memory, "argon2id-memory", 64*1024, "argon2id memory in KiB")
+	fs.UintVar(&cfg.password.argon2id.iterations, "argon2id-iterations", 3, "argon2id iterations")
+	fs.UintVar(&cfg.password.argon2id.parallelism, "argon2id-parallelism", 2, "argon2id parallelism")
+
+	// Failed logins are tracked both per account and per IP address. The IP limit is
+	// higher, because many users can legitimately share one address.
+	fs.IntVar(&cfg.login.maxFailures, "login-max-failures", 10, "Failed logins before an account is locked out")
+	fs.IntVar(&cfg.login.ipMaxFailures, "login-ip-max-failures", 100, "Failed logins before an IP address is locked out")
+	fs.DurationVar(&cfg.login.backoffBase, "login-backoff-base", time.Second, "Delay after the first failed login, doubled for each further failure")
+	fs.DurationVar(&cfg.login.backoffMax, "login-backoff-max", 5*time.Minute, "Maximum delay between failed logins")
+	fs.DurationVar(&cfg.login.lockout, "login-lockout", 15*time.Minute, "How long a lockout lasts")
+	fs.DurationVar(&cfg.login.window, "login-failure-window", time.Hour, "How long failed logins are remembered for")
+	fs.BoolVar(&cfg.login.notifyNewDevice, "login-notify-new-device", true, "Email users when they log in from a new device or network")
+	fs.StringVar(&cfg.login.revokeURL, "login-revoke-url", "", "Frontend URL that new login emails link to for revoking the session (the code is appended)")
+
+	fs.BoolVar(&cfg.registration.inviteOnly, "registration-invite-only", false, "Require an invitation code to register")
+
+	fs.BoolVar(&cfg.magicLink.enabled, "magic-link-enabled", false, "Enable passwordless login links")
+	fs.StringVar(&cfg.magicLink.url, "magic-link-url", "", "Frontend URL that login links point to (the token is appended)")
+
+	fs.StringVar(&cfg.oidc.issuer, "oidc-issuer", "", "OpenID Connect provider issuer URL (disabled if empty)")
+	fs.StringVar(&cfg.oidc.clientID, "oidc-client-id", "", "OpenID Connect client ID")
+	fs.StringVar(&cfg.oidc.clientSecret, "oidc-client-secret", "", "OpenID Connect client secret (empty for a public client)")
+	fs.StringVar(&cfg.oidc.redirectURL, "oidc-redirect-url", "", "URL of the OpenID Connect callback endpoint, as registered with the provider")
+	cfg.oidc.scopes = []string{"openid", "email", "profile"}
+	fs.Var(stringList{&cfg.oidc.scopes}, "oidc-scopes", "OpenID Connect scopes to request (space separated)")
+	fs.BoolVar(&cfg.oidc.autoProvision, "oidc-auto-provision", false, "Create users for new OpenID Connect identities with verified email addresses")
+
+	fs.DurationVar(&cfg.oauth.accessTokenTTL, "oauth-access-token-ttl", time.Hour, "Lifetime of access tokens issued to OAuth clients")
+
+	fs.DurationVar(&cfg.cache.ttl, "cache-ttl", 30*time.Second, "How long authenticated users and permissions are cached for (0 disables the cache)")
+	fs.IntVar(&cfg.cache.size, "cache-size", 10000, "Maximum number of entries in each authentication cache")
+
+	fs.BoolVar(&cfg.accessLog.enabled, "access-log", true, "Write an access log entry for each request")
+	fs.Float64Var(&cfg.accessLog.sampleRate, "access-log-sample-rate", 1, "Fraction of successful requests to write to the access log (0-1)")
+	fs.DurationVar(&cfg.accessLog.slowThreshold, "access-log-slow-threshold", time.Second, "Requests slower than this are always written to the access log")
+
+	// The defaults cover the query parameters that carry tokens and codes in the API's
+	// own endpoints.
+	cfg.accessLog.redactParams = []string{"token", "code", "state", "password", "client_secret", "code_verifier", "access_token", "refresh_token"}
+	fs.Var(stringList{&cfg.accessLog.redactParams}, "access-log-redact", "Query parameters whose values are hidden in the access log (space separated)")
+
+	fs.StringVar(&cfg.tracing.exporter, "trace-exporter", "none", "Where to export trace spans (none|stdout|otlp)")
+	fs.StringVar(&cfg.tracing.otlpEndpoint, "trace-otlp-endpoint", "http://localhost:4318/v1/traces", "OTLP/HTTP endpoint of the trace collector")
+	fs.Float64Var(&cfg.tracing.sampleRatio, "trace-sample-ratio", 1, "Fraction of new traces to sample (0-1)")
+
+	// The config file can also be named by the GREENLIGHT_CONFIG environment variable,
+	// but not in a config file.
+	fs.String("config", "", "Config file to read settings from (.yaml, .toml or .json)")
+}
+
+// The openLogger() function returns a jsonlog.Logger which writes to the configured
+// sinks.
+func openLogger(cfg config) (*jsonlog.Logger, error) {
+	var sinks []jsonlog.Sink
+
+	if cfg.log.stdout.enabled {
+		sinks = append(sinks, jsonlog.NewWriterSink(os.Stdout, cfg.log.format, cfg.log.stdout.level))
+	}
+
+	if cfg.log.file.path != "" {
+		file, err := jsonlog.OpenRotatingFile(jsonlog.RotateConfig{
+			Path:       cfg.log.file.path,
+			MaxSize:    int64(cfg.log.file.maxSize) * 1024 * 1024,
+			Interval:   cfg.log.file.rotateInterval,
+			MaxBackups: cfg.log.file.maxBackups,
+			MaxAge:     cfg.log.file.maxAge,
+			Compress:   cfg.log.file.compress,
+		})
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, jsonlog.NewWriteCloserSink(file, cfg.log.format, cfg.log.file.level))
+	}
+
+	if cfg.log.syslog.enabled {
+		sink, err := jsonlog.NewSyslogSink(cfg.log.syslog.address, cfg.log.syslog.tag, cfg.log.syslog.level)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+
+	var sink jsonlog.Sink = jsonlog.Multi(sinks...)
+
+	// Writing to a file or syslog can be slow, so by default the entries are buffered
+	// and written by a background goroutine. If the buffer fills up, entries are
+	// dropped rather than holding up requests, and counted in the metrics.
+	if cfg.log.bufferSize > 0 {
+		sink = jsonlog.NewAsyncSink(sink, cfg.log.bufferSize)
+	}
+
+	logger := jsonlog.NewWithSink(sink, cfg.log.level)
+
+	// Most errors are logged through the helpers in errors.go, so they're skipped when
+	// working out where an error came from. Otherwise every error would seem to come
+	// from logError().
+	err := logger.SetErrorPolicy(jsonlog.ErrorPolicy{
+		Stack:  cfg.log.errors.stack,
+		Window: cfg.log.errors.window,
+		Burst:  cfg.log.errors.burst,
+		Helpers: []string{
+			funcName((*application).logError),
+			funcName((*application).errorResponse),
+			funcName((*application).serverErrorResponse),
+		},
+	})
+	if err != nil {
+		sink.Close()
+		return nil, err
+	}
+
+	return logger, nil
+}
+
+// The funcName() function returns the full name of a function, as it appears in stack
+// traces.
+func funcName(fn any) string {
+	return runtime.FuncForPC(reflect.ValueOf(fn).Pointer()).Name()
+}
+
+// The newPasswordHasher() function returns the data.PasswordHasher for the configured
+// algorithm and parameters.
+func newPasswordHasher(cfg config) (data.PasswordHasher, error) {
+	switch cfg.password.hasher {
+	case "bcrypt":
+		if cfg.password.bcrypt.cost < bcrypt.MinCost || cfg.password.bcrypt.cost > bcrypt.MaxCost {
+			return nil, fmt.Errorf("bcrypt cost must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+		}
+		return data.BcryptHasher{Cost: cfg.password.bcrypt.cost}, nil
+	case "argon2id":
+		if cfg.password.argon2id.memory < 8*1024 || cfg.password.argon2id.iterations < 1 ||
+			cfg.password.argon2id.parallelism < 1 || cfg.password.argon2id.parallelism > 255 {
+			return nil, errors.New("argon2id parameters are out of range")
+		}
+		return data.Argon2idHasher{
+			Memory:      uint32(cfg.password.argon2id.memory),
+			Iterations:  uint32(cfg.password.argon2id.iterations),
+			Parallelism: uint8(cfg.password.argon2id.parallelism),
+			SaltLength:  16,
+			KeyLength:   32,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("invalid password hasher %q", cfg.password.hasher)
+}
+
+// The openJWTKeys() function parses the configured signing keys into a jwt.KeySet. It
+// returns a nil KeySet if no keys are configured and signed tokens aren't required.
+func openJWTKeys(cfg config) (*jwt.KeySet, error) {
+	switch cfg.token.format {
+	case "opaque", "jwt":
+	default:
+		return nil, fmt.Errorf("invalid token format %q", cfg.token.format)
+	}
+
+	if len(cfg.token.jwt.keys) == 0 {
+		if cfg.token.format == "jwt" {
+			return nil, errors.New("the jwt token format requires at least one signing key")
+		}
+		return nil, nil
+	}
+
+	keys := make([]*jwt.Key, 0, len(cfg.token.jwt.keys))
+	for _, spec := range cfg.token.jwt.keys {
+		key, err := jwt.ParseKey(spec)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	return jwt.NewKeySet(keys...)
+}
+
+// The openOIDCProvider() function returns the oidc.Provider for the configured
+// issuer, or nil if external login isn't configured. The provider itself isn't
+// contacted until the first login.
+func openOIDCProvider(cfg config) (*oidc.Provider, error) {
+	if cfg.oidc.issuer == "" {
+		return nil, nil
+	}
+
+	if cfg.oidc.clientID == "" || cfg.oidc.redirectURL == "" {
+		return nil, errors.New("OpenID Connect login requires a client ID and redirect URL")
+	}
+
+	if !slices.Contains(cfg.oidc.scopes, "openid") {
+		return nil, errors.New("OpenID Connect scopes must include openid")
+	}
+
+	return oidc.New(oidc.Config{
+		Issuer:       cfg.oidc.issuer,
+		ClientID:     cfg.oidc.clientID,
+		ClientSecret: cfg.oidc.clientSecret,
+		RedirectURL:  cfg.oidc.redirectURL,
+		Scopes:       cfg.oidc.scopes,
+	}), nil
+}
+
+// The openTracer() function sets up tracing with the configured exporter. It returns a
+// nil Tracer if tracing is disabled, in which case no spans are created at all.
+func openTracer(cfg config) (*tracing.Tracer, error) {
+	if cfg.tracing.sampleRatio < 0 || cfg.tracing.sampleRatio > 1 {
+		return nil, errors.New("trace sample ratio must be between 0 and 1")
+	}
+
+	var exporter tracing.Exporter
+
+	switch cfg.tracing.exporter {
+	case "none":
+		return nil, nil
+	case "stdout":
+		exporter = tracing.NewStdoutExporter(os.Stdout)
+	case "otlp":
+		if cfg.tracing.otlpEndpoint == "" {
+			return nil, errors.New("the otlp trace exporter requires an endpoint")
+		}
+		exporter = tracing.NewOTLPExporter(cfg.tracing.otlpEndpoint)
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %q", cfg.tracing.exporter)
+	}
+
+	return tracing.Configure(exporter, "greenlight", cfg.tracing.sampleRatio), nil
+}
+
 // The openDB() function returns a sql.DB connection pool.
 func openDB(cfg config) (*sql.DB, error) {
 	// Use sql.Open() to create an empty connection pool, using the DSN from the config
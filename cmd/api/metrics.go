@@ -0,0 +1,86 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"runtime"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/thecodephilic-guy/greenlight/internal/metrics"
+)
+
+// Define a patternRouter type which wraps httprouter.Router, so that every handler
+// records the pattern it was registered with. Version 1.3.0 of httprouter has no way of
+// telling us which route matched.
+type patternRouter struct {
+	*httprouter.Router
+}
+
+func (pr patternRouter) Handler(method, path string, handler http.Handler) {
+	pr.Router.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if pattern, ok := r.Context().Value(routePatternContextKey).(*string); ok {
+			*pattern = path
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+}
+
+func (pr patternRouter) HandlerFunc(method, path string, handler http.HandlerFunc) {
+	pr.Handler(method, path, handler)
+}
+
+// The registerMetrics() method adds the gauges and counters which are read when the
+// metrics are scraped: the database connection pool statistics, the number of
+// goroutines and background tasks, and the build information. The request metrics are
+// added by the metrics middleware.
+func (app *application) registerMetrics(db *sql.DB) {
+	reg := app.registry
+
+	reg.NewGaugeFunc("greenlight_build_info", "Build information about the running server.",
+		func() float64 { return 1 },
+		metrics.Label{Name: "version", Value: version},
+		metrics.Label{Name: "build_time", Value: buildTime},
+		metrics.Label{Name: "go_version", Value: runtime.Version()},
+	)
+
+	reg.NewGaugeFunc("go_goroutines", "Number of goroutines that currently exist.", func() float64 {
+		return float64(runtime.NumGoroutine())
+	})
+
+	reg.NewGaugeFunc("greenlight_background_tasks", "Number of background tasks (such as sending emails) currently running.", func() float64 {
+		return float64(app.backgroundTasks.Load())
+	})
+
+	reg.NewCounterFunc("greenlight_log_entries_dropped_total", "Total number of log entries dropped because the log buffer was full.", func() float64 {
+		return float64(app.logger.Dropped())
+	})
+
+	reg.NewGaugeFunc("greenlight_db_max_open_connections", "Maximum number of open connections to the database.", func() float64 {
+		return float64(db.Stats().MaxOpenConnections)
+	})
+	reg.NewGaugeFunc("greenlight_db_open_connections", "Number of established connections to the database, both in use and idle.", func() float64 {
+		return float64(db.Stats().OpenConnections)
+	})
+	reg.NewGaugeFunc("greenlight_db_in_use_connections", "Number of database connections currently in use.", func() float64 {
+		return float64(db.Stats().InUse)
+	})
+	reg.NewGaugeFunc("greenlight_db_idle_connections", "Number of idle database connections.", func() float64 {
+		return float64(db.Stats().Idle)
+	})
+	reg.NewCounterFunc("greenlight_db_wait_count_total", "Total number of times a database connection had to be waited for.", func() float64 {
+		return float64(db.Stats().WaitCount)
+	})
+	reg.NewCounterFunc("greenlight_db_wait_duration_seconds_total", "Total time spent waiting for a database connection.", func() float64 {
+		return db.Stats().WaitDuration.Seconds()
+	})
+	reg.NewCounterFunc("greenlight_db_max_idle_closed_total", "Total number of database connections closed because of the idle connection limit.", func() float64 {
+		return float64(db.Stats().MaxIdleClosed)
+	})
+	reg.NewCounterFunc("greenlight_db_max_idle_time_closed_total", "Total number of database connections closed because of the maximum idle time.", func() float64 {
+		return float64(db.Stats().MaxIdleTimeClosed)
+	})
+	reg.NewCounterFunc("greenlight_db_max_lifetime_closed_total", "Total number of database connections closed because of the maximum lifetime.", func() float64 {
+		return float64(db.Stats().MaxLifetimeClosed)
+	})
+}
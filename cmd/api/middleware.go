@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/rand"
 	"errors"
 	"expvar"
 	"fmt"
-	"net"
+	mathrand "math/rand/v2"
 	"net/http"
+	"net/url"
 	"slices"
 	"strconv"
 	"strings"
@@ -14,6 +16,9 @@ import (
 
 	"github.com/felixge/httpsnoop"
 	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/jsonlog"
+	"github.com/thecodephilic-guy/greenlight/internal/metrics"
+	"github.com/thecodephilic-guy/greenlight/internal/tracing"
 	"github.com/thecodephilic-guy/greenlight/internal/validator"
 	"golang.org/x/time/rate"
 )
@@ -84,14 +89,16 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 	//The function we are returning is a closure, which 'closes over' the limiter
 	//variable.
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Read the current limiter settings, which can change when the config is
+		// reloaded.
+		live := app.live.Load()
+
 		//only carry out checks if rate limiter is enabled:
-		if app.config.limiter.enabled {
-			//Extract the client' IP address:
-			ip, _, err := net.SplitHostPort(r.RemoteAddr)
-			if err != nil {
-				app.serverErrorResponse(w, r, err)
-				return
-			}
+		if live.limiter.enabled {
+			// Get the client's IP address. Behind a trusted proxy this is the address
+			// that the proxy reported, not the proxy's own, so that every client gets
+			// a limiter of its own.
+			ip := app.clientIP(r)
 
 			//Lock the mutex to prevent this code from executing concurrently:
 			mu.Lock()
@@ -99,7 +106,14 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 			//check and upate the map to see if an IP address is present in it
 			//if not then add it and initialize the limiter for that IP
 			if _, found := clients[ip]; !found {
-				clients[ip] = &client{limiter: rate.NewLimiter(rate.Limit(app.config.limiter.rps), app.config.limiter.burst)}
+				clients[ip] = &client{limiter: rate.NewLimiter(rate.Limit(live.limiter.rps), live.limiter.burst)}
+			}
+
+			// If the settings have been reloaded since the limiter was created, bring it
+			// up to date. The tokens it has already built up are kept.
+			if limiter := clients[ip].limiter; limiter.Limit() != rate.Limit(live.limiter.rps) || limiter.Burst() != live.limiter.burst {
+				limiter.SetLimit(rate.Limit(live.limiter.rps))
+				limiter.SetBurst(live.limiter.burst)
 			}
 
 			//Update the last seen time for the client
@@ -127,31 +141,60 @@ func (app *application) rateLimit(next http.Handler) http.Handler {
 
 func (app *application) authenticate(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// Add the "Vary: Authorization" header to the response. This indicates to any
-		// caches that the response may vary based on the value of the Authorization
-		// header in the request.
+		// Add the "Vary: Authorization" and "Vary: X-API-Key" headers to the response.
+		// This indicates to any caches that the response may vary based on the value
+		// of those headers in the request.
 		w.Header().Add("Vary", "Authorization")
+		w.Header().Add("Vary", "X-API-Key")
 
 		// Retrieve the value of the Authorization header from the request. This will
-		// return the empty string "" if there is no such header found.
+		// return the empty string "" if there is no such header found. API keys may
+		// also be sent in the X-API-Key header, which is easier for some HTTP clients.
 		authorizationHeader := r.Header.Get("Authorization")
+		apiKey := r.Header.Get("X-API-Key")
 
-		// If there is no Authorization header found, use the contextSetUser() helper
-		// that we just made to add the AnonymousUser to the request context. Then we
-		// call the next handler in the chain and return without executing any of the
-		// code below.
-		if authorizationHeader == "" {
+		// If there is no Authorization or X-API-Key header found, use the
+		// contextSetUser() helper that we just made to add the AnonymousUser to the
+		// request context. Then we call the next handler in the chain and return
+		// without executing any of the code below.
+		if authorizationHeader == "" && apiKey == "" {
 			r = app.contextSetUser(r, data.AnonymousUser)
 			next.ServeHTTP(w, r)
 			return
 		}
 
+		// If there is an API key in the X-API-Key header (and no Authorization header to
+		// conflict with it), authenticate with that.
+		if authorizationHeader == "" {
+			app.authenticateAPIKey(w, r, next, apiKey)
+			return
+		}
+
 		// Otherwise, we expect the value of the Authorization header to be in the format
-		// "Bearer <token>". We try to split this into its constituent parts, and if the
-		// header isn't in the expected format we return a 401 Unauthorized response
-		// using the invalidAuthenticationTokenResponse() helper
+		// "Bearer <token>" or "ApiKey <key>". We try to split this into its constituent
+		// parts, and if the header isn't in the expected format (or disagrees with the
+		// X-API-Key header) we return a 401 Unauthorized response using the
+		// invalidAuthenticationTokenResponse() helper
 		headerParts := strings.Split(authorizationHeader, " ")
-		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
+		if len(headerParts) != 2 || (apiKey != "" && headerParts[1] != apiKey) {
+			app.invalidAuthenticationTokenResponse(w, r)
+			return
+		}
+
+		switch headerParts[0] {
+		case "Bearer":
+		case "ApiKey":
+			app.authenticateAPIKey(w, r, next, headerParts[1])
+			return
+		case "Basic":
+			// OAuth clients authenticate to the token, introspection and revocation
+			// endpoints with HTTP basic authentication. They aren't users, so the
+			// request carries on as anonymous and those handlers check the
+			// credentials themselves.
+			r = app.contextSetUser(r, data.AnonymousUser)
+			next.ServeHTTP(w, r)
+			return
+		default:
 			app.invalidAuthenticationTokenResponse(w, r)
 			return
 		}
@@ -159,6 +202,54 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 		//Extact the token
 		token := headerParts[1]
 
+		// Tokens issued to OAuth clients have their own prefix, and only grant the
+		// permissions that the user consented to.
+		if strings.HasPrefix(token, data.OAuthTokenPrefix) {
+			app.authenticateOAuthToken(w, r, next, token)
+			return
+		}
+
+		// Signed access tokens carry the user ID and permissions in their claims, so
+		// they can be verified with nothing more than a (usually cached) check that the
+		// user hasn't been blocked or deactivated since.
+		if app.isSignedToken(token) {
+			user, claims, err := app.userForSignedToken(token)
+			if err != nil {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			// The claims can't be taken back once the token is issued, so we check the
+			// user's current state as well. Tokens belonging to a blocked or deleted
+			// user are rejected, just like opaque tokens (whose rows are deleted), and
+			// the activation state comes from the user record rather than the claims,
+			// so that requireActivatedUser() turns a deactivated user away.
+			account, err := app.cache.userForID(r.Context(), app.models, user.ID)
+			if err != nil {
+				switch {
+				case errors.Is(err, data.ErrRecordNotFound):
+					app.invalidAuthenticationTokenResponse(w, r)
+				default:
+					app.serverErrorResponse(w, r, err)
+				}
+				return
+			}
+
+			if account.Blocked {
+				app.invalidAuthenticationTokenResponse(w, r)
+				return
+			}
+
+			user.Activated = account.Activated
+
+			r = app.contextSetUser(r, user)
+			r = app.contextSetPermissions(r, claims.Permissions)
+			r = app.contextSetTwoFactor(r, claims.TwoFactor)
+
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		// Validate the token
 		v := validator.New()
 
@@ -169,9 +260,9 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		// Retrieve the details of the user associated with the authentication token,
 		// again calling the invalidAuthenticationTokenResponse() helper if no
-		// matching record was found. IMPORTANT: Notice that we are using
-		// ScopeAuthentication as the first parameter here.
-		user, err := app.models.Users.GetForToken(data.ScopeAuthentication, token)
+		// matching record was found. The lookup goes through the cache, which only
+		// queries the database (with ScopeAuthentication) on a miss.
+		user, err := app.cache.userForToken(r.Context(), app.models, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
@@ -189,6 +280,82 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 	})
 }
 
+// The authenticateAPIKey() method authenticates a request using a long-lived API key.
+// The user's permissions are restricted to the ones granted to the key, and those are
+// added to the request context so that requirePermission() uses them.
+func (app *application) authenticateAPIKey(w http.ResponseWriter, r *http.Request, next http.Handler, key string) {
+	v := validator.New()
+
+	if data.ValidateAPIKeyPlaintext(v, key); !v.Valid() {
+		app.invalidAPIKeyResponse(w, r)
+		return
+	}
+
+	user, keyPermissions, err := app.models.Users.GetForAPIKey(r.Context(), key)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAPIKeyResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// The owner may have lost some permissions since the key was created, so we only
+	// keep the codes that the owner still holds.
+	permissions, err := app.cache.permissionsForUser(r.Context(), app.models, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Keys can only be created with permissions that need two-factor authentication
+	// if the owner had it enabled at the time, so we treat the check as satisfied.
+	r = app.contextSetUser(r, user)
+	r = app.contextSetPermissions(r, keyPermissions.Intersect(permissions))
+	r = app.contextSetTwoFactor(r, true)
+	r = app.contextSetDelegated(r)
+
+	next.ServeHTTP(w, r)
+}
+
+// The authenticateOAuthToken() method authenticates a request using an access token
+// issued to an OAuth client. Just like API keys, the user's permissions are restricted
+// to the ones granted to the token.
+func (app *application) authenticateOAuthToken(w http.ResponseWriter, r *http.Request, next http.Handler, plaintext string) {
+	if !data.ValidOAuthTokenPlaintext(plaintext) {
+		app.invalidAuthenticationTokenResponse(w, r)
+		return
+	}
+
+	token, user, err := app.models.OAuth.GetAccessToken(plaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.invalidAuthenticationTokenResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	permissions, err := app.cache.permissionsForUser(r.Context(), app.models, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Permissions which need two-factor authentication can only be delegated by users
+	// who have it enabled, so we treat the check as satisfied.
+	r = app.contextSetUser(r, user)
+	r = app.contextSetPermissions(r, token.Permissions.Intersect(permissions))
+	r = app.contextSetTwoFactor(r, true)
+	r = app.contextSetDelegated(r)
+
+	next.ServeHTTP(w, r)
+}
+
 func (app *application) requireAuthenticatedUser(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		user := app.contextGetUser(r)
@@ -221,16 +388,40 @@ func (app *application) requireActivatedUser(next http.HandlerFunc) http.Handler
 	return app.requireAuthenticatedUser(fn)
 }
 
+// The requireUserSession() middleware only lets through activated users who
+// authenticated as themselves. Endpoints which hand out or manage delegated access use
+// it, so that an API key or OAuth token can't be used to grant itself more, and so do
+// the endpoints which change how the account is secured (the password, two-factor
+// authentication and login history), which a delegated credential has no business with.
+func (app *application) requireUserSession(next http.HandlerFunc) http.HandlerFunc {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if app.contextIsDelegated(r) {
+			app.delegatedCredentialResponse(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
 func (app *application) requirePermission(code string, next http.HandlerFunc) http.HandlerFunc {
 	fn := func(w http.ResponseWriter, r *http.Request) {
 		// Retrive the user from the req context
 		user := app.contextGetUser(r)
 
-		//Get the clise of permissions for the user.
-		permissions, err := app.models.Permissions.GetAllForUser(user.ID)
-		if err != nil {
-			app.serverErrorResponse(w, r, err)
-			return
+		// Use the permissions from the request context if the authenticate middleware
+		// already knows them, otherwise get the slice of permissions for the user
+		// (from the cache if possible).
+		permissions, ok := app.contextGetPermissions(r)
+		if !ok {
+			var err error
+			permissions, err = app.cache.permissionsForUser(r.Context(), app.models, user.ID)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
 		}
 
 		// Check if the slice includes the required permission. If it does not
@@ -240,6 +431,25 @@ func (app *application) requirePermission(code string, next http.HandlerFunc) ht
 			return
 		}
 
+		// Some permissions can only be used by accounts which have two-factor
+		// authentication enabled.
+		if slices.Contains(app.config.totp.requiredPermissions, code) {
+			enabled, ok := app.contextGetTwoFactor(r)
+			if !ok {
+				var err error
+				enabled, err = app.models.TOTP.IsEnabled(user.ID)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+			}
+
+			if !enabled {
+				app.twoFactorRequiredResponse(w, r)
+				return
+			}
+		}
+
 		// Otherwise they have the req permission so call next
 		next.ServeHTTP(w, r)
 	}
@@ -257,10 +467,14 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 		// Get the value of the request's Origin header.
 		origin := r.Header.Get("Origin")
 		// only run this if there's an Origin Request header present AND at lest
-		// one trusted origin is configured.
-		if origin != "" && len(app.config.cors.trustedOrigins) != 0 {
-			if slices.Contains(app.config.cors.trustedOrigins, origin) {
+		// one trusted origin is configured. The trusted origins can change when the
+		// config is reloaded.
+		trustedOrigins := app.live.Load().cors.trustedOrigins
+		if origin != "" && len(trustedOrigins) != 0 {
+			if slices.Contains(trustedOrigins, origin) {
 				w.Header().Set("Access-Control-Allow-Origin", origin)
+				// Let browser clients read the request ID, so it can go in bug reports.
+				w.Header().Set("Access-Control-Expose-Headers", "X-Request-ID")
 
 				//Check if the request has the HTTP method OPTIONS and contains the
 				// "Access-Control-Request-Method" header. If it does, then we
@@ -268,7 +482,7 @@ func (app *application) enableCORS(next http.Handler) http.Handler {
 				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
 					// Set the necessary preflight response headers
 					w.Header().Set("Access-Control-Allow-Methods", "OPTIONS, PUT, PATCH, DELETE")
-					w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+					w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Request-ID")
 
 					//Write the headers along with a 200 OK status and return
 					// from the middleware with no furhter action.
@@ -290,11 +504,21 @@ func (app *application) metrics(next http.Handler) http.Handler {
 	totalProcessingTimeMicroseconds := expvar.NewInt("total_processing_time_μs")
 	totalResponsesSentByStatus := expvar.NewMap("total_responses_sent_by_status")
 
+	// Along with the Prometheus histograms, which are labelled by route pattern, method
+	// and status code.
+	requestDuration := app.registry.NewHistogramVec("greenlight_http_request_duration_seconds",
+		"Time taken to handle HTTP requests.", metrics.DefaultBuckets, "route", "method", "status")
+	responseSize := app.registry.NewHistogramVec("greenlight_http_response_size_bytes",
+		"Size of HTTP response bodies.", metrics.ExponentialBuckets(100, 10, 6), "route", "method", "status")
+
 	// The following code will be run for every requests...
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Use the Add() method to increment the number of requests received by 1
 		totalRequestReceived.Add(1)
 
+		// Give the router somewhere to record the pattern of the route that matched.
+		r, pattern := withRoutePattern(r)
+
 		// Call the httpsnoop.CaptureMetrics() function, passing in the next handler in
 		// the chain along with the existing http.ResponseWriter and http.Request. This
 		// returns the metrics struct that we saw above.
@@ -309,5 +533,182 @@ func (app *application) metrics(next http.Handler) http.Handler {
 		// Note that the expvar map is string-keyed, so we need to use the strconv.Itoa()
 		// function to convert the status code (which is an integer) to a string.
 		totalResponsesSentByStatus.Add(strconv.Itoa(metrics.Code), 1)
+
+		// Requests which didn't match any route (404s, 405s and CORS preflight
+		// requests) are all counted together.
+		route := *pattern
+		if route == "" {
+			route = "unmatched"
+		}
+
+		status := strconv.Itoa(metrics.Code)
+		method := metricsMethod(r.Method)
+
+		requestDuration.Observe(metrics.Duration.Seconds(), route, method, status)
+		responseSize.Observe(float64(metrics.Written), route, method, status)
+	})
+}
+
+// The metricsMethod() helper returns the method label for a request. Clients can send
+// any method they like, and every different label value is a new series which lives
+// for as long as the server does, so methods outside the standard set are all counted
+// as "OTHER".
+func metricsMethod(method string) string {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+		http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace:
+		return method
+	default:
+		return "OTHER"
+	}
+}
+
+// The tracing() middleware starts a server span for every request, which the spans for
+// database queries, password hashing and emails are children of. If the client sent a
+// traceparent header, the span joins the client's trace. It must run inside metrics(),
+// which gives the router somewhere to record the matched route pattern.
+func (app *application) tracing(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+
+		// A malformed header is ignored, and a new trace is started instead.
+		if parent, ok := tracing.ParseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = tracing.ContextWithRemoteParent(ctx, parent)
+		}
+
+		ctx, span := tracing.StartKind(ctx, tracing.KindServer, r.Method,
+			tracing.Attr("http.request.method", r.Method),
+			tracing.Attr("url.path", r.URL.Path),
+			tracing.Attr("client.address", app.clientIP(r)),
+			tracing.Attr("user_agent.original", r.UserAgent()),
+		)
+		defer span.End()
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r.WithContext(ctx))
+
+		// The span is named after the route rather than the path, so that requests for
+		// different movies are grouped together.
+		if pattern, ok := r.Context().Value(routePatternContextKey).(*string); ok && *pattern != "" {
+			span.SetName(r.Method + " " + *pattern)
+			span.SetAttributes(tracing.Attr("http.route", *pattern))
+		}
+
+		span.SetAttributes(tracing.Attr("http.response.status_code", metrics.Code))
+
+		if metrics.Code >= 500 {
+			span.RecordError(errors.New(http.StatusText(metrics.Code)))
+		}
+	})
+}
+
+// The requestID() middleware gives every request an ID, which is added to the request
+// context, returned in the X-Request-ID response header, and included in every log
+// entry written while handling the request. If the client (or a proxy in front of us)
+// already sent an ID we keep it, so that the same ID can be followed across services.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+
+		// IDs from the client end up in our logs, so anything unusual is replaced rather
+		// than trusted.
+		if !validRequestID(id) {
+			id = rand.Text()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+
+		next.ServeHTTP(w, app.contextSetRequestID(r, id))
 	})
 }
+
+// The validRequestID() helper reports whether a request ID sent by a client is safe to
+// use: between 1 and 128 characters long, made up of letters, digits, dashes,
+// underscores, dots and colons.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// The accessLog() middleware writes a log entry for each request once it has been
+// handled. Requests which failed (with a 4xx or 5xx status) or were slower than the
+// threshold are always written, and successful ones are sampled at the configured
+// rate, so that busy servers can keep the volume down. It must run inside metrics(),
+// which gives the router somewhere to record the matched route pattern.
+func (app *application) accessLog(next http.Handler) http.Handler {
+	if !app.config.accessLog.enabled {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r, userID := withAccessLogUser(r)
+
+		metrics := httpsnoop.CaptureMetrics(next, w, r)
+
+		failed := metrics.Code >= 400
+		slow := metrics.Duration >= app.config.accessLog.slowThreshold
+
+		if !failed && !slow && mathrand.Float64() >= app.config.accessLog.sampleRate {
+			return
+		}
+
+		attrs := []jsonlog.Attr{
+			jsonlog.String("request_id", app.contextGetRequestID(r)),
+			jsonlog.String("method", r.Method),
+			jsonlog.String("path", app.redactedURL(r.URL)),
+			jsonlog.Int("status", metrics.Code),
+			jsonlog.Int64("bytes", metrics.Written),
+			jsonlog.Duration("duration", metrics.Duration),
+			jsonlog.String("client_ip", app.clientIP(r)),
+			jsonlog.String("user_agent", r.UserAgent()),
+		}
+
+		if pattern, ok := r.Context().Value(routePatternContextKey).(*string); ok && *pattern != "" {
+			attrs = append(attrs, jsonlog.String("route", *pattern))
+		}
+
+		if *userID != 0 {
+			attrs = append(attrs, jsonlog.Int64("user_id", *userID))
+		}
+
+		if slow {
+			attrs = append(attrs, jsonlog.Bool("slow", true))
+		}
+
+		app.logger.Info("request", attrs...)
+	})
+}
+
+// The redactedURL() helper returns the path and query string of a URL, with the values
+// of any sensitive query parameters replaced, so that tokens and codes sent in query
+// strings don't end up in the logs.
+func (app *application) redactedURL(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+
+	query := u.Query()
+
+	for key, values := range query {
+		if slices.ContainsFunc(app.config.accessLog.redactParams, func(param string) bool {
+			return strings.EqualFold(param, key)
+		}) {
+			for i := range values {
+				values[i] = "REDACTED"
+			}
+		}
+	}
+
+	return u.Path + "?" + query.Encode()
+}
@@ -29,12 +29,16 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	// Copy the values from the input struct to a new Movie struct.
+	// Copy the values from the input struct to a new Movie struct, recording the user
+	// who created it as the owner.
+	user := app.contextGetUser(r)
+
 	movie := &data.Movie{
-		Title:   input.Title,
-		Year:    input.Year,
-		Runtime: input.Runtime,
-		Genres:  input.Genres,
+		Title:     input.Title,
+		Year:      input.Year,
+		Runtime:   input.Runtime,
+		Genres:    input.Genres,
+		CreatedBy: &user.ID,
 	}
 
 	// Initialize a new Validator instance:
@@ -48,7 +52,7 @@ func (app *application) createMovieHandler(w http.ResponseWriter, r *http.Reques
 	//Now calling the Insert() method on our movie model, passing in a pointer to the
 	//validated movie struct. This will create a record in the database and update the
 	//movie struct with the system-generated information.
-	err = app.models.Movies.Insert(movie)
+	err = app.models.Movies.Insert(r.Context(), movie)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -76,7 +80,7 @@ func (app *application) showMovieHandler(w http.ResponseWriter, r *http.Request)
 		return
 	}
 
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -103,7 +107,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	//Fetching the record from DB to make sure it exists:
-	movie, err := app.models.Movies.Get(id)
+	movie, err := app.models.Movies.Get(r.Context(), id)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -114,6 +118,11 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Now that we have the record, check that the policy lets this user change it.
+	if !authorize(app, w, r, moviePolicy, actionUpdate, movie) {
+		return
+	}
+
 	// If the request contains a X-Expected-Version header, verify that the movie
 	// version in the database matches the expected version specified in the header.
 	if r.Header.Get("X-Expected-Version") != "" {
@@ -175,7 +184,7 @@ func (app *application) updateMovieHandler(w http.ResponseWriter, r *http.Reques
 	}
 
 	// Now update the DB:
-	err = app.models.Movies.Update(movie)
+	err = app.models.Movies.Update(r.Context(), movie)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -201,8 +210,24 @@ func (app *application) deleteMovieHandler(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
+	// Fetch the record first, so that the policy can check who owns it.
+	movie, err := app.models.Movies.Get(r.Context(), id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if !authorize(app, w, r, moviePolicy, actionDelete, movie) {
+		return
+	}
+
 	//Deleting the movie data from the databse and sending 404 not found if not present:
-	err = app.models.Movies.Delete(id)
+	err = app.models.Movies.Delete(r.Context(), movie.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -256,7 +281,7 @@ func (app *application) listMoviesHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	movies, metadata, err := app.models.Movies.GetAll(input.Title, input.Genres, input.Filters)
+	movies, metadata, err := app.models.Movies.GetAll(r.Context(), input.Title, input.Genres, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -0,0 +1,632 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/oidc"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// Authorization codes have to be exchanged for an access token straight away.
+const oauthCodeTTL = 5 * time.Minute
+
+// POST /v1/oauth/clients
+func (app *application) createOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name         string   `json:"name"`
+		RedirectURIs []string `json:"redirect_uris"`
+		Scopes       []string `json:"scopes"`
+		Confidential *bool    `json:"confidential"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Clients are confidential (they have a secret) unless they say otherwise.
+	client := &data.OAuthClient{
+		UserID:       user.ID,
+		Name:         input.Name,
+		RedirectURIs: input.RedirectURIs,
+		Scopes:       input.Scopes,
+		Confidential: input.Confidential == nil || *input.Confidential,
+	}
+
+	v := validator.New()
+
+	data.ValidateOAuthClient(v, client)
+
+	// Scopes are permission codes, so they have to be ones that exist.
+	permissions, err := app.models.Permissions.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	for _, scope := range client.Scopes {
+		if !permissions.Include(scope) {
+			v.AddError("scopes", fmt.Sprintf("must only contain existing permissions (%q does not exist)", scope))
+			break
+		}
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	err = app.models.OAuth.InsertClient(client)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// The secret is included in this response and never again.
+	err = app.writeJSON(w, http.StatusCreated, envelop{"client": client}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/oauth/clients
+func (app *application) listOAuthClientsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	clients, err := app.models.OAuth.GetClientsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"clients": clients}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/oauth/clients/:id
+func (app *application) deleteOAuthClientHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Deleting a client also deletes every token issued to it, so it's a quick way
+	// to cut off an application that has been compromised.
+	err = app.models.OAuth.DeleteClient(id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "client successfully deleted"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// Define an authorizationRequest struct to hold the parameters of an authorization
+// request. Our frontend receives these from the client in the query string, and passes
+// them on to the authorize endpoints.
+type authorizationRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+}
+
+// The checkAuthorizationRequest() helper validates an authorization request, and
+// returns the client and the scopes that it asked for. If no scopes were asked for,
+// all of the client's scopes are used. PKCE is required for every client.
+func (app *application) checkAuthorizationRequest(v *validator.Validator, req authorizationRequest) (*data.OAuthClient, data.Permissions, error) {
+	v.Check(req.ClientID != "", "client_id", "must be provided")
+	v.Check(req.RedirectURI != "", "redirect_uri", "must be provided")
+
+	if !v.Valid() {
+		return nil, nil, nil
+	}
+
+	client, err := app.models.OAuth.GetClient(req.ClientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("client_id", "must be a registered client")
+			return nil, nil, nil
+		default:
+			return nil, nil, err
+		}
+	}
+
+	// Only ever send codes to a URI that was registered for the client, compared
+	// exactly, otherwise anyone could have them sent to their own server.
+	v.Check(slices.Contains(client.RedirectURIs, req.RedirectURI), "redirect_uri", "must be registered for the client")
+	v.Check(req.ResponseType == "code", "response_type", `must be "code"`)
+	v.Check(req.CodeChallenge != "", "code_challenge", "must be provided")
+	v.Check(len(req.CodeChallenge) <= 128, "code_challenge", "must not be more than 128 bytes long")
+	v.Check(req.CodeChallengeMethod == "S256", "code_challenge_method", `must be "S256"`)
+
+	scopes := data.Permissions(strings.Fields(req.Scope))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+
+	for _, scope := range scopes {
+		if !client.Scopes.Include(scope) {
+			v.AddError("scope", fmt.Sprintf("must only contain scopes registered for the client (%q is not)", scope))
+			break
+		}
+	}
+
+	return client, scopes, nil
+}
+
+// GET /v1/oauth/authorize
+func (app *application) showAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	req := authorizationRequest{
+		ResponseType:        qs.Get("response_type"),
+		ClientID:            qs.Get("client_id"),
+		RedirectURI:         qs.Get("redirect_uri"),
+		Scope:               qs.Get("scope"),
+		State:               qs.Get("state"),
+		CodeChallenge:       qs.Get("code_challenge"),
+		CodeChallengeMethod: qs.Get("code_challenge_method"),
+	}
+
+	v := validator.New()
+
+	client, scopes, err := app.checkAuthorizationRequest(v, req)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Tell the frontend whether the user has already agreed to all of these scopes,
+	// in which case it can approve the request without asking again.
+	consented, err := app.models.OAuth.GetConsent(user.ID, client.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelop{
+		"client": envelop{
+			"client_id": client.ClientID,
+			"name":      client.Name,
+		},
+		"scopes":           scopes,
+		"consent_required": len(scopes.Intersect(consented)) != len(scopes),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/oauth/authorize
+func (app *application) approveAuthorizationHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		authorizationRequest
+		Approve bool `json:"approve"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	client, scopes, err := app.checkAuthorizationRequest(v, input.authorizationRequest)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// The response holds the URI that the frontend should send the user back to,
+	// with either the code or an error in the query string.
+	redirect, err := url.Parse(input.RedirectURI)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	params := redirect.Query()
+	if input.State != "" {
+		params.Set("state", input.State)
+	}
+
+	user := app.contextGetUser(r)
+
+	if !input.Approve {
+		params.Set("error", "access_denied")
+		redirect.RawQuery = params.Encode()
+
+		err = app.writeJSON(w, http.StatusOK, envelop{"redirect_uri": redirect.String()}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Requests made with an OAuth token skip the two-factor check, just like API keys,
+	// so permissions which need a second factor can only be delegated by users who
+	// have one.
+	ok, err := app.canDelegate(user.ID, scopes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.twoFactorRequiredResponse(w, r)
+		return
+	}
+
+	err = app.models.OAuth.AddConsent(user.ID, client.ID, scopes)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	code := &data.OAuthToken{
+		Token:         data.Token{UserID: user.ID, Scope: data.ScopeOAuthCode},
+		ClientID:      client.ID,
+		Permissions:   scopes,
+		CodeChallenge: input.CodeChallenge,
+		RedirectURI:   input.RedirectURI,
+	}
+
+	err = app.models.OAuth.NewToken(code, oauthCodeTTL)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	params.Set("code", code.Plaintext)
+	redirect.RawQuery = params.Encode()
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"redirect_uri": redirect.String()}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The canDelegate() helper reports whether a user may hand the permissions to a third
+// party. Permissions which need two-factor authentication can only be delegated by
+// users who have it enabled.
+func (app *application) canDelegate(userID int64, permissions data.Permissions) (bool, error) {
+	if !slices.ContainsFunc(permissions, func(code string) bool {
+		return slices.Contains(app.config.totp.requiredPermissions, code)
+	}) {
+		return true, nil
+	}
+
+	return app.models.TOTP.IsEnabled(userID)
+}
+
+// The readOAuthForm() helper parses the form-encoded body which the token,
+// introspection and revocation endpoints use, and authenticates the client. Clients
+// send their credentials with HTTP basic authentication, or in the body. Confidential
+// clients must send their secret, and public clients just send their client ID. An
+// error response is sent if the client can't be authenticated, and nil is returned.
+func (app *application) readOAuthForm(w http.ResponseWriter, r *http.Request) (url.Values, *data.OAuthClient) {
+	r.Body = http.MaxBytesReader(w, r.Body, 1_048_576)
+
+	err := r.ParseForm()
+	if err != nil {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "the request body must be form-encoded")
+		return nil, nil
+	}
+
+	form := r.PostForm
+
+	clientID, secret, basic := r.BasicAuth()
+	if basic {
+		// The credentials are form-encoded before they're put in the header.
+		clientID, _ = url.QueryUnescape(clientID)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		clientID, secret = form.Get("client_id"), form.Get("client_secret")
+	}
+
+	if clientID == "" {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication is required")
+		return nil, nil
+	}
+
+	client, err := app.models.OAuth.GetClient(clientID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return nil, nil
+	}
+
+	if client.Confidential != (secret != "") || (client.Confidential && !client.MatchesSecret(secret)) {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "client authentication failed")
+		return nil, nil
+	}
+
+	return form, client
+}
+
+// POST /v1/oauth/token
+func (app *application) createOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	form, client := app.readOAuthForm(w, r)
+	if client == nil {
+		return
+	}
+
+	token := &data.OAuthToken{
+		Token:    data.Token{Scope: data.ScopeOAuthAccess},
+		ClientID: client.ID,
+	}
+
+	switch form.Get("grant_type") {
+	case "authorization_code":
+		code := form.Get("code")
+		verifier := form.Get("code_verifier")
+
+		if code == "" || verifier == "" {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "code and code_verifier must be provided")
+			return
+		}
+
+		// Using the code deletes it, whether or not the rest of the checks pass, so
+		// that a stolen code can't be tried again.
+		var grant *data.OAuthToken
+		if data.ValidOAuthTokenPlaintext(code) {
+			var err error
+			grant, err = app.models.OAuth.UseCode(code)
+			if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		challenge := oidc.Challenge(verifier)
+
+		if grant == nil || grant.ClientID != client.ID || grant.RedirectURI != form.Get("redirect_uri") ||
+			subtle.ConstantTimeCompare([]byte(challenge), []byte(grant.CodeChallenge)) != 1 {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_grant", "invalid, expired or already used authorization code")
+			return
+		}
+
+		token.UserID = grant.UserID
+		token.Permissions = grant.Permissions
+
+	case "client_credentials":
+		// Public clients can't prove who they are, so they can't act for themselves.
+		if !client.Confidential {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "unauthorized_client", "public clients can't use the client_credentials grant")
+			return
+		}
+
+		scopes := data.Permissions(strings.Fields(form.Get("scope")))
+		if len(scopes) == 0 {
+			scopes = client.Scopes
+		}
+
+		for _, scope := range scopes {
+			if !client.Scopes.Include(scope) {
+				app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", fmt.Sprintf("%q is not registered for the client", scope))
+				return
+			}
+		}
+
+		// The client acts as the user who registered it, so it's held to the same
+		// rules as that user's API keys.
+		ok, err := app.canDelegate(client.UserID, scopes)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_scope", "the client's owner must enable two-factor authentication to delegate these scopes")
+			return
+		}
+
+		token.UserID = client.UserID
+		token.Permissions = scopes
+
+	default:
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "unsupported_grant_type", "")
+		return
+	}
+
+	ttl := app.config.oauth.accessTokenTTL
+
+	err := app.models.OAuth.NewToken(token, ttl)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Token responses must never be cached (RFC 6749 section 5.1).
+	headers := http.Header{}
+	headers.Set("Cache-Control", "no-store")
+
+	env := envelop{
+		"access_token": token.Plaintext,
+		"token_type":   "Bearer",
+		"expires_in":   int(ttl.Seconds()),
+		"scope":        strings.Join(token.Permissions, " "),
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/oauth/introspect
+func (app *application) introspectOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	form, client := app.readOAuthForm(w, r)
+	if client == nil {
+		return
+	}
+
+	if !client.Confidential {
+		app.oauthErrorResponse(w, r, http.StatusUnauthorized, "invalid_client", "only confidential clients can introspect tokens")
+		return
+	}
+
+	plaintext := form.Get("token")
+
+	// A client can only find out about its own tokens. Everything else, including
+	// tokens which don't exist, is reported as inactive (RFC 7662 section 2.2).
+	var (
+		token *data.OAuthToken
+		user  *data.User
+	)
+
+	if data.ValidOAuthTokenPlaintext(plaintext) {
+		var err error
+		token, user, err = app.models.OAuth.GetAccessToken(plaintext)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	headers := http.Header{}
+	headers.Set("Cache-Control", "no-store")
+
+	if token == nil || token.ClientID != client.ID {
+		err := app.writeJSON(w, http.StatusOK, envelop{"active": false}, headers)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelop{
+		"active":     true,
+		"scope":      strings.Join(token.Permissions, " "),
+		"client_id":  client.ClientID,
+		"username":   user.Email,
+		"token_type": "Bearer",
+		"exp":        token.ExpiryTime.Unix(),
+		"sub":        strconv.FormatInt(user.ID, 10),
+	}
+
+	err := app.writeJSON(w, http.StatusOK, env, headers)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/oauth/revoke
+func (app *application) revokeOAuthTokenHandler(w http.ResponseWriter, r *http.Request) {
+	form, client := app.readOAuthForm(w, r)
+	if client == nil {
+		return
+	}
+
+	plaintext := form.Get("token")
+	if plaintext == "" {
+		app.oauthErrorResponse(w, r, http.StatusBadRequest, "invalid_request", "token must be provided")
+		return
+	}
+
+	// Revoking a token which doesn't exist (or which belongs to another client)
+	// quietly succeeds, as RFC 7009 requires.
+	if data.ValidOAuthTokenPlaintext(plaintext) {
+		err := app.models.OAuth.RevokeToken(plaintext, client.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+// GET /v1/users/me/oauth-consents
+func (app *application) listOAuthConsentsHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	consents, err := app.models.OAuth.GetConsentsForUser(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"consents": consents}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/users/me/oauth-consents/:id
+func (app *application) deleteOAuthConsentHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := app.readIdParams(r)
+	if err != nil {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Withdrawing consent also deletes the client's tokens for the user, so that the
+	// client loses access straight away.
+	err = app.models.OAuth.DeleteConsent(user.ID, id)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "consent successfully withdrawn"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/oidc"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// GET /v1/oidc/login
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	// The state ties the callback to this login, the nonce ties the ID token to it,
+	// and the PKCE code verifier proves that whoever redeems the authorization code is
+	// whoever started the login.
+	login := &data.OIDCLogin{ExpiryTime: time.Now().Add(10 * time.Minute)}
+
+	for _, dst := range []*string{&login.State, &login.Nonce, &login.CodeVerifier} {
+		value, err := oidc.GenerateVerifier()
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		*dst = value
+	}
+
+	err := app.models.Identities.InsertLogin(login)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	authURL, err := app.oidc.AuthCodeURL(r.Context(), login.State, login.Nonce, login.CodeVerifier)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"authorization_url": authURL}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/oidc/callback
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	qs := r.URL.Query()
+
+	v := validator.New()
+
+	// If the user cancelled, or the provider refused, there is an error instead of a
+	// code.
+	if providerErr := qs.Get("error"); providerErr != "" {
+		v.AddError("error", fmt.Sprintf("the identity provider returned %q", providerErr))
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	code := qs.Get("code")
+	state := qs.Get("state")
+
+	v.Check(code != "", "code", "must be provided")
+	v.Check(state != "", "state", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	login, err := app.models.Identities.UseLogin(state)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired login")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	claims, err := app.oidc.Exchange(r.Context(), code, login.CodeVerifier, login.Nonce)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrInvalidIDToken):
+			app.logError(r, err)
+
+			err = app.recordLoginAttempt(r, loginMethodOIDC, data.LoginFailure, "", nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			app.invalidCredentialsResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	user, err := app.userForIdentity(r, claims)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notPermittedResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.completeLogin(w, r, loginMethodOIDC, user)
+}
+
+// The userForIdentity() helper returns the user for the identity in an ID token. An
+// identity which hasn't been seen before is linked to the user with the same email
+// address, but only if the provider says that it has verified the address. Failing
+// that, a new user is created if auto-provisioning is enabled, unless registration is
+// invite-only: anybody can get an account with the provider, so provisioning would be
+// a way around the invitations. ErrRecordNotFound is returned if there is no user for
+// the identity.
+func (app *application) userForIdentity(r *http.Request, claims *oidc.Claims) (*data.User, error) {
+	user, err := app.models.Identities.GetUser(claims.Issuer, claims.Subject)
+	if err == nil || !errors.Is(err, data.ErrRecordNotFound) {
+		return user, err
+	}
+
+	if claims.Email == "" || !claims.EmailVerified {
+		return nil, data.ErrRecordNotFound
+	}
+
+	user, err = app.models.Users.GetByEmail(r.Context(), claims.Email)
+	switch {
+	case err == nil:
+	case errors.Is(err, data.ErrRecordNotFound) && app.config.oidc.autoProvision && !app.config.registration.inviteOnly:
+		user, err = app.provisionUser(r, claims)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	err = app.models.Identities.Link(user.ID, claims.Issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
+
+// The provisionUser() helper creates a new user for an identity. The provider has
+// verified the email address, so the user is activated straight away. They are given a
+// random password which nobody knows, so they log in through the provider (or with a
+// magic link, if those are enabled).
+func (app *application) provisionUser(r *http.Request, claims *oidc.Claims) (*data.User, error) {
+	name := strings.TrimSpace(claims.Name)
+	if name == "" {
+		name, _, _ = strings.Cut(claims.Email, "@")
+	}
+
+	user := &data.User{
+		Name:      name,
+		Email:     claims.Email,
+		Activated: true,
+	}
+
+	err := user.Password.Set(r.Context(), rand.Text())
+	if err != nil {
+		return nil, err
+	}
+
+	v := validator.New()
+
+	if data.ValidateUser(v, user); !v.Valid() {
+		return nil, fmt.Errorf("identity %q can't be provisioned: %v", claims.Subject, v.Errors)
+	}
+
+	err = app.models.Users.Insert(r.Context(), user)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.models.Roles.AddDefaultForUser(user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	err = app.audit(r, "user.provisioned", user.ID, map[string]any{"issuer": claims.Issuer, "subject": claims.Subject})
+	if err != nil {
+		return nil, err
+	}
+
+	return user, nil
+}
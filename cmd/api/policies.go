@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/thecodephilic-guy/greenlight/internal/authz"
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+)
+
+// The actions which are checked against a policy after a record has been loaded.
+const (
+	actionUpdate = "update"
+	actionDelete = "delete"
+)
+
+// ownsMovie allows the user who created a movie. Movies created before ownership was
+// recorded have no owner, so nobody owns them.
+func ownsMovie(subject authz.Subject, movie *data.Movie) bool {
+	return movie.CreatedBy != nil && *movie.CreatedBy == subject.UserID
+}
+
+// unownedMovie allows anybody to change a movie which was created before ownership was
+// recorded. Before then every user with movies:write could change every movie, and
+// this keeps it that way for those movies.
+func unownedMovie(subject authz.Subject, movie *data.Movie) bool {
+	return movie.CreatedBy == nil
+}
+
+// moviePolicy decides who may change a movie: users with movies:write may change the
+// movies they created and the movies which have no owner, and users with
+// movies:write-any may change any movie.
+var moviePolicy = authz.NewPolicy[*data.Movie]().
+	Allow(actionUpdate,
+		authz.All(authz.HasPermission[*data.Movie]("movies:write"), ownsMovie),
+		authz.All(authz.HasPermission[*data.Movie]("movies:write"), unownedMovie),
+		authz.HasPermission[*data.Movie]("movies:write-any"),
+	).
+	Allow(actionDelete,
+		authz.All(authz.HasPermission[*data.Movie]("movies:write"), ownsMovie),
+		authz.All(authz.HasPermission[*data.Movie]("movies:write"), unownedMovie),
+		authz.HasPermission[*data.Movie]("movies:write-any"),
+	)
+
+// The subject() helper returns the authz.Subject for the user making the request. Just
+// like requirePermission(), it uses the permissions from the request context if the
+// authenticate middleware already knows them.
+func (app *application) subject(r *http.Request) (authz.Subject, error) {
+	user := app.contextGetUser(r)
+
+	permissions, ok := app.contextGetPermissions(r)
+	if !ok {
+		var err error
+		permissions, err = app.cache.permissionsForUser(r.Context(), app.models, user.ID)
+		if err != nil {
+			return authz.Subject{}, err
+		}
+	}
+
+	return authz.Subject{UserID: user.ID, Permissions: permissions}, nil
+}
+
+// The authorize() helper checks whether the user making the request may perform an
+// action on a resource. It sends a 403 Forbidden response if the policy denies the
+// action, and returns false if a response has already been sent to the client.
+func authorize[T any](app *application, w http.ResponseWriter, r *http.Request, policy *authz.Policy[T], action string, resource T) bool {
+	subject, err := app.subject(r)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !policy.Allows(subject, action, resource) {
+		app.notPermittedResponse(w, r)
+		return false
+	}
+
+	return true
+}
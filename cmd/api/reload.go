@@ -0,0 +1,144 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"maps"
+	"os"
+	"reflect"
+	"slices"
+
+	"github.com/thecodephilic-guy/greenlight/internal/jsonlog"
+	"github.com/thecodephilic-guy/greenlight/internal/mailer"
+)
+
+// Define a liveConfig struct to hold the settings which can be changed while the server
+// is running, by editing the config file (or environment) and sending the server a
+// SIGHUP signal. The rest of app.config needs a restart to change.
+type liveConfig struct {
+	limiter struct {
+		rps     float64
+		burst   int
+		enabled bool
+	}
+	cors struct {
+		trustedOrigins []string
+	}
+	mailer mailer.Mailer
+	// The values of every setting, which the next reload compares against to work
+	// out what has changed.
+	values map[string]any
+}
+
+// The settings which can be changed by reloading the config. The log level isn't in
+// liveConfig, because the logger keeps track of it.
+var reloadableSettings = []string{
+	"limiter-rps", "limiter-burst", "limiter-enabled",
+	"cors-trusted-origins",
+	"log-level",
+	"smtp-host", "smtp-port", "smtp-username", "smtp-password", "smtp-sender",
+}
+
+// The newLiveConfig() function returns the liveConfig for cfg.
+func newLiveConfig(cfg config, values map[string]any) *liveConfig {
+	live := &liveConfig{
+		mailer: mailer.New(cfg.smtp.host, cfg.smtp.port, cfg.smtp.username, cfg.smtp.password, cfg.smtp.sender),
+		values: values,
+	}
+
+	live.limiter.rps = cfg.limiter.rps
+	live.limiter.burst = cfg.limiter.burst
+	live.limiter.enabled = cfg.limiter.enabled
+	live.cors.trustedOrigins = cfg.cors.trustedOrigins
+
+	return live
+}
+
+// The mailer() method returns the mailer for the current SMTP settings.
+func (app *application) mailer() mailer.Mailer {
+	return app.live.Load().mailer
+}
+
+// The reloadConfig() method works out the configuration again, in the same way as when
+// the server started, and applies the settings which can be changed while it's
+// running. They're all swapped in at once, so a request never sees a mix of old and
+// new settings. If the new configuration is invalid, it's rejected and the old one
+// stays in place.
+//
+// Environment variables can't change while the server is running, so in practice it's
+// the config file which is reloaded.
+func (app *application) reloadConfig() error {
+	var cfg config
+
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	defineFlags(fs, &cfg)
+
+	// These are defined so that the original arguments can be parsed again, but they
+	// don't mean anything here.
+	fs.Bool("print-config", false, "")
+	fs.Bool("version", false, "")
+
+	err := fs.Parse(os.Args[1:])
+	if err == nil {
+		err = loadConfig(fs)
+	}
+	if err == nil {
+		err = validateConfig(cfg)
+	}
+	if err != nil {
+		return err
+	}
+
+	previous := app.live.Load()
+	next := newLiveConfig(cfg, configValues(fs, false))
+
+	// Work out what has changed. Changes to settings which can't be applied without a
+	// restart are logged too, so that it's clear they haven't taken effect. Their old
+	// values are kept, so that they're reported again on the next reload.
+	var applied, ignored []jsonlog.Attr
+
+	for _, name := range slices.Sorted(maps.Keys(next.values)) {
+		from, to := previous.values[name], next.values[name]
+		if reflect.DeepEqual(from, to) {
+			continue
+		}
+
+		reloadable := slices.Contains(reloadableSettings, name)
+		if !reloadable {
+			next.values[name] = from
+		}
+
+		if slices.Contains(secretSettings, name) {
+			from, to = redactSetting(name, from), redactSetting(name, to)
+		}
+
+		change := jsonlog.Group(name, jsonlog.Any("from", from), jsonlog.Any("to", to))
+
+		if reloadable {
+			applied = append(applied, change)
+		} else {
+			ignored = append(ignored, change)
+		}
+	}
+
+	app.live.Store(next)
+
+	// Only touch the log level if it has changed in the config, so that a level set
+	// through the admin API survives reloads which are about something else.
+	if !reflect.DeepEqual(previous.values["log-level"], next.values["log-level"]) {
+		app.logger.SetLevel(cfg.log.level)
+	}
+
+	attrs := []jsonlog.Attr{}
+	if len(applied) > 0 {
+		attrs = append(attrs, jsonlog.Group("changed", applied...))
+	}
+	if len(ignored) > 0 {
+		attrs = append(attrs, jsonlog.Group("requires_restart", ignored...))
+	}
+
+	app.logger.Info("configuration reloaded", attrs...)
+
+	return nil
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// GET /v1/admin/permissions
+func (app *application) listPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	permissions, err := app.models.Permissions.GetAll(r.Context())
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"permissions": permissions}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/admin/roles
+func (app *application) listRolesHandler(w http.ResponseWriter, r *http.Request) {
+	roles, err := app.models.Roles.GetAll()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"roles": roles}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/admin/roles
+func (app *application) createRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name        string   `json:"name"`
+		Permissions []string `json:"permissions"`
+		IsDefault   bool     `json:"is_default"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	role := &data.Role{
+		Name:        input.Name,
+		Permissions: input.Permissions,
+		IsDefault:   input.IsDefault,
+	}
+
+	v := validator.New()
+
+	data.ValidateRole(v, role)
+
+	err = app.validatePermissionCodes(r.Context(), v, role.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	event := app.newAuditEvent(r, "role.created", 0, map[string]any{
+		"role":        role.Name,
+		"permissions": role.Permissions,
+		"is_default":  role.IsDefault,
+	})
+
+	err = app.models.Roles.Insert(role, event)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrDuplicateRoleName):
+			v.AddError("name", "a role with this name already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelop{"role": role}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/admin/roles/default
+func (app *application) setDefaultRoleHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Name string `json:"name"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateRoleName(v, input.Name); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	event := app.newAuditEvent(r, "role.default_changed", 0, map[string]any{"role": input.Name})
+
+	err = app.models.Roles.SetDefault(input.Name, event)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("name", "role does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "default role successfully updated"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// GET /v1/admin/users/:id/permissions
+func (app *application) showUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// POST /v1/admin/users/:id/roles
+func (app *application) addUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Role string `json:"role"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(input.Role != "", "role", "must be provided")
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	event := app.newAuditEvent(r, "user.role_added", user.ID, map[string]any{"role": input.Role})
+
+	err = app.models.Roles.AddForUser(user.ID, input.Role, event)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("role", "role does not exist")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.cache.invalidateUser(user.ID)
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// DELETE /v1/admin/users/:id/roles/:role
+func (app *application) removeUserRoleHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+	role := params.ByName("role")
+
+	event := app.newAuditEvent(r, "user.role_removed", user.ID, map[string]any{"role": role})
+
+	err := app.models.Roles.RemoveForUser(user.ID, role, event)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.cache.invalidateUser(user.ID)
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// POST /v1/admin/users/:id/permissions
+func (app *application) addUserPermissionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Permissions []string `json:"permissions"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	v.Check(len(input.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(input.Permissions), "permissions", "must not contain duplicate values")
+
+	err = app.validatePermissionCodes(r.Context(), v, input.Permissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	event := app.newAuditEvent(r, "user.permissions_added", user.ID, map[string]any{"permissions": input.Permissions})
+
+	err = app.models.Permissions.AddForUser(r.Context(), user.ID, event, input.Permissions...)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.cache.invalidateUser(user.ID)
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// DELETE /v1/admin/users/:id/permissions/:code
+func (app *application) removeUserPermissionHandler(w http.ResponseWriter, r *http.Request) {
+	user, ok := app.readUserParam(w, r)
+	if !ok {
+		return
+	}
+
+	params := httprouter.ParamsFromContext(r.Context())
+	code := params.ByName("code")
+
+	event := app.newAuditEvent(r, "user.permission_removed", user.ID, map[string]any{"permission": code})
+
+	err := app.models.Permissions.RemoveForUser(r.Context(), user.ID, event, code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.cache.invalidateUser(user.ID)
+
+	app.writeUserPermissions(w, r, user.ID)
+}
+
+// The writeUserPermissions() helper sends the roles and permissions that a user has
+// been granted, along with the effective permissions that they add up to.
+func (app *application) writeUserPermissions(w http.ResponseWriter, r *http.Request, userID int64) {
+	roles, err := app.models.Roles.GetAllForUser(userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	direct, err := app.models.Permissions.GetDirectForUser(r.Context(), userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	effective, err := app.models.Permissions.GetAllForUser(r.Context(), userID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelop{
+		"roles":                 roles,
+		"permissions":           direct,
+		"effective_permissions": effective,
+	}
+
+	err = app.writeJSON(w, http.StatusOK, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// The validatePermissionCodes() helper checks that every code refers to a permission
+// which exists. Unknown codes would otherwise be silently ignored when granting them.
+func (app *application) validatePermissionCodes(ctx context.Context, v *validator.Validator, codes []string) error {
+	permissions, err := app.models.Permissions.GetAll(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, code := range codes {
+		if !permissions.Include(code) {
+			v.AddError("permissions", "must only contain existing permissions")
+			break
+		}
+	}
+
+	return nil
+}
@@ -8,8 +8,9 @@ import (
 )
 
 func (app *application) routes() http.Handler {
-	// Initialize a new httprouter instance.
-	router := httprouter.New()
+	// Initialize a new httprouter instance, wrapped so that the metrics middleware
+	// knows which route matched each request.
+	router := patternRouter{httprouter.New()}
 
 	// Convert the notFoundResponse() helper to a http.Handler using the
 	// http.HandlerFunc() adapter, and then set it as the custom error handler for 404
@@ -33,10 +34,76 @@ func (app *application) routes() http.Handler {
 	router.HandlerFunc(http.MethodPost, "/v1/users", app.registerUserHandler)
 	router.HandlerFunc(http.MethodPut, "/v1/users/activated", app.activateUserHander)
 
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/logins", app.requireUserSession(app.listMyLoginsHandler))
+
+	router.HandlerFunc(http.MethodPost, "/v1/users/me/totp", app.requireUserSession(app.enrollTOTPHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/totp", app.requireUserSession(app.disableTOTPHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/users/me/totp/enabled", app.requireUserSession(app.confirmTOTPHandler))
+
 	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication", app.createAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication/totp", app.createTwoFactorAuthenticationTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/tokens/authentication/revoke", app.revokeLoginSessionHandler)
+
+	// Only register the magic link routes if passwordless login is enabled, so that
+	// they respond with a 404 Not Found otherwise.
+	if app.config.magicLink.enabled {
+		router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link", app.createMagicLinkTokenHandler)
+		router.HandlerFunc(http.MethodPost, "/v1/tokens/magic-link/redeem", app.redeemMagicLinkTokenHandler)
+	}
+
+	// Likewise, the OpenID Connect routes are only registered if a provider is
+	// configured.
+	if app.oidc != nil {
+		router.HandlerFunc(http.MethodGet, "/v1/oidc/login", app.oidcLoginHandler)
+		router.HandlerFunc(http.MethodGet, "/v1/oidc/callback", app.oidcCallbackHandler)
+	}
+
+	router.HandlerFunc(http.MethodGet, "/v1/.well-known/jwks.json", app.jwksHandler)
+
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/clients", app.requireUserSession(app.listOAuthClientsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/clients", app.requireUserSession(app.createOAuthClientHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/oauth/clients/:id", app.requireUserSession(app.deleteOAuthClientHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/oauth/authorize", app.requireUserSession(app.showAuthorizationHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/authorize", app.requireUserSession(app.approveAuthorizationHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/token", app.createOAuthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/introspect", app.introspectOAuthTokenHandler)
+	router.HandlerFunc(http.MethodPost, "/v1/oauth/revoke", app.revokeOAuthTokenHandler)
+	router.HandlerFunc(http.MethodGet, "/v1/users/me/oauth-consents", app.requireUserSession(app.listOAuthConsentsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/users/me/oauth-consents/:id", app.requireUserSession(app.deleteOAuthConsentHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/api-keys", app.requireUserSession(app.listAPIKeysHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/api-keys", app.requireUserSession(app.createAPIKeyHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/api-keys/:id", app.requireUserSession(app.deleteAPIKeyHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users", app.requirePermission("users:admin", app.listUsersHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id", app.requirePermission("users:admin", app.showUserHandler))
+	router.HandlerFunc(http.MethodPatch, "/v1/admin/users/:id", app.requirePermission("users:admin", app.updateUserHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id", app.requirePermission("users:admin", app.deleteUserHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/audit-events", app.requirePermission("users:admin", app.listAuditEventsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/invitations", app.requirePermission("users:admin", app.listInvitationsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/invitations", app.requirePermission("users:admin", app.createInvitationHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/invitations/:id", app.requirePermission("users:admin", app.deleteInvitationHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/logins", app.requirePermission("users:admin", app.listUserLoginsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/lockout", app.requirePermission("users:admin", app.unlockUserHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/permissions", app.requirePermission("users:admin", app.listPermissionsHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/roles", app.requirePermission("users:admin", app.listRolesHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/roles", app.requirePermission("users:admin", app.createRoleHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/roles/default", app.requirePermission("users:admin", app.setDefaultRoleHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.showUserPermissionsHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/permissions", app.requirePermission("users:admin", app.addUserPermissionsHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/permissions/:code", app.requirePermission("users:admin", app.removeUserPermissionHandler))
+	router.HandlerFunc(http.MethodPost, "/v1/admin/users/:id/roles", app.requirePermission("users:admin", app.addUserRoleHandler))
+	router.HandlerFunc(http.MethodDelete, "/v1/admin/users/:id/roles/:role", app.requirePermission("users:admin", app.removeUserRoleHandler))
+
+	router.HandlerFunc(http.MethodGet, "/v1/admin/log-level", app.requirePermission("users:admin", app.showLogLevelHandler))
+	router.HandlerFunc(http.MethodPut, "/v1/admin/log-level", app.requirePermission("users:admin", app.updateLogLevelHandler))
+	router.HandlerFunc(http.MethodGet, "/v1/admin/errors", app.requirePermission("users:admin", app.listErrorsHandler))
 
 	// For dipalying the metrics
 	router.Handler(http.MethodGet, "/debug/vars", expvar.Handler())
+	router.Handler(http.MethodGet, "/metrics", app.registry.Handler())
 
-	return app.metrics(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))
+	return app.realIP(app.requestID(app.metrics(app.accessLog(app.tracing(app.recoverPanic(app.enableCORS(app.rateLimit(app.authenticate(router)))))))))
 }
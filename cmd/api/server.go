@@ -23,6 +23,22 @@ func (app *application) server() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	// Start a background goroutine which reloads the config whenever we receive a
+	// SIGHUP signal, which is the traditional way to tell a daemon that its config has
+	// changed. If the new config is invalid, we log the problem and carry on with the
+	// old one.
+	go func() {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+
+		for range reload {
+			err := app.reloadConfig()
+			if err != nil {
+				app.logger.PrintError(fmt.Errorf("config reload rejected: %w", err), nil)
+			}
+		}
+	}()
+
 	// Create a shutdownError channel. We will use this to receive any errors returned
 	// by the graceful Shutdown() function.
 	shutdownError := make(chan error)
@@ -74,6 +90,17 @@ func (app *application) server() error {
 		// the shutdownError channel, to indicate that the shutdown completed without
 		// any issues.
 		app.wg.Wait()
+
+		// Now that nothing else can start a span, export the spans which are still
+		// queued. Losing them isn't worth failing the shutdown over, so any error is
+		// just logged.
+		if app.tracer != nil {
+			err := app.tracer.Shutdown(ctx)
+			if err != nil {
+				app.logger.PrintError(err, nil)
+			}
+		}
+
 		shutdownError <- nil
 	}()
 
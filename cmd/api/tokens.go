@@ -1,14 +1,29 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
 	"errors"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/jwt"
 	"github.com/thecodephilic-guy/greenlight/internal/validator"
 )
 
+// accessTokenClaims is the payload of a signed access token. Along with the standard
+// claims it carries everything that the authenticate and requirePermission middleware
+// would otherwise have to look up in the database.
+type accessTokenClaims struct {
+	jwt.RegisteredClaims
+	Activated   bool     `json:"act"`
+	TwoFactor   bool     `json:"mfa"`
+	Permissions []string `json:"perms"`
+}
+
 func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
 	// Parse the email and password from request body
 	var input struct {
@@ -33,13 +48,29 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
+	// Refuse to check the password at all if there have been too many recent failed
+	// attempts for this email address or from this IP address.
+	if !app.checkLoginThrottle(w, r, input.Email) {
+		return
+	}
+
 	// Lookup the user record based on the email address. If no matching user was
-	// found, then we call the app.invalidCredentialsResponse() helper to send a 401
+	// found, then we still go through the motions of checking a password, so that the
+	// response takes the same time whether or not the account exists. Then we record
+	// the failure and call the app.invalidCredentialsResponse() helper to send a 401
 	// Unauthorized response to the client
-	user, err := app.models.Users.GetByEmail(input.Email)
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
+			data.SimulatePasswordCheck(r.Context(), input.Password)
+
+			err = app.recordLoginFailure(r, loginMethodPassword, input.Email, nil)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
 			app.invalidCredentialsResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
@@ -48,22 +79,117 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 	}
 
 	// Check if the provided password matches the actual password for the user.
-	match, err := user.Password.Matches(input.Password)
+	match, err := user.Password.Matches(r.Context(), input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	// If the password do not match, then we call the app.invalidCredentialsResponse()
-	// helper again and return
+	// If the password do not match, then we record the failure, call the
+	// app.invalidCredentialsResponse() helper again and return
 	if !match {
+		err = app.recordLoginFailure(r, loginMethodPassword, input.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
 		app.invalidCredentialsResponse(w, r)
 		return
 	}
 
-	// If the password is correct, we generate a new token with a 24-hour
-	// expiry time and the scope 'authentication'
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, data.ScopeAuthentication)
+	// If the stored hash was created with an outdated algorithm or cost, take the
+	// chance to rehash the password now that we have the plaintext. A failure here
+	// shouldn't stop the user from logging in, so we only log it.
+	if user.Password.NeedsRehash() {
+		err = app.rehashPassword(r.Context(), user, input.Password)
+		if err != nil {
+			app.logError(r, err)
+		}
+	}
+
+	// A correct password clears the failed attempts for the account. We deliberately
+	// leave the counter for the IP address alone, otherwise an attacker could reset it
+	// by logging in to an account of their own between guesses.
+	err = app.models.Logins.Reset(data.EmailThrottleKey(user.Email))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// If the password is correct, the first factor has been checked and we hand over
+	// to completeLogin() to deal with the second factor (if any).
+	app.completeLogin(w, r, loginMethodPassword, user)
+}
+
+// The rehashPassword() helper hashes the password again with the configured hasher and
+// saves it. An edit conflict means that the user record was changed by another request
+// in the meantime, in which case we leave it for the next login.
+func (app *application) rehashPassword(ctx context.Context, user *data.User, plaintextPassword string) error {
+	err := user.Password.Set(ctx, plaintextPassword)
+	if err != nil {
+		return err
+	}
+
+	err = app.models.Users.Update(ctx, user)
+	if err != nil && !errors.Is(err, data.ErrEditConflict) {
+		return err
+	}
+
+	return nil
+}
+
+// The completeLogin() helper is called once a user has proven who they are with their
+// first factor. Blocked users are turned away here. If the user has two-factor
+// authentication enabled we send back a short-lived challenge token, which must be
+// exchanged together with a TOTP code at POST /v1/tokens/authentication/totp.
+// Otherwise, we issue an authentication token.
+func (app *application) completeLogin(w http.ResponseWriter, r *http.Request, method string, user *data.User) {
+	// Blocked users can't log in, however they prove who they are.
+	if user.Blocked {
+		err := app.recordLoginAttempt(r, method, data.LoginBlocked, user.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.blockedAccountResponse(w, r)
+		return
+	}
+
+	enabled, err := app.models.TOTP.IsEnabled(user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if enabled {
+		token, err := app.models.Tokens.New(r.Context(), user.ID, 5*time.Minute, data.ScopeTwoFactor)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, envelop{"two_factor_challenge": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	app.issueAuthenticationToken(w, r, method, user, false)
+}
+
+// The issueAuthenticationToken() helper creates an authentication token for the user
+// and sends it to the client with a 201 Created response.
+func (app *application) issueAuthenticationToken(w http.ResponseWriter, r *http.Request, method string, user *data.User, twoFactor bool) {
+	token, err := app.newAuthenticationToken(r.Context(), user, twoFactor)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.recordLoginSuccess(r, method, user, token)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -74,3 +200,106 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// The newAuthenticationToken() helper issues an authentication token for the user. With
+// the opaque format this is a random token stored in the tokens table with a 24-hour
+// expiry, and with the jwt format it is a signed token which is never stored. The
+// twoFactor parameter records whether the user completed a second factor when logging
+// in, which is only needed for the claims of a signed token.
+func (app *application) newAuthenticationToken(ctx context.Context, user *data.User, twoFactor bool) (*data.Token, error) {
+	if app.config.token.format != "jwt" {
+		return app.models.Tokens.New(ctx, user.ID, 24*time.Hour, data.ScopeAuthentication)
+	}
+
+	permissions, err := app.models.Permissions.GetAllForUser(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	expiry := now.Add(app.config.token.jwt.ttl)
+
+	claims := accessTokenClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    app.config.token.jwt.issuer,
+			Subject:   strconv.FormatInt(user.ID, 10),
+			IssuedAt:  now.Unix(),
+			ExpiresAt: expiry.Unix(),
+			ID:        rand.Text(),
+		},
+		Activated:   user.Activated,
+		TwoFactor:   twoFactor,
+		Permissions: permissions,
+	}
+
+	plaintext, err := app.jwtKeys.Sign(claims)
+	if err != nil {
+		return nil, err
+	}
+
+	token := &data.Token{
+		Plaintext:  plaintext,
+		UserID:     user.ID,
+		ExpiryTime: time.Unix(claims.ExpiresAt, 0),
+		Scope:      data.ScopeAuthentication,
+	}
+
+	return token, nil
+}
+
+// The isSignedToken() helper reports whether a bearer token looks like a signed access
+// token rather than an opaque one. Opaque tokens are base-32 and never contain a dot.
+func (app *application) isSignedToken(token string) bool {
+	return app.jwtKeys != nil && strings.Count(token, ".") == 2
+}
+
+// The userForSignedToken() helper verifies a signed access token and rebuilds the user
+// and their permissions from its claims, without touching the database. Note that the
+// returned User only has the ID and Activated fields set, and that the authenticate
+// middleware goes on to check the user's current state.
+func (app *application) userForSignedToken(token string) (*data.User, *accessTokenClaims, error) {
+	var claims accessTokenClaims
+
+	err := app.jwtKeys.Verify(token, &claims)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = claims.Valid(time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if claims.Issuer != app.config.token.jwt.issuer {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+
+	id, err := strconv.ParseInt(claims.Subject, 10, 64)
+	if err != nil || id < 1 {
+		return nil, nil, jwt.ErrInvalidToken
+	}
+
+	user := &data.User{
+		ID:        id,
+		Activated: claims.Activated,
+	}
+
+	return user, &claims, nil
+}
+
+// GET /v1/.well-known/jwks.json
+func (app *application) jwksHandler(w http.ResponseWriter, r *http.Request) {
+	// If no signing keys are configured there is nothing to publish, so we respond
+	// with an empty key set rather than a 404.
+	jwks := jwt.JWKS{Keys: []jwt.JWK{}}
+	if app.jwtKeys != nil {
+		jwks = app.jwtKeys.JWKS()
+	}
+
+	// The JWKS document is a well-known format, so we write it as-is rather than
+	// wrapping it in an envelope.
+	err := app.writeJSON(w, http.StatusOK, envelop{"keys": jwks.Keys}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
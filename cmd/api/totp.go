@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/data"
+	"github.com/thecodephilic-guy/greenlight/internal/totp"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// POST /v1/users/me/totp
+func (app *application) enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	// The user in the request context may have been built from the claims of a signed
+	// access token, so we fetch the full record to get their email address.
+	user, err := app.models.Users.Get(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// Store the secret as a pending enrolment. It doesn't take effect until the user
+	// proves that their authenticator app is set up by confirming a code.
+	err = app.models.TOTP.Enroll(user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrTOTPAlreadyEnabled):
+			app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelop{
+		"totp": map[string]string{
+			"secret": totp.EncodeSecret(secret),
+			"uri":    totp.URI(app.config.totp.issuer, user.Email, secret),
+		},
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// PUT /v1/users/me/totp/enabled
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	enrolment, err := app.models.TOTP.Get(user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.errorResponse(w, r, http.StatusConflict, "two-factor authentication enrolment has not been started")
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if enrolment.Enabled {
+		app.errorResponse(w, r, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+
+	step, ok := totp.Validate(enrolment.Secret, input.Code, time.Now(), 1)
+	if !ok {
+		v.AddError("code", "invalid two-factor authentication code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	// Enabling TOTP generates a fresh set of recovery codes. This is the only time the
+	// plaintext codes are ever shown, so the client must store them now.
+	codes, err := app.models.TOTP.Enable(user.ID, step)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"recovery_codes": codes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// DELETE /v1/users/me/totp
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	if data.ValidateTOTPCode(v, input.Code); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	// Turning two-factor authentication off needs a current code, so that a stolen
+	// authentication token on its own isn't enough to downgrade the account.
+	ok, err := app.checkTOTPCode(user.ID, input.Code)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		app.invalidTwoFactorCodeResponse(w, r)
+		return
+	}
+
+	// Any API keys and OAuth tokens which hold permissions that need two-factor
+	// authentication are revoked at the same time, since they were only allowed
+	// because it was turned on.
+	err = app.models.TOTP.Delete(user.ID, app.config.totp.requiredPermissions)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelop{"message": "two-factor authentication successfully disabled"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// POST /v1/tokens/authentication/totp
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	// The client sends the challenge token from createAuthenticationTokenHandler,
+	// along with either a code from their authenticator app or a recovery code.
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+		RecoveryCode   string `json:"recovery_code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+
+	data.ValidateTokenPlaintext(v, input.TokenPlaintext)
+
+	switch {
+	case input.Code == "" && input.RecoveryCode == "":
+		v.AddError("code", "must be provided")
+	case input.Code != "" && input.RecoveryCode != "":
+		v.AddError("code", "must not be provided together with a recovery code")
+	case input.Code != "":
+		data.ValidateTOTPCode(v, input.Code)
+	}
+
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeTwoFactor, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor challenge token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	// Codes are only 6 digits long, so guesses count towards the same lockout as
+	// failed passwords.
+	if !app.checkLoginThrottle(w, r, user.Email) {
+		return
+	}
+
+	var ok bool
+	if input.Code != "" {
+		ok, err = app.checkTOTPCode(user.ID, input.Code)
+	} else {
+		ok, err = app.models.TOTP.UseRecoveryCode(user.ID, input.RecoveryCode)
+	}
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if !ok {
+		err = app.recordLoginFailure(r, loginMethodTOTP, user.Email, user)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		app.invalidTwoFactorCodeResponse(w, r)
+		return
+	}
+
+	// The challenge has been met, so delete all of the user's challenge tokens before
+	// handing out the authentication token.
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.issueAuthenticationToken(w, r, loginMethodTOTP, user, true)
+}
+
+// The checkTOTPCode() helper checks a code against the user's enabled TOTP secret, and
+// marks its time step as used so that it can't be accepted a second time.
+func (app *application) checkTOTPCode(userID int64, code string) (bool, error) {
+	enrolment, err := app.models.TOTP.Get(userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	if !enrolment.Enabled {
+		return false, nil
+	}
+
+	step, ok := totp.Validate(enrolment.Secret, code, time.Now(), 1)
+	if !ok {
+		return false, nil
+	}
+
+	return app.models.TOTP.UseStep(userID, step)
+}
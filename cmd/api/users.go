@@ -13,9 +13,10 @@ import (
 func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Request) {
 	//Anonymous struct to hold the expected data from the request body:
 	var input struct {
-		Name     string `json:"name"`
-		Email    string `json:"email"`
-		Password string `json:"password"`
+		Name       string `json:"name"`
+		Email      string `json:"email"`
+		Password   string `json:"password"`
+		Invitation string `json:"invitation"`
 	}
 
 	err := app.readJSON(w, r, &input)
@@ -35,7 +36,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	}
 
 	//Use the Password.set() method to generate and store the hashed and plaintext passwords
-	err = user.Password.Set(input.Password)
+	err = user.Password.Set(r.Context(), input.Password)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -43,16 +44,58 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	v := validator.New()
 
-	//validate the user struct and return the error messages to the client if any of
-	//the checks fail.
-	if data.ValidateUser(v, user); !v.Valid() {
+	//validate the user struct and the password policy, and return the error messages
+	//to the client if any of the checks fail.
+	data.ValidateUser(v, user)
+
+	err = app.validatePasswordPolicy(v, "password", input.Password, user)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	// In invite-only mode every registration needs an invitation code. Otherwise a
+	// code is optional, but it is still honored if one is given.
+	if app.config.registration.inviteOnly || input.Invitation != "" {
+		data.ValidateInvitationCode(v, input.Invitation)
+	}
+
+	if !v.Valid() {
 		app.failedValidationResponse(w, r, v.Errors)
 		return
 	}
 
+	// Use up the invitation before creating the user. Accepting an invitation proves
+	// that the user was expected, so the account is activated straight away.
+	var invitation *data.Invitation
+
+	if input.Invitation != "" {
+		invitation, err = app.models.Invitations.Redeem(input.Invitation, user.Email)
+		if err != nil {
+			switch {
+			case errors.Is(err, data.ErrRecordNotFound):
+				v.AddError("invitation", "invalid, expired or already used invitation")
+				app.failedValidationResponse(w, r, v.Errors)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+
+		user.Activated = true
+	}
+
 	//Insert the user data into db
-	err = app.models.Users.Insert(user)
+	err = app.models.Users.Insert(r.Context(), user)
 	if err != nil {
+		// Give the use of the invitation back, since no user was created with it.
+		if invitation != nil {
+			releaseErr := app.models.Invitations.Release(invitation.ID)
+			if releaseErr != nil {
+				app.logError(r, releaseErr)
+			}
+		}
+
 		switch {
 		// If we get a ErrDuplicateEmail error, use the v.AddError() method to manually
 		// add a message to the validator instance, and then call our
@@ -66,15 +109,35 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	// Add the "movies:read" permission for the new user.
-	err = app.models.Permissions.AddForUser(user.ID, "movies:read")
+	// Assign the default role to the new user. Out of the box this is the "viewer"
+	// role, which grants the "movies:read" permission.
+	err = app.models.Roles.AddDefaultForUser(user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
+
+	// Invited users are already activated, so they skip the activation email and also
+	// get any permissions that the invitation grants.
+	if invitation != nil {
+		if len(invitation.Permissions) > 0 {
+			err = app.models.Permissions.AddForUser(r.Context(), user.ID, nil, invitation.Permissions...)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+
+		err = app.writeJSON(w, http.StatusCreated, envelop{"user": user}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	// After the user record has been created in the database and permission to read has been granded
 	// genereate a ner activation token for the user.
-	token, err := app.models.Tokens.New(user.ID, 3*24*time.Hour, data.ScopeActivation)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 3*24*time.Hour, data.ScopeActivation)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -82,7 +145,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 
 	// Launch a goroutine which runs an anonymous function that sends the welcome email.
 	// All the logic has been modularised to be used again in background()
-	app.background(func() {
+	app.background(r, func() {
 		// As there are now multiple pieces of data that we want to pass to our email
 		// templates, we create a map to act as a 'holding structure' for the data. This
 		// contains the plaintext version of the activation token for the user, along
@@ -93,12 +156,12 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		}
 
 		// Send the welcome email, passing in the map as dynamic data.
-		err = app.mailer.Send(user.Email, "user_welcome.html", data)
+		err := app.mailer().Send(r.Context(), user.Email, "user_welcome.html", data)
 		if err != nil {
 			// Importantly, if there is an error sending the email then we use the
-			// app.logger.PrintError() helper to manage it, instead of the
+			// app.requestLogger(r).PrintError() helper to manage it, instead of the
 			// app.serverErrorResponse()
-			app.logger.PrintError(err, nil)
+			app.requestLogger(r).PrintError(err, nil)
 		}
 	})
 
@@ -135,7 +198,7 @@ func (app *application) activateUserHander(w http.ResponseWriter, r *http.Reques
 	// Retrieve the details of the user associated with the token using the
 	// GetForToken() method. If no matching record
 	// is found, then we let the client know that the token they provided is not valid.
-	user, err := app.models.Users.GetForToken(data.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(r.Context(), data.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrRecordNotFound):
@@ -152,7 +215,7 @@ func (app *application) activateUserHander(w http.ResponseWriter, r *http.Reques
 
 	// Save the updated user record in our db, checking for any edit conflicts in
 	// the same way that we did for our movies records.
-	err = app.models.Users.Update(user)
+	err = app.models.Users.Update(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, data.ErrEditConflict):
@@ -164,12 +227,16 @@ func (app *application) activateUserHander(w http.ResponseWriter, r *http.Reques
 	}
 
 	// now if everything was successfull then we delete all activatioin tokens for the user
-	err = app.models.Tokens.DeleteAllForUser(data.ScopeActivation, user.ID)
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), data.ScopeActivation, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
+	// Drop any cached copies of the user, so that the change takes effect straight away
+	// rather than when the invalidation notification arrives.
+	app.cache.invalidateUser(user.ID)
+
 	// Send the updated user details to the client:
 	err = app.writeJSON(w, http.StatusOK, envelop{"user": user}, nil)
 	if err != nil {
@@ -177,3 +244,26 @@ func (app *application) activateUserHander(w http.ResponseWriter, r *http.Reques
 	}
 
 }
+
+// The validatePasswordPolicy() helper checks a new password against the configured
+// password policy, adding the reason to the validator if it is rejected. The user's
+// name and email address are passed along, because passwords based on them are much
+// easier to guess. The reason is added under the given key, which is the name of the
+// field the client sent the password in.
+//
+// If the password has already failed the basic checks (it's missing, or too short or
+// too long), the policy isn't checked at all. The client needs to fix the password
+// anyway, and there's no point in spending time estimating the strength of a password
+// which could be any length.
+func (app *application) validatePasswordPolicy(v *validator.Validator, key, plaintextPassword string, user *data.User) error {
+	if _, failed := v.Errors[key]; failed {
+		return nil
+	}
+
+	policy := validator.PasswordPolicy{
+		MinScore: app.config.password.minScore,
+		PwnedDir: app.config.password.pwnedDir,
+	}
+
+	return policy.Validate(v, key, plaintextPassword, user.Name, user.Email)
+}
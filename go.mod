@@ -11,13 +11,16 @@ require (
 )
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/felixge/httpsnoop v1.0.4
 	github.com/go-mail/mail v2.3.1+incompatible
 	golang.org/x/crypto v0.48.0
 	golang.org/x/time v0.14.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
+	golang.org/x/sys v0.41.0 // indirect
 	gopkg.in/alexcesaro/quotedprintable.v3 v3.0.0-20150716171945-2caba252f4dc // indirect
 	gopkg.in/mail.v2 v2.3.1 // indirect
 )
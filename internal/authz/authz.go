@@ -0,0 +1,67 @@
+package authz
+
+import "slices"
+
+// Define a Subject struct to hold the details of who is trying to perform an action:
+// the ID of the authenticated user and the permission codes that they hold.
+type Subject struct {
+	UserID      int64
+	Permissions []string
+}
+
+// A Rule decides whether a subject may perform an action on a particular resource.
+type Rule[T any] func(subject Subject, resource T) bool
+
+// Define a Policy type which holds the rules for each action on a type of resource. An
+// action is allowed if any one of its rules allows it, and denied if none do (including
+// when the action has no rules at all).
+type Policy[T any] struct {
+	rules map[string][]Rule[T]
+}
+
+// Return a new, empty Policy which denies everything.
+func NewPolicy[T any]() *Policy[T] {
+	return &Policy[T]{
+		rules: make(map[string][]Rule[T]),
+	}
+}
+
+// The Allow() method adds rules for an action. It returns the policy so that calls can
+// be chained when the policy is declared.
+func (p *Policy[T]) Allow(action string, rules ...Rule[T]) *Policy[T] {
+	p.rules[action] = append(p.rules[action], rules...)
+	return p
+}
+
+// The Allows() method reports whether the subject may perform the action on the
+// resource.
+func (p *Policy[T]) Allows(subject Subject, action string, resource T) bool {
+	for _, rule := range p.rules[action] {
+		if rule(subject, resource) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// HasPermission returns a rule which allows subjects holding the permission code,
+// whatever the resource.
+func HasPermission[T any](code string) Rule[T] {
+	return func(subject Subject, _ T) bool {
+		return slices.Contains(subject.Permissions, code)
+	}
+}
+
+// All returns a rule which only allows an action if every one of the rules does.
+func All[T any](rules ...Rule[T]) Rule[T] {
+	return func(subject Subject, resource T) bool {
+		for _, rule := range rules {
+			if !rule(subject, resource) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Define a Cache type which holds up to a fixed number of entries, each of which
+// expires after a fixed TTL. When the cache is full, the least recently used entry is
+// evicted to make room for a new one. A Cache is safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	ttl     time.Duration
+	size    int
+	mu      sync.Mutex
+	entries map[K]*list.Element
+	lru     *list.List
+	hits    atomic.Int64
+	misses  atomic.Int64
+}
+
+type entry[K comparable, V any] struct {
+	key     K
+	value   V
+	expires time.Time
+}
+
+// Define a Stats struct to hold the hit and miss counters for a cache, along with the
+// number of entries it currently holds.
+type Stats struct {
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+	Entries int   `json:"entries"`
+}
+
+// Return a new Cache instance which holds at most size entries for up to ttl. If
+// either of them is zero, the cache is disabled: nothing is ever stored, and every Get
+// is a miss.
+func New[K comparable, V any](ttl time.Duration, size int) *Cache[K, V] {
+	return &Cache[K, V]{
+		ttl:     ttl,
+		size:    size,
+		entries: make(map[K]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// The Get() method returns the value for a key, and whether it was found. Expired
+// entries are removed as they are found.
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.entries[key]
+	if ok {
+		e := element.Value.(*entry[K, V])
+
+		if time.Now().Before(e.expires) {
+			c.lru.MoveToFront(element)
+			c.hits.Add(1)
+			return e.value, true
+		}
+
+		c.remove(element)
+	}
+
+	c.misses.Add(1)
+
+	var zero V
+	return zero, false
+}
+
+// The Set() method adds a value to the cache, replacing any existing value for the
+// key and evicting the least recently used entry if the cache is full.
+func (c *Cache[K, V]) Set(key K, value V) {
+	if c.ttl <= 0 || c.size <= 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+
+	for c.lru.Len() >= c.size {
+		c.remove(c.lru.Back())
+	}
+
+	c.entries[key] = c.lru.PushFront(&entry[K, V]{
+		key:     key,
+		value:   value,
+		expires: time.Now().Add(c.ttl),
+	})
+}
+
+// The Delete() method removes the entry for a key, if there is one.
+func (c *Cache[K, V]) Delete(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.entries[key]; ok {
+		c.remove(element)
+	}
+}
+
+// The DeleteFunc() method removes every entry for which fn returns true. It has to
+// look at every entry, so it should only be used when the key isn't known.
+func (c *Cache[K, V]) DeleteFunc(fn func(key K, value V) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for element := c.lru.Front(); element != nil; {
+		next := element.Next()
+
+		e := element.Value.(*entry[K, V])
+		if fn(e.key, e.value) {
+			c.remove(element)
+		}
+
+		element = next
+	}
+}
+
+// The Purge() method removes every entry from the cache.
+func (c *Cache[K, V]) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	clear(c.entries)
+	c.lru.Init()
+}
+
+// The Stats() method returns the hit and miss counters and the number of entries.
+func (c *Cache[K, V]) Stats() Stats {
+	c.mu.Lock()
+	entries := c.lru.Len()
+	c.mu.Unlock()
+
+	return Stats{
+		Hits:    c.hits.Load(),
+		Misses:  c.misses.Load(),
+		Entries: entries,
+	}
+}
+
+// remove deletes an element from both the map and the list. The caller must hold the
+// mutex.
+func (c *Cache[K, V]) remove(element *list.Element) {
+	e := element.Value.(*entry[K, V])
+
+	delete(c.entries, e.key)
+	c.lru.Remove(element)
+}
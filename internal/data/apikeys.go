@@ -0,0 +1,263 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// API keys are prefixed so that they are easy to recognise in logs, config files and
+// secret scanners, and so that they can't be confused with a 26-character token.
+const apiKeyPrefix = "gl_"
+
+// Define an APIKey struct to hold the data for a single long-lived API key. Just like
+// tokens, only the SHA-256 hash is stored and the plaintext is shown to the client
+// exactly once, when the key is created.
+type APIKey struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Plaintext   string      `json:"key,omitempty"`
+	Hash        []byte      `json:"-"`
+	UserID      int64       `json:"-"`
+	Permissions Permissions `json:"permissions"`
+	ExpiryTime  *time.Time  `json:"expiry,omitempty"`
+	LastUsedAt  *time.Time  `json:"last_used_at,omitempty"`
+}
+
+func generateAPIKey(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key := &APIKey{
+		Name:        name,
+		UserID:      userID,
+		Permissions: permissions,
+		ExpiryTime:  expiry,
+	}
+
+	// API keys live for a long time, so we use 32 random bytes rather than the 16
+	// that we use for short-lived tokens.
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	key.Plaintext = apiKeyPrefix + base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(key.Plaintext))
+	key.Hash = hash[:]
+
+	return key, nil
+}
+
+// Check that the plaintext API key has the expected prefix and is exactly 55 bytes
+// long (the 3-byte prefix followed by 52 bytes of base-32).
+func ValidateAPIKeyPlaintext(v *validator.Validator, plaintext string) {
+	v.Check(plaintext != "", "key", "must be provided")
+	v.Check(strings.HasPrefix(plaintext, apiKeyPrefix), "key", "must be a valid API key")
+	v.Check(len(plaintext) == 55, "key", "must be 55 bytes long")
+}
+
+func ValidateAPIKey(v *validator.Validator, key *APIKey) {
+	v.Check(key.Name != "", "name", "must be provided")
+	v.Check(len(key.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(key.Permissions) >= 1, "permissions", "must contain at least 1 permission")
+	v.Check(validator.Unique(key.Permissions), "permissions", "must not contain duplicate values")
+
+	if key.ExpiryTime != nil {
+		v.Check(key.ExpiryTime.After(time.Now()), "expiry", "must be in the future")
+	}
+}
+
+// Define the APIKeyModel type.
+type APIKeyModel struct {
+	DB *sql.DB
+}
+
+// The New() method is a shortcut which creates a new APIKey struct and then inserts the
+// data in the api_keys table.
+func (m APIKeyModel) New(userID int64, name string, permissions Permissions, expiry *time.Time) (*APIKey, error) {
+	key, err := generateAPIKey(userID, name, permissions, expiry)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(key)
+
+	return key, err
+}
+
+func (m APIKeyModel) Insert(key *APIKey) error {
+	query := `
+		INSERT INTO api_keys (user_id, name, hash, permissions, expiry)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+	args := []any{
+		key.UserID,
+		key.Name,
+		key.Hash,
+		pq.Array(key.Permissions),
+		key.ExpiryTime,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&key.ID, &key.CreatedAt)
+}
+
+// The GetAllForUser() method returns every API key belonging to a user, newest first.
+// The plaintext keys are never stored, so they are not included.
+func (m APIKeyModel) GetAllForUser(userID int64) ([]*APIKey, error) {
+	query := `
+		SELECT id, created_at, name, permissions, expiry, last_used_at
+		FROM api_keys
+		WHERE user_id = $1
+		ORDER BY created_at DESC, id DESC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []*APIKey{}
+
+	for rows.Next() {
+		key := APIKey{UserID: userID}
+
+		err := rows.Scan(
+			&key.ID,
+			&key.CreatedAt,
+			&key.Name,
+			pq.Array(&key.Permissions),
+			&key.ExpiryTime,
+			&key.LastUsedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		keys = append(keys, &key)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
+
+// The Delete() method deletes an API key. The user ID is part of the WHERE clause so
+// that users can only ever delete their own keys.
+func (m APIKeyModel) Delete(id, userID int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM api_keys
+		WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteAllForUser() deletes every API key belonging to a user.
+func (m APIKeyModel) DeleteAllForUser(userID int64) error {
+	query := `
+		DELETE FROM api_keys
+		WHERE user_id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// Get the user details associated with an API key, along with the permission codes the
+// key is restricted to. The last_used_at timestamp is updated in the same query, so a
+// successful lookup costs just the one round trip.
+func (m UserModel) GetForAPIKey(ctx context.Context, plaintext string) (*User, Permissions, error) {
+	keyHash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		UPDATE api_keys
+		SET last_used_at = NOW()
+		FROM users
+		WHERE api_keys.user_id = users.id
+		AND api_keys.hash = $1
+		AND (api_keys.expiry IS NULL OR api_keys.expiry > $2)
+		AND NOT users.blocked
+		RETURNING users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.blocked, users.version, api_keys.permissions
+	`
+
+	args := []any{keyHash[:], time.Now()}
+
+	var (
+		user        User
+		permissions Permissions
+	)
+
+	ctx, span := startSpan(ctx, "UserModel.GetForAPIKey", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Blocked,
+		&user.Version,
+		pq.Array(&permissions),
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			span.RecordError(err)
+			return nil, nil, err
+		}
+	}
+
+	return &user, permissions, nil
+}
@@ -0,0 +1,113 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"time"
+)
+
+// Define an AuditEvent struct to hold a record of an administrative action. The actor
+// is the user who performed the action, and the target is the user it was performed
+// on. Details holds any extra information about the action, such as the fields that
+// were changed.
+type AuditEvent struct {
+	ID           int64          `json:"id"`
+	CreatedAt    time.Time      `json:"created_at"`
+	ActorID      *int64         `json:"actor_id"`
+	Action       string         `json:"action"`
+	TargetUserID *int64         `json:"target_user_id,omitempty"`
+	IPAddress    string         `json:"ip_address"`
+	Details      map[string]any `json:"details"`
+}
+
+// Define the AuditModel type.
+type AuditModel struct {
+	DB *sql.DB
+}
+
+// The Insert() method adds an event to the audit trail.
+func (m AuditModel) Insert(event *AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return insertAuditEvent(ctx, m.DB, event)
+}
+
+// The insertAuditEvent() helper runs the query for Insert(). It's shared with the
+// models which audit a change in the same transaction as making it.
+func insertAuditEvent(ctx context.Context, q queryRower, event *AuditEvent) error {
+	details, err := json.Marshal(event.Details)
+	if err != nil {
+		return err
+	}
+
+	query := `
+		INSERT INTO audit_events (actor_id, action, target_user_id, ip_address, details)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at
+	`
+
+	args := []any{event.ActorID, event.Action, event.TargetUserID, event.IPAddress, details}
+
+	return q.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// The GetAll() method returns a page of audit events, newest first. If targetUserID is
+// not nil, only the events for that user are returned.
+func (m AuditModel) GetAll(targetUserID *int64, filters Filters) ([]*AuditEvent, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, created_at, actor_id, action, target_user_id, ip_address, details
+		FROM audit_events
+		WHERE (target_user_id = $1 OR $1 IS NULL)
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, targetUserID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*AuditEvent{}
+
+	for rows.Next() {
+		var (
+			event   AuditEvent
+			details []byte
+		)
+
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.ActorID,
+			&event.Action,
+			&event.TargetUserID,
+			&event.IPAddress,
+			&details,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		err = json.Unmarshal(details, &event.Details)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+
+	return events, metadata, nil
+}
@@ -0,0 +1,208 @@
+package data
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrUnknownHashAlgorithm = errors.New("unknown password hash algorithm")
+)
+
+// The PasswordHasher interface is implemented by each of the supported password
+// hashing algorithms. Every hasher writes its algorithm and parameters into the
+// encoded hash, so a stored hash can always be checked by the hasher that recognizes
+// it, even after the configured hasher has been changed.
+type PasswordHasher interface {
+	// Hash returns the encoded hash of a plaintext password.
+	Hash(plaintextPassword string) ([]byte, error)
+	// Matches checks a plaintext password against an encoded hash.
+	Matches(hash []byte, plaintextPassword string) (bool, error)
+	// Recognizes reports whether the encoded hash was produced by this algorithm.
+	Recognizes(hash []byte) bool
+	// NeedsRehash reports whether a recognized hash was produced with parameters that
+	// are different to the ones this hasher is configured with.
+	NeedsRehash(hash []byte) bool
+	// MaxLength returns the longest plaintext password that can be hashed, in bytes.
+	MaxLength() int
+}
+
+// passwordHasher is used for all new password hashes. It defaults to bcrypt with a
+// cost of 12, which is what every existing hash in the users table was created with.
+var passwordHasher PasswordHasher = BcryptHasher{Cost: 12}
+
+// SetPasswordHasher changes the hasher used for new password hashes. It should be
+// called once when the application starts, before any passwords are hashed.
+func SetPasswordHasher(hasher PasswordHasher) {
+	passwordHasher = hasher
+}
+
+// hasherFor returns a hasher which can check the encoded hash. The configured hasher is
+// tried first, followed by the defaults for every other supported algorithm.
+func hasherFor(hash []byte) (PasswordHasher, error) {
+	hashers := []PasswordHasher{passwordHasher, BcryptHasher{}, Argon2idHasher{}}
+
+	for _, hasher := range hashers {
+		if hasher.Recognizes(hash) {
+			return hasher, nil
+		}
+	}
+
+	return nil, ErrUnknownHashAlgorithm
+}
+
+// BcryptHasher hashes passwords with bcrypt. Note that bcrypt ignores everything after
+// the first 72 bytes of a password, so longer passwords are rejected by validation.
+type BcryptHasher struct {
+	Cost int
+}
+
+func (h BcryptHasher) Hash(plaintextPassword string) ([]byte, error) {
+	return bcrypt.GenerateFromPassword([]byte(plaintextPassword), h.Cost)
+}
+
+func (h BcryptHasher) Matches(hash []byte, plaintextPassword string) (bool, error) {
+	err := bcrypt.CompareHashAndPassword(hash, []byte(plaintextPassword))
+	if err != nil {
+		switch {
+		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
+			return false, nil
+		default:
+			return false, err
+		}
+	}
+
+	return true, nil
+}
+
+func (h BcryptHasher) Recognizes(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$2a$")) || bytes.HasPrefix(hash, []byte("$2b$")) || bytes.HasPrefix(hash, []byte("$2y$"))
+}
+
+func (h BcryptHasher) NeedsRehash(hash []byte) bool {
+	cost, err := bcrypt.Cost(hash)
+	return err != nil || cost != h.Cost
+}
+
+func (h BcryptHasher) MaxLength() int {
+	return 72
+}
+
+// Argon2idHasher hashes passwords with argon2id, and encodes them in the same PHC
+// string format as the reference implementation:
+//
+// $argon2id$v=19$m=65536,t=3,p=2$<base64 salt>$<base64 key>
+//
+// Memory is given in KiB.
+type Argon2idHasher struct {
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+type argon2idParams struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+	salt        []byte
+	key         []byte
+}
+
+func (h Argon2idHasher) Hash(plaintextPassword string) ([]byte, error) {
+	salt := make([]byte, h.SaltLength)
+
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	key := argon2.IDKey([]byte(plaintextPassword), salt, h.Iterations, h.Memory, h.Parallelism, h.KeyLength)
+
+	encoded := fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version,
+		h.Memory,
+		h.Iterations,
+		h.Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(key),
+	)
+
+	return []byte(encoded), nil
+}
+
+func (h Argon2idHasher) Matches(hash []byte, plaintextPassword string) (bool, error) {
+	params, err := decodeArgon2id(hash)
+	if err != nil {
+		return false, err
+	}
+
+	key := argon2.IDKey([]byte(plaintextPassword), params.salt, params.iterations, params.memory, params.parallelism, uint32(len(params.key)))
+
+	return subtle.ConstantTimeCompare(key, params.key) == 1, nil
+}
+
+func (h Argon2idHasher) Recognizes(hash []byte) bool {
+	return bytes.HasPrefix(hash, []byte("$argon2id$"))
+}
+
+func (h Argon2idHasher) NeedsRehash(hash []byte) bool {
+	params, err := decodeArgon2id(hash)
+	if err != nil {
+		return true
+	}
+
+	return params.memory != h.Memory ||
+		params.iterations != h.Iterations ||
+		params.parallelism != h.Parallelism ||
+		len(params.salt) != int(h.SaltLength) ||
+		len(params.key) != int(h.KeyLength)
+}
+
+func (h Argon2idHasher) MaxLength() int {
+	return 500
+}
+
+// decodeArgon2id parses the parameters, salt and key out of an encoded argon2id hash.
+func decodeArgon2id(hash []byte) (*argon2idParams, error) {
+	parts := bytes.Split(hash, []byte("$"))
+	if len(parts) != 6 || string(parts[1]) != "argon2id" {
+		return nil, ErrUnknownHashAlgorithm
+	}
+
+	var version int
+	_, err := fmt.Sscanf(string(parts[2]), "v=%d", &version)
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+	if version != argon2.Version {
+		return nil, fmt.Errorf("unsupported argon2id version %d", version)
+	}
+
+	var params argon2idParams
+
+	_, err = fmt.Sscanf(string(parts[3]), "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism)
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+
+	params.salt, err = base64.RawStdEncoding.DecodeString(string(parts[4]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+
+	params.key, err = base64.RawStdEncoding.DecodeString(string(parts[5]))
+	if err != nil {
+		return nil, fmt.Errorf("invalid argon2id hash: %w", err)
+	}
+
+	return &params, nil
+}
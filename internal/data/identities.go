@@ -0,0 +1,141 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Define an OIDCLogin struct to hold the secrets for a login that has been sent to an
+// OpenID Connect provider. The state is sent to the provider and comes back in the
+// callback, and is used to find the nonce and PKCE code verifier again.
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	ExpiryTime   time.Time
+}
+
+// Define the IdentityModel type.
+type IdentityModel struct {
+	DB *sql.DB
+}
+
+// The InsertLogin() method saves a pending login.
+func (m IdentityModel) InsertLogin(login *OIDCLogin) error {
+	hash := sha256.Sum256([]byte(login.State))
+
+	query := `
+		INSERT INTO oidc_logins (hash, nonce, code_verifier, expiry)
+		VALUES ($1, $2, $3, $4)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash[:], login.Nonce, login.CodeVerifier, login.ExpiryTime)
+	return err
+}
+
+// The UseLogin() method deletes the pending login for a state and returns it, so that
+// each state can only be used once. ErrRecordNotFound is returned if there is no
+// unexpired login for the state. Expired logins are cleared out at the same time.
+func (m IdentityModel) UseLogin(state string) (*OIDCLogin, error) {
+	hash := sha256.Sum256([]byte(state))
+
+	query := `
+		DELETE FROM oidc_logins
+		WHERE hash = $1 OR expiry <= $2
+		RETURNING hash = $1 AND expiry > $2, nonce, code_verifier, expiry
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, hash[:], time.Now())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var login *OIDCLogin
+
+	for rows.Next() {
+		var (
+			match     bool
+			candidate = OIDCLogin{State: state}
+		)
+
+		err := rows.Scan(&match, &candidate.Nonce, &candidate.CodeVerifier, &candidate.ExpiryTime)
+		if err != nil {
+			return nil, err
+		}
+
+		if match {
+			login = &candidate
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if login == nil {
+		return nil, ErrRecordNotFound
+	}
+
+	return login, nil
+}
+
+// The GetUser() method returns the user linked to an identity at a provider.
+func (m IdentityModel) GetUser(issuer, subject string) (*User, error) {
+	query := `
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.blocked, users.version
+		FROM users
+		INNER JOIN user_identities ON user_identities.user_id = users.id
+		WHERE user_identities.issuer = $1 AND user_identities.subject = $2
+	`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Blocked,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// The Link() method links an identity at a provider to a user. Linking an identity
+// which is already linked to the same user is a no-op.
+func (m IdentityModel) Link(userID int64, issuer, subject string) error {
+	query := `
+		INSERT INTO user_identities (issuer, subject, user_id)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (issuer, subject) DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, issuer, subject, userID)
+	return err
+}
@@ -0,0 +1,247 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// Define an Invitation struct to hold the data for an invitation to register. Just
+// like tokens, only the SHA-256 hash of the code is stored. An invitation can be bound
+// to a single email address, can expire, can be limited to a number of uses, and can
+// grant permissions to the users who accept it.
+type Invitation struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	CreatedBy   *int64      `json:"created_by,omitempty"`
+	Plaintext   string      `json:"code,omitempty"`
+	Hash        []byte      `json:"-"`
+	Email       string      `json:"email,omitempty"`
+	Permissions Permissions `json:"permissions"`
+	ExpiryTime  *time.Time  `json:"expiry,omitempty"`
+	MaxUses     *int        `json:"max_uses,omitempty"`
+	Uses        int         `json:"uses"`
+}
+
+// The generateInvitationCode() function fills in a new random code for an invitation,
+// in the same format as a token.
+func generateInvitationCode(invitation *Invitation) error {
+	randomBytes := make([]byte, 16)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return err
+	}
+
+	invitation.Plaintext = base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+
+	hash := sha256.Sum256([]byte(invitation.Plaintext))
+	invitation.Hash = hash[:]
+
+	return nil
+}
+
+// Check that an invitation code has been provided and is exactly 26 bytes long.
+func ValidateInvitationCode(v *validator.Validator, code string) {
+	v.Check(code != "", "invitation", "must be provided")
+	v.Check(len(code) == 26, "invitation", "must be 26 bytes long")
+}
+
+func ValidateInvitation(v *validator.Validator, invitation *Invitation) {
+	if invitation.Email != "" {
+		v.Check(validator.Matches(invitation.Email, validator.EmailRX), "email", "must be a valid email address")
+	}
+
+	v.Check(validator.Unique(invitation.Permissions), "permissions", "must not contain duplicate values")
+
+	if invitation.ExpiryTime != nil {
+		v.Check(invitation.ExpiryTime.After(time.Now()), "expiry", "must be in the future")
+	}
+
+	if invitation.MaxUses != nil {
+		v.Check(*invitation.MaxUses > 0, "max_uses", "must be greater than zero")
+	}
+}
+
+// Define the InvitationModel type.
+type InvitationModel struct {
+	DB *sql.DB
+}
+
+// The Insert() method generates a code for a new invitation and saves it.
+func (m InvitationModel) Insert(invitation *Invitation) error {
+	err := generateInvitationCode(invitation)
+	if err != nil {
+		return err
+	}
+
+	if invitation.Permissions == nil {
+		invitation.Permissions = Permissions{}
+	}
+
+	query := `
+		INSERT INTO invitations (created_by, hash, email, permissions, expiry, max_uses)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6)
+		RETURNING id, created_at
+	`
+
+	args := []any{
+		invitation.CreatedBy,
+		invitation.Hash,
+		invitation.Email,
+		pq.Array(invitation.Permissions),
+		invitation.ExpiryTime,
+		invitation.MaxUses,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&invitation.ID, &invitation.CreatedAt)
+}
+
+// The GetAll() method returns every invitation, newest first.
+func (m InvitationModel) GetAll() ([]*Invitation, error) {
+	query := `
+		SELECT id, created_at, created_by, COALESCE(email, ''), permissions, expiry, max_uses, uses
+		FROM invitations
+		ORDER BY id DESC
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	invitations := []*Invitation{}
+
+	for rows.Next() {
+		var invitation Invitation
+
+		err := rows.Scan(
+			&invitation.ID,
+			&invitation.CreatedAt,
+			&invitation.CreatedBy,
+			&invitation.Email,
+			pq.Array(&invitation.Permissions),
+			&invitation.ExpiryTime,
+			&invitation.MaxUses,
+			&invitation.Uses,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		invitations = append(invitations, &invitation)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return invitations, nil
+}
+
+// The Redeem() method uses up one use of the invitation with the given code, and
+// returns it. ErrRecordNotFound is returned if there is no such invitation, or if it
+// has expired, has been used up, or is bound to a different email address. The check
+// and the increment happen in a single statement, so an invitation can't be used more
+// times than it allows.
+func (m InvitationModel) Redeem(code, email string) (*Invitation, error) {
+	hash := sha256.Sum256([]byte(code))
+
+	query := `
+		UPDATE invitations
+		SET uses = uses + 1
+		WHERE hash = $1
+		AND (email IS NULL OR email = $2)
+		AND (expiry IS NULL OR expiry > $3)
+		AND (max_uses IS NULL OR uses < max_uses)
+		RETURNING id, created_at, created_by, COALESCE(email, ''), permissions, expiry, max_uses, uses
+	`
+
+	var invitation Invitation
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], strings.TrimSpace(email), time.Now()).Scan(
+		&invitation.ID,
+		&invitation.CreatedAt,
+		&invitation.CreatedBy,
+		&invitation.Email,
+		pq.Array(&invitation.Permissions),
+		&invitation.ExpiryTime,
+		&invitation.MaxUses,
+		&invitation.Uses,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &invitation, nil
+}
+
+// The Release() method gives back a use of an invitation. It's called when the
+// registration that redeemed it fails, so that the failure doesn't count against the
+// usage limit.
+func (m InvitationModel) Release(id int64) error {
+	query := `
+		UPDATE invitations
+		SET uses = uses - 1
+		WHERE id = $1 AND uses > 0
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+	return err
+}
+
+// The Delete() method deletes an invitation, so that it can't be used any more.
+func (m InvitationModel) Delete(id int64) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM invitations
+		WHERE id = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,199 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// The outcomes of a login attempt. A blocked login is one with the right credentials
+// for an account that an administrator has blocked.
+const (
+	LoginSuccess = "success"
+	LoginFailure = "failure"
+	LoginBlocked = "blocked"
+)
+
+// Define a LoginEvent struct to hold a record of an attempt to log in. The method is
+// how the user tried to prove who they are ("password", "totp", "magic-link" or
+// "oidc"). The network is the part of the IP address that identifies the network that
+// the attempt came from, and is used to spot logins from somewhere new.
+type LoginEvent struct {
+	ID          int64      `json:"id"`
+	CreatedAt   time.Time  `json:"created_at"`
+	UserID      *int64     `json:"user_id,omitempty"`
+	Email       string     `json:"email,omitempty"`
+	Method      string     `json:"method"`
+	Outcome     string     `json:"outcome"`
+	IPAddress   string     `json:"ip_address"`
+	Network     string     `json:"-"`
+	UserAgent   string     `json:"user_agent"`
+	SessionHash []byte     `json:"-"`
+	RevokeHash  []byte     `json:"-"`
+	RevokedAt   *time.Time `json:"revoked_at,omitempty"`
+}
+
+// The NewRevokeCode() method generates the code which revokes the session started by
+// a successful login, and sets the event's RevokeHash. Only the hash is stored, and the
+// plaintext code is returned so that it can be emailed to the user.
+func (e *LoginEvent) NewRevokeCode() (string, error) {
+	plaintext, err := randomString(16)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256([]byte(plaintext))
+	e.RevokeHash = hash[:]
+
+	return plaintext, nil
+}
+
+// Define the LoginEventModel type.
+type LoginEventModel struct {
+	DB *sql.DB
+}
+
+// The Insert() method adds an event to the login history.
+func (m LoginEventModel) Insert(event *LoginEvent) error {
+	query := `
+		INSERT INTO login_events (user_id, email, method, outcome, ip_address, network, user_agent, session_hash, revoke_hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at
+	`
+
+	args := []any{
+		event.UserID,
+		event.Email,
+		event.Method,
+		event.Outcome,
+		event.IPAddress,
+		event.Network,
+		event.UserAgent,
+		event.SessionHash,
+		event.RevokeHash,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+}
+
+// The Familiarity() method looks through a user's successful logins and reports
+// whether they have logged in before at all, whether they have done so with the user
+// agent before, and whether they have done so from the network before.
+func (m LoginEventModel) Familiarity(userID int64, userAgent, network string) (seenUser, seenDevice, seenNetwork bool, err error) {
+	query := `
+		SELECT count(*) > 0, COALESCE(bool_or(user_agent = $2), false), COALESCE(bool_or(network = $3), false)
+		FROM login_events
+		WHERE user_id = $1 AND outcome = $4
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err = m.DB.QueryRowContext(ctx, query, userID, userAgent, network, LoginSuccess).Scan(&seenUser, &seenDevice, &seenNetwork)
+
+	return seenUser, seenDevice, seenNetwork, err
+}
+
+// The GetAllForUser() method returns a page of a user's login history, newest first.
+func (m LoginEventModel) GetAllForUser(userID int64, filters Filters) ([]*LoginEvent, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, created_at, user_id, email, method, outcome, ip_address, user_agent, revoked_at
+		FROM login_events
+		WHERE user_id = $1
+		ORDER BY id DESC
+		LIMIT $2 OFFSET $3
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, filters.limit(), filters.offset())
+	if err != nil {
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	events := []*LoginEvent{}
+
+	for rows.Next() {
+		var event LoginEvent
+
+		err := rows.Scan(
+			&totalRecords,
+			&event.ID,
+			&event.CreatedAt,
+			&event.UserID,
+			&event.Email,
+			&event.Method,
+			&event.Outcome,
+			&event.IPAddress,
+			&event.UserAgent,
+			&event.RevokedAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+
+	return events, metadata, nil
+}
+
+// The RevokeSession() method uses up a revoke code and deletes the authentication token
+// for the session it belongs to, in a single transaction. It returns the ID of the user
+// whose session it was, or ErrRecordNotFound if the code is unknown or already used.
+func (m LoginEventModel) RevokeSession(plaintext string) (int64, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE login_events
+		SET revoke_hash = NULL, revoked_at = NOW()
+		WHERE revoke_hash = $1
+		RETURNING user_id, session_hash
+	`
+
+	var (
+		userID      int64
+		sessionHash []byte
+	)
+
+	err = tx.QueryRowContext(ctx, query, hash[:]).Scan(&userID, &sessionHash)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			return 0, err
+		}
+	}
+
+	if sessionHash != nil {
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE hash = $1 AND scope = $2`, sessionHash, ScopeAuthentication)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return userID, tx.Commit()
+}
@@ -1,6 +1,7 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 )
@@ -12,12 +13,27 @@ var (
 	ErrEditConflict   = errors.New("edit conflict")
 )
 
+// The queryRower interface is satisfied by both *sql.DB and *sql.Tx, so that helpers
+// which run a single query can be used inside a transaction or outside of one.
+type queryRower interface {
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
 // Create a Models struct which wraps the MovieModel. We'll add other models to this,
 // like a UserModel and PermissionModel, as our build progresses.
 type Models struct {
+	APIKeys     APIKeyModel
+	Audit       AuditModel
+	Identities  IdentityModel
+	Invitations InvitationModel
+	LoginEvents LoginEventModel
+	Logins      LoginThrottleModel
 	Movies      MovieModel
+	OAuth       OAuthModel
 	Permissions PermissionModel
+	Roles       RoleModel
 	Tokens      TokenModel
+	TOTP        TOTPModel
 	Users       UserModel
 }
 
@@ -25,9 +41,18 @@ type Models struct {
 // the initialized MovieModel.
 func NewModels(db *sql.DB) Models {
 	return Models{
+		APIKeys:     APIKeyModel{DB: db},
+		Audit:       AuditModel{DB: db},
+		Identities:  IdentityModel{DB: db},
+		Invitations: InvitationModel{DB: db},
+		LoginEvents: LoginEventModel{DB: db},
+		Logins:      LoginThrottleModel{DB: db},
 		Movies:      MovieModel{DB: db},
+		OAuth:       OAuthModel{DB: db},
 		Permissions: PermissionModel{DB: db},
+		Roles:       RoleModel{DB: db},
 		Tokens:      TokenModel{DB: db},
+		TOTP:        TOTPModel{DB: db},
 		Users:       UserModel{DB: db},
 	}
 }
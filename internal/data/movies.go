@@ -19,6 +19,8 @@ type Movie struct {
 	Runtime   int32     `json:"runtime,omitempty"`
 	Genres    []string  `json:"genres,omitempty"`
 	Version   int32     `json:"version"` //The version number starts with 1 and be in incremented each time the information is updated
+	// CreatedBy is nil for movies created before ownership was recorded.
+	CreatedBy *int64 `json:"created_by,omitempty"`
 }
 
 /*
@@ -59,43 +61,54 @@ type MovieModel struct {
 // Add a placeholder method for inserting a new record in the movies table.
 // The Insert() method accepts a pointer to a movie struct, which should contain the
 // data for the new record.
-func (m MovieModel) Insert(movie *Movie) error {
+func (m MovieModel) Insert(ctx context.Context, movie *Movie) error {
 	//Defining the query:
 	query := `
-		INSERT INTO movies (title, year, runtime, genres)
-		VALUES ($1, $2, $3, $4)
+		INSERT INTO movies (title, year, runtime, genres, created_by)
+		VALUES ($1, $2, $3, $4, $5)
 		RETURNING id, created_at, version
 	`
 	// Create an args slice containing the values for the placeholder parameters from
 	// the movie struct. Declaring this slice immediately next to our SQL query helps to
 	// make it nice and clear *what values are being used where* in the query.
-	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres)}
+	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.CreatedBy}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "MovieModel.Insert", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// Use the QueryRow() method to execute the SQL query on our connection pool,
 	// passing in the args slice as a variadic parameter and scanning the system-
 	// generated id, created_at and version values into the movie struct.
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.ID, &movie.CreatedAt, &movie.Version)
+	span.RecordError(err)
+
+	return err
 }
 
 // Add a placeholder method for fetching a specific record from the movies table
-func (m MovieModel) Get(id int64) (*Movie, error) {
+func (m MovieModel) Get(ctx context.Context, id int64) (*Movie, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 	query := `
-		SELECT id, created_at, title, year, runtime, genres, version
+		SELECT id, created_at, title, year, runtime, genres, version, created_by
 		FROM movies
 		WHERE id = $1`
 
 	var moive Movie
 
+	// Start a span for the query, as a child of whatever span is in the context that was
+	// passed in (usually the one for the HTTP request).
+	ctx, span := startSpan(ctx, "MovieModel.Get", query)
+	defer span.End()
+
 	// Use the context.WithTimeout() function to create a context.Context which carries a
-	// 3-second timeout deadline. Note that we're using the empty context.Background()
-	// as the 'parent' context.
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	// 3-second timeout deadline. Note that we're using the span's context as the
+	// 'parent' context, so the deadline is also shortened if the request is cancelled.
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 
 	// Importantly, use defer to make sure that we cancel the context before the Get()
 	// method returns.
@@ -115,6 +128,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		&moive.Runtime,
 		pq.Array(&moive.Genres),
 		&moive.Version,
+		&moive.CreatedBy,
 	)
 
 	// Handle any errors. If there was no matching movie found, Scan() will return
@@ -125,6 +139,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
+			span.RecordError(err)
 			return nil, err
 		}
 	}
@@ -134,7 +149,7 @@ func (m MovieModel) Get(id int64) (*Movie, error) {
 }
 
 // Add a placeholder method for updating a specific record from the movies table.
-func (m MovieModel) Update(movie *Movie) error {
+func (m MovieModel) Update(ctx context.Context, movie *Movie) error {
 	query := `
 		UPDATE movies
 		SET title = $1, year = $2, runtime = $3, genres = $4, version = version + 1
@@ -143,7 +158,10 @@ func (m MovieModel) Update(movie *Movie) error {
 	`
 	args := []any{movie.Title, movie.Year, movie.Runtime, pq.Array(movie.Genres), movie.ID, movie.Version}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "MovieModel.Update", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&movie.Version)
@@ -154,6 +172,7 @@ func (m MovieModel) Update(movie *Movie) error {
 			return ErrEditConflict
 
 		default:
+			span.RecordError(err)
 			return err
 		}
 	}
@@ -162,7 +181,7 @@ func (m MovieModel) Update(movie *Movie) error {
 }
 
 // Add a placeholder method for deleting a specific record from the movies table.
-func (m MovieModel) Delete(id int64) error {
+func (m MovieModel) Delete(ctx context.Context, id int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -172,19 +191,24 @@ func (m MovieModel) Delete(id int64) error {
 		WHERE id = $1
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "MovieModel.Delete", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 	// Execute the SQL query using the Exec() method, passing in the id variable as
 	// the value for the placeholder parameter. The Exec() method returns a sql.Result
 	// object.
 	result, err := m.DB.ExecContext(ctx, query, id)
 	if err != nil {
+		span.RecordError(err)
 		return err
 	}
 
 	//Check the number of rows affected by the query:
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
+		span.RecordError(err)
 		return err
 	}
 
@@ -196,14 +220,14 @@ func (m MovieModel) Delete(id int64) error {
 	return nil
 }
 
-func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
+func (m MovieModel) GetAll(ctx context.Context, title string, genres []string, filters Filters) ([]*Movie, Metadata, error) {
 
 	//Dyanically building the query based on sort parameter
 	//Notice that we have added id in the ORDER BY to make sure consistent returs
 	//for same pages fetched by different users
 	//count(*) OVER() is called window function which counts after applying filters
 	query := fmt.Sprintf(`
-		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version 
+		SELECT count(*) OVER(), id, created_at, title, year, runtime, genres, version, created_by
 		FROM movies
 		WHERE (to_tsvector('simple', title) @@ plainto_tsquery('simple', $1) OR $1 = '')
 		AND (genres @> $2 OR $2 = '{}')
@@ -211,14 +235,18 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 		LIMIT $3 OFFSET $4
 	`, filters.sortColumn(), filters.sortDirection())
 
+	ctx, span := startSpan(ctx, "MovieModel.GetAll", query)
+	defer span.End()
+
 	// A fail-safe for timeout:
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	args := []any{title, pq.Array(genres), filters.limit(), filters.offset()}
 
 	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
+		span.RecordError(err)
 		return nil, Metadata{}, err
 	}
 
@@ -244,9 +272,11 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 			&movie.Runtime,
 			pq.Array(&movie.Genres),
 			&movie.Version,
+			&movie.CreatedBy,
 		)
 
 		if err != nil {
+			span.RecordError(err)
 			return nil, Metadata{}, err
 		}
 
@@ -256,6 +286,7 @@ func (m MovieModel) GetAll(title string, genres []string, filters Filters) ([]*M
 	// When the rows.Next() loop has finished, call rows.Err() to retrieve any error
 	// that was encountered during the iteration.
 	if err = rows.Err(); err != nil {
+		span.RecordError(err)
 		return nil, Metadata{}, err
 	}
 
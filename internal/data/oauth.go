@@ -0,0 +1,549 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+// Authorization codes and access tokens issued to OAuth clients are stored in the
+// tokens table with these scopes.
+const (
+	ScopeOAuthCode   = "oauth-code"
+	ScopeOAuthAccess = "oauth-access"
+)
+
+// Tokens issued to OAuth clients are prefixed so that the authenticate middleware can
+// tell them apart from a user's own authentication tokens without a database lookup.
+const OAuthTokenPrefix = "glo_"
+
+// Define an OAuthClient struct to hold the data for a third-party application. The
+// ClientID is the public identifier that the application sends in requests. Only the
+// SHA-256 hash of the secret is stored, and the plaintext is shown to the owner once,
+// when the client is registered. Public clients (such as mobile apps, which can't keep
+// a secret) have no secret at all.
+type OAuthClient struct {
+	ID           int64       `json:"id"`
+	CreatedAt    time.Time   `json:"created_at"`
+	UserID       int64       `json:"-"`
+	ClientID     string      `json:"client_id"`
+	Secret       string      `json:"client_secret,omitempty"`
+	SecretHash   []byte      `json:"-"`
+	Confidential bool        `json:"confidential"`
+	Name         string      `json:"name"`
+	RedirectURIs []string    `json:"redirect_uris"`
+	Scopes       Permissions `json:"scopes"`
+}
+
+// The MatchesSecret() method reports whether the plaintext secret is the client's
+// secret. Public clients never match.
+func (c *OAuthClient) MatchesSecret(plaintext string) bool {
+	if c.SecretHash == nil {
+		return false
+	}
+
+	hash := sha256.Sum256([]byte(plaintext))
+	return subtle.ConstantTimeCompare(hash[:], c.SecretHash) == 1
+}
+
+// Define an OAuthToken struct to hold an authorization code or access token, along
+// with the client it was issued to and the permissions it grants. The code challenge
+// and redirect URI are only set for authorization codes.
+type OAuthToken struct {
+	Token
+	ClientID      int64
+	Permissions   Permissions
+	CodeChallenge string
+	RedirectURI   string
+}
+
+// Define an OAuthConsent struct to hold the scopes that a user has agreed to let a
+// client use.
+type OAuthConsent struct {
+	Client    OAuthClient `json:"client"`
+	Scopes    Permissions `json:"scopes"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+}
+
+// randomString returns n random bytes encoded as unpadded base-32, the same format as
+// tokens.
+func randomString(n int) (string, error) {
+	randomBytes := make([]byte, n)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes), nil
+}
+
+func ValidateOAuthClient(v *validator.Validator, client *OAuthClient) {
+	v.Check(client.Name != "", "name", "must be provided")
+	v.Check(len(client.Name) <= 100, "name", "must not be more than 100 bytes long")
+
+	v.Check(len(client.RedirectURIs) >= 1, "redirect_uris", "must contain at least 1 URI")
+	v.Check(len(client.RedirectURIs) <= 10, "redirect_uris", "must not contain more than 10 URIs")
+	v.Check(validator.Unique(client.RedirectURIs), "redirect_uris", "must not contain duplicate values")
+
+	for _, uri := range client.RedirectURIs {
+		v.Check(validRedirectURI(uri), "redirect_uris", "must only contain absolute https URIs (or http for localhost) without fragments")
+	}
+
+	v.Check(len(client.Scopes) >= 1, "scopes", "must contain at least 1 scope")
+	v.Check(validator.Unique(client.Scopes), "scopes", "must not contain duplicate values")
+}
+
+// validRedirectURI reports whether a redirect URI can be registered. Codes are sent to
+// it in the query string, so it has to use TLS unless it points back at the user's own
+// machine.
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.Fragment != "" {
+		return false
+	}
+
+	switch u.Scheme {
+	case "https":
+		return true
+	case "http":
+		host := u.Hostname()
+		return host == "localhost" || host == "127.0.0.1" || host == "::1"
+	}
+
+	return false
+}
+
+// Define the OAuthModel type.
+type OAuthModel struct {
+	DB *sql.DB
+}
+
+// The InsertClient() method generates a client ID (and a secret, for confidential
+// clients) and inserts a new client.
+func (m OAuthModel) InsertClient(client *OAuthClient) error {
+	var err error
+
+	client.ClientID, err = randomString(16)
+	if err != nil {
+		return err
+	}
+
+	if client.Confidential {
+		client.Secret, err = randomString(32)
+		if err != nil {
+			return err
+		}
+
+		hash := sha256.Sum256([]byte(client.Secret))
+		client.SecretHash = hash[:]
+	}
+
+	query := `
+		INSERT INTO oauth_clients (user_id, client_id, secret_hash, name, redirect_uris, scopes)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`
+
+	args := []any{
+		client.UserID,
+		client.ClientID,
+		client.SecretHash,
+		client.Name,
+		pq.Array(client.RedirectURIs),
+		pq.Array(client.Scopes),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&client.ID, &client.CreatedAt)
+}
+
+const oauthClientColumns = `
+	oauth_clients.id, oauth_clients.created_at, oauth_clients.user_id, oauth_clients.client_id,
+	oauth_clients.secret_hash, oauth_clients.name, oauth_clients.redirect_uris, oauth_clients.scopes
+`
+
+func scanOAuthClient(row interface{ Scan(...any) error }, client *OAuthClient) error {
+	err := row.Scan(
+		&client.ID,
+		&client.CreatedAt,
+		&client.UserID,
+		&client.ClientID,
+		&client.SecretHash,
+		&client.Name,
+		pq.Array(&client.RedirectURIs),
+		pq.Array(&client.Scopes),
+	)
+
+	client.Confidential = client.SecretHash != nil
+
+	return err
+}
+
+// The GetClient() method returns the client with a public client ID.
+func (m OAuthModel) GetClient(clientID string) (*OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients WHERE client_id = $1`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var client OAuthClient
+
+	err := scanOAuthClient(m.DB.QueryRowContext(ctx, query, clientID), &client)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &client, nil
+}
+
+// The GetClientsForUser() method returns the clients that a user has registered,
+// newest first.
+func (m OAuthModel) GetClientsForUser(userID int64) ([]*OAuthClient, error) {
+	query := `SELECT ` + oauthClientColumns + ` FROM oauth_clients WHERE user_id = $1 ORDER BY id DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	clients := []*OAuthClient{}
+
+	for rows.Next() {
+		var client OAuthClient
+
+		err := scanOAuthClient(rows, &client)
+		if err != nil {
+			return nil, err
+		}
+
+		clients = append(clients, &client)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return clients, nil
+}
+
+// The DeleteClient() method deletes a client, but only if it belongs to the user. Every
+// consent, code and token for the client goes with it.
+func (m OAuthModel) DeleteClient(id, userID int64) error {
+	query := `
+		DELETE FROM oauth_clients
+		WHERE id = $1 AND user_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// The GetConsent() method returns the scopes that a user has agreed to let a client
+// use. An empty slice is returned if the user hasn't consented to anything.
+func (m OAuthModel) GetConsent(userID, clientID int64) (Permissions, error) {
+	query := `
+		SELECT scopes
+		FROM oauth_consents
+		WHERE user_id = $1 AND client_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	scopes := Permissions{}
+
+	err := m.DB.QueryRowContext(ctx, query, userID, clientID).Scan(pq.Array(&scopes))
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	return scopes, nil
+}
+
+// The AddConsent() method records that a user has agreed to let a client use some
+// scopes, in addition to any that they have already agreed to.
+func (m OAuthModel) AddConsent(userID, clientID int64, scopes Permissions) error {
+	query := `
+		INSERT INTO oauth_consents (user_id, client_id, scopes)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (user_id, client_id) DO UPDATE
+		SET scopes = ARRAY(SELECT DISTINCT unnest(oauth_consents.scopes || EXCLUDED.scopes) ORDER BY 1),
+			updated_at = NOW()
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID, clientID, pq.Array(scopes))
+	return err
+}
+
+// The GetConsentsForUser() method returns every consent that a user has given, most
+// recently updated first.
+func (m OAuthModel) GetConsentsForUser(userID int64) ([]*OAuthConsent, error) {
+	query := `SELECT ` + oauthClientColumns + `, oauth_consents.scopes, oauth_consents.created_at, oauth_consents.updated_at
+		FROM oauth_consents
+		INNER JOIN oauth_clients ON oauth_clients.id = oauth_consents.client_id
+		WHERE oauth_consents.user_id = $1
+		ORDER BY oauth_consents.updated_at DESC`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	consents := []*OAuthConsent{}
+
+	for rows.Next() {
+		var consent OAuthConsent
+
+		err := rows.Scan(
+			&consent.Client.ID,
+			&consent.Client.CreatedAt,
+			&consent.Client.UserID,
+			&consent.Client.ClientID,
+			&consent.Client.SecretHash,
+			&consent.Client.Name,
+			pq.Array(&consent.Client.RedirectURIs),
+			pq.Array(&consent.Client.Scopes),
+			pq.Array(&consent.Scopes),
+			&consent.CreatedAt,
+			&consent.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		consent.Client.Confidential = consent.Client.SecretHash != nil
+
+		consents = append(consents, &consent)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return consents, nil
+}
+
+// The DeleteConsent() method withdraws a user's consent for a client, and deletes every
+// code and token that the client holds for the user, in a single transaction.
+func (m OAuthModel) DeleteConsent(userID, clientID int64) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, `DELETE FROM oauth_consents WHERE user_id = $1 AND client_id = $2`, userID, clientID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1 AND client_id = $2`, userID, clientID)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The NewToken() method creates an authorization code or access token for a client and
+// inserts it in the tokens table. It's hashed in exactly the same way as every other
+// token, but carries the OAuthTokenPrefix.
+func (m OAuthModel) NewToken(token *OAuthToken, ttl time.Duration) error {
+	random, err := randomString(20)
+	if err != nil {
+		return err
+	}
+
+	token.Plaintext = OAuthTokenPrefix + random
+	hash := sha256.Sum256([]byte(token.Plaintext))
+	token.Hash = hash[:]
+	token.ExpiryTime = time.Now().Add(ttl)
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, client_id, permissions, code_challenge, redirect_uri)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''))
+	`
+
+	args := []any{
+		token.Hash,
+		token.UserID,
+		token.ExpiryTime,
+		token.Scope,
+		token.ClientID,
+		pq.Array(token.Permissions),
+		token.CodeChallenge,
+		token.RedirectURI,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err = m.DB.ExecContext(ctx, query, args...)
+	return err
+}
+
+// ValidOAuthTokenPlaintext reports whether a string looks like a token issued by
+// NewToken(): the prefix followed by 32 bytes of base-32.
+func ValidOAuthTokenPlaintext(plaintext string) bool {
+	return strings.HasPrefix(plaintext, OAuthTokenPrefix) && len(plaintext) == len(OAuthTokenPrefix)+32
+}
+
+// The UseCode() method deletes an unexpired authorization code and returns it. Just
+// like TokenModel.Use(), this makes sure that a code can only ever be exchanged once.
+func (m OAuthModel) UseCode(plaintext string) (*OAuthToken, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id, expiry, client_id, permissions, code_challenge, redirect_uri
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	token := OAuthToken{Token: Token{Plaintext: plaintext, Hash: hash[:], Scope: ScopeOAuthCode}}
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], ScopeOAuthCode, time.Now()).Scan(
+		&token.UserID,
+		&token.ExpiryTime,
+		&token.ClientID,
+		pq.Array(&token.Permissions),
+		&token.CodeChallenge,
+		&token.RedirectURI,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &token, nil
+}
+
+// The GetAccessToken() method returns an unexpired access token, along with the user it
+// acts for. Tokens belonging to blocked users are treated as if they don't exist.
+func (m OAuthModel) GetAccessToken(plaintext string) (*OAuthToken, *User, error) {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		SELECT tokens.expiry, tokens.client_id, tokens.permissions,
+			users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.blocked, users.version
+		FROM tokens
+		INNER JOIN users ON users.id = tokens.user_id
+		WHERE tokens.hash = $1 AND tokens.scope = $2 AND tokens.expiry > $3
+		AND NOT users.blocked
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	var (
+		token = OAuthToken{Token: Token{Plaintext: plaintext, Hash: hash[:], Scope: ScopeOAuthAccess}}
+		user  User
+	)
+
+	err := m.DB.QueryRowContext(ctx, query, hash[:], ScopeOAuthAccess, time.Now()).Scan(
+		&token.ExpiryTime,
+		&token.ClientID,
+		pq.Array(&token.Permissions),
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Blocked,
+		&user.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, nil, ErrRecordNotFound
+		default:
+			return nil, nil, err
+		}
+	}
+
+	token.UserID = user.ID
+
+	return &token, &user, nil
+}
+
+// The RevokeToken() method deletes a code or access token, but only if it was issued
+// to the client.
+func (m OAuthModel) RevokeToken(plaintext string, clientID int64) error {
+	hash := sha256.Sum256([]byte(plaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND client_id = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, hash[:], clientID)
+	return err
+}
@@ -19,60 +19,173 @@ func (p Permissions) Include(code string) bool {
 	return slices.Contains(p, code)
 }
 
+// The Intersect() method returns the permission codes that appear in both slices. It's
+// used to restrict a user's permissions to those granted to an API key.
+func (p Permissions) Intersect(other Permissions) Permissions {
+	permissions := Permissions{}
+
+	for _, code := range p {
+		if other.Include(code) {
+			permissions = append(permissions, code)
+		}
+	}
+
+	return permissions
+}
+
 // Define the PermissionModel type.
 type PermissionModel struct {
 	DB *sql.DB
 }
 
+// The GetAll() method returns every permission code that exists, in alphabetical
+// order.
+func (m PermissionModel) GetAll(ctx context.Context) (Permissions, error) {
+	query := `
+		SELECT DISTINCT code
+		FROM permissions
+		ORDER BY code
+	`
+
+	return m.query(ctx, "PermissionModel.GetAll", query)
+}
+
 // The GetAllForUser() method returns all permission codes for a specific user in a
-// Permissions slice. The code in this method should feel very familiar --- it uses the
-// standard pattern that we've already seen before for retrieving multiple data rows in
-// an SQL query.
-func (m PermissionModel) GetAllForUser(userID int64) (Permissions, error) {
+// Permissions slice. This includes the permissions granted to the user directly, along
+// with the permissions of every role they have been assigned. The code in this method
+// should feel very familiar --- it uses the standard pattern that we've already seen
+// before for retrieving multiple data rows in an SQL query.
+func (m PermissionModel) GetAllForUser(ctx context.Context, userID int64) (Permissions, error) {
 	query := `
 		SELECT permissions.code
 		FROM permissions
 		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
-		INNER JOIN users ON users_permissions.user_id = users.id
-		WHERE users.id = $1
+		WHERE users_permissions.user_id = $1
+		UNION
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN roles_permissions ON roles_permissions.permission_id = permissions.id
+		INNER JOIN users_roles ON users_roles.role_id = roles_permissions.role_id
+		WHERE users_roles.user_id = $1
+		ORDER BY code
+	`
+
+	return m.query(ctx, "PermissionModel.GetAllForUser", query, userID)
+}
+
+// The GetDirectForUser() method returns only the permission codes that have been
+// granted to a user directly, and not through a role.
+func (m PermissionModel) GetDirectForUser(ctx context.Context, userID int64) (Permissions, error) {
+	query := `
+		SELECT permissions.code
+		FROM permissions
+		INNER JOIN users_permissions ON users_permissions.permission_id = permissions.id
+		WHERE users_permissions.user_id = $1
+		ORDER BY permissions.code
 	`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	return m.query(ctx, "PermissionModel.GetDirectForUser", query, userID)
+}
+
+// The query() helper runs a query which returns a single column of permission codes.
+// The name is used for the query's span.
+func (m PermissionModel) query(ctx context.Context, name, query string, args ...any) (Permissions, error) {
+	ctx, span := startSpan(ctx, name, query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, userID)
+	rows, err := m.DB.QueryContext(ctx, query, args...)
 	if err != nil {
+		span.RecordError(err)
 		return nil, err
 	}
 	defer rows.Close()
 
-	var permissions Permissions
+	permissions := Permissions{}
 
 	for rows.Next() {
 		var permission string
 
 		err := rows.Scan(&permission)
 		if err != nil {
+			span.RecordError(err)
 			return nil, err
 		}
 
 		permissions = append(permissions, permission)
 	}
 	if err = rows.Err(); err != nil {
+		span.RecordError(err)
 		return nil, err
 	}
 
 	return permissions, nil
 }
 
-func (m PermissionModel) AddForUser(userID int64, codes ...string) error {
+// The AddForUser() method grants permissions to a user directly. Permissions which the
+// user already has are skipped. If event isn't nil, it's added to the audit trail in the
+// same transaction.
+func (m PermissionModel) AddForUser(ctx context.Context, userID int64, event *AuditEvent, codes ...string) error {
 	query := `
 		INSERT INTO users_permissions
 		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, span := startSpan(ctx, "PermissionModel.AddForUser", query)
+	defer span.End()
+
+	err := m.change(ctx, query, userID, event, codes)
+	span.RecordError(err)
+
+	return err
+}
+
+// The RemoveForUser() method revokes permissions that were granted to a user directly.
+// Note that the user keeps any of the permissions which come from one of their roles.
+// Like AddForUser(), the event is saved in the same transaction as the change.
+func (m PermissionModel) RemoveForUser(ctx context.Context, userID int64, event *AuditEvent, codes ...string) error {
+	query := `
+		DELETE FROM users_permissions
+		USING permissions
+		WHERE users_permissions.permission_id = permissions.id
+		AND users_permissions.user_id = $1
+		AND permissions.code = ANY($2)
+	`
+
+	ctx, span := startSpan(ctx, "PermissionModel.RemoveForUser", query)
+	defer span.End()
+
+	err := m.change(ctx, query, userID, event, codes)
+	span.RecordError(err)
 
-	_, err := m.DB.ExecContext(ctx, query, userID, pq.Array(codes))
 	return err
 }
+
+// The change() helper runs the query for AddForUser() or RemoveForUser(), and inserts
+// the audit event (if there is one) in the same transaction.
+func (m PermissionModel) change(ctx context.Context, query string, userID int64, event *AuditEvent, codes []string) error {
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.Array(codes))
+	if err != nil {
+		return err
+	}
+
+	if event != nil {
+		err = insertAuditEvent(ctx, tx, event)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
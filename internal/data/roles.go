@@ -0,0 +1,311 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"regexp"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+var (
+	ErrDuplicateRoleName = errors.New("duplicate role name")
+)
+
+// RoleNameRX matches role names made up of lower case letters, digits, dashes and
+// underscores, starting with a letter.
+var RoleNameRX = regexp.MustCompile("^[a-z][a-z0-9_-]*$")
+
+// Define a Role struct to hold a named bundle of permission codes. Users who are
+// assigned a role get all of its permissions, and the default role is assigned to every
+// new user when they register.
+type Role struct {
+	ID          int64       `json:"id"`
+	CreatedAt   time.Time   `json:"created_at"`
+	Name        string      `json:"name"`
+	Permissions Permissions `json:"permissions"`
+	IsDefault   bool        `json:"is_default"`
+}
+
+func ValidateRoleName(v *validator.Validator, name string) {
+	v.Check(name != "", "name", "must be provided")
+	v.Check(len(name) <= 50, "name", "must not be more than 50 bytes long")
+	v.Check(validator.Matches(name, RoleNameRX), "name", "must only contain lower case letters, digits, dashes and underscores")
+}
+
+func ValidateRole(v *validator.Validator, role *Role) {
+	ValidateRoleName(v, role.Name)
+
+	v.Check(role.Permissions != nil, "permissions", "must be provided")
+	v.Check(validator.Unique(role.Permissions), "permissions", "must not contain duplicate values")
+}
+
+// Define the RoleModel type.
+type RoleModel struct {
+	DB *sql.DB
+}
+
+// The Insert() method creates a new role along with its permissions. If the role is
+// marked as the default, it replaces the existing default role. The event is added to
+// the audit trail in the same transaction, so the role is never created without it.
+func (m RoleModel) Insert(role *Role, event *AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if role.IsDefault {
+		_, err = tx.ExecContext(ctx, `UPDATE roles SET is_default = false WHERE is_default`)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := `
+		INSERT INTO roles (name, is_default)
+		VALUES ($1, $2)
+		RETURNING id, created_at
+	`
+
+	err = tx.QueryRowContext(ctx, query, role.Name, role.IsDefault).Scan(&role.ID, &role.CreatedAt)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "roles_name_key"`:
+			return ErrDuplicateRoleName
+		default:
+			return err
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		INSERT INTO roles_permissions
+		SELECT $1, permissions.id FROM permissions WHERE permissions.code = ANY($2)
+		ON CONFLICT DO NOTHING
+	`, role.ID, pq.Array(role.Permissions))
+	if err != nil {
+		return err
+	}
+
+	err = insertAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The GetAll() method returns every role with its permissions, ordered by name.
+func (m RoleModel) GetAll() ([]*Role, error) {
+	query := `
+		SELECT roles.id, roles.created_at, roles.name, roles.is_default,
+			COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		GROUP BY roles.id
+		ORDER BY roles.name
+	`
+
+	return m.query(query)
+}
+
+// The GetAllForUser() method returns the roles that have been assigned to a user.
+func (m RoleModel) GetAllForUser(userID int64) ([]*Role, error) {
+	query := `
+		SELECT roles.id, roles.created_at, roles.name, roles.is_default,
+			COALESCE(array_agg(permissions.code ORDER BY permissions.code) FILTER (WHERE permissions.code IS NOT NULL), '{}')
+		FROM roles
+		INNER JOIN users_roles ON users_roles.role_id = roles.id
+		LEFT JOIN roles_permissions ON roles_permissions.role_id = roles.id
+		LEFT JOIN permissions ON permissions.id = roles_permissions.permission_id
+		WHERE users_roles.user_id = $1
+		GROUP BY roles.id
+		ORDER BY roles.name
+	`
+
+	return m.query(query, userID)
+}
+
+func (m RoleModel) query(query string, args ...any) ([]*Role, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	roles := []*Role{}
+
+	for rows.Next() {
+		var role Role
+
+		err := rows.Scan(
+			&role.ID,
+			&role.CreatedAt,
+			&role.Name,
+			&role.IsDefault,
+			pq.Array(&role.Permissions),
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		roles = append(roles, &role)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return roles, nil
+}
+
+// The SetDefault() method makes the named role the one that is assigned to new users.
+// ErrRecordNotFound is returned if there is no role with that name. Like Insert(), the
+// change and its audit event are saved together.
+func (m RoleModel) SetDefault(name string, event *AuditEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `UPDATE roles SET is_default = false WHERE is_default`)
+	if err != nil {
+		return err
+	}
+
+	result, err := tx.ExecContext(ctx, `UPDATE roles SET is_default = true WHERE name = $1`, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	err = insertAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The AddForUser() method assigns a role to a user. ErrRecordNotFound is returned if
+// there is no role with that name. Assigning a role the user already has is a no-op,
+// but it is still audited. The event is saved in the same transaction as the change.
+func (m RoleModel) AddForUser(userID int64, name string, event *AuditEvent) error {
+	query := `
+		WITH role AS (
+			SELECT id FROM roles WHERE name = $2
+		), inserted AS (
+			INSERT INTO users_roles
+			SELECT $1, role.id FROM role
+			ON CONFLICT DO NOTHING
+		)
+		SELECT EXISTS (SELECT 1 FROM role)
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+
+	err = tx.QueryRowContext(ctx, query, userID, name).Scan(&exists)
+	if err != nil {
+		return err
+	}
+
+	if !exists {
+		return ErrRecordNotFound
+	}
+
+	err = insertAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// The AddDefaultForUser() method assigns the default role to a new user. If no role
+// has been marked as the default, the user is left without any roles.
+func (m RoleModel) AddDefaultForUser(userID int64) error {
+	query := `
+		INSERT INTO users_roles
+		SELECT $1, roles.id FROM roles WHERE roles.is_default
+		ON CONFLICT DO NOTHING
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return err
+}
+
+// The RemoveForUser() method revokes a role from a user. ErrRecordNotFound is returned
+// if the user didn't have the role. The event is saved in the same transaction as the
+// change.
+func (m RoleModel) RemoveForUser(userID int64, name string, event *AuditEvent) error {
+	query := `
+		DELETE FROM users_roles
+		USING roles
+		WHERE users_roles.role_id = roles.id
+		AND users_roles.user_id = $1
+		AND roles.name = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, userID, name)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	err = insertAuditEvent(ctx, tx, event)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,170 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Define a ThrottlePolicy struct to hold the settings for how failed login attempts
+// are throttled. After each failure, the next attempt for the same key is blocked for
+// BaseDelay, doubling with every further failure up to MaxDelay. Once MaxFailures is
+// reached the key is locked out for the Lockout duration instead. Failures older than
+// Window are forgotten.
+type ThrottlePolicy struct {
+	MaxFailures int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Lockout     time.Duration
+	Window      time.Duration
+}
+
+// The delay() method returns how long to block further attempts after the given number
+// of consecutive failures.
+func (p ThrottlePolicy) delay(failures int) time.Duration {
+	if failures >= p.MaxFailures {
+		return p.Lockout
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < failures && delay < p.MaxDelay; i++ {
+		delay *= 2
+	}
+
+	return min(delay, p.MaxDelay)
+}
+
+// Define a LoginThrottle struct to hold the failed login state for a single key.
+type LoginThrottle struct {
+	Key           string
+	Failures      int
+	LastFailureAt time.Time
+	BlockedUntil  time.Time
+	Locked        bool
+}
+
+// The EmailThrottleKey() and IPThrottleKey() functions return the keys that failed
+// logins are tracked under. Emails are lower-cased to match the citext column in the
+// users table.
+func EmailThrottleKey(email string) string {
+	return "email:" + strings.ToLower(email)
+}
+
+func IPThrottleKey(ip string) string {
+	return "ip:" + ip
+}
+
+// Define the LoginThrottleModel type.
+type LoginThrottleModel struct {
+	DB *sql.DB
+}
+
+// The BlockedUntil() method returns the latest time that any of the keys are blocked
+// until. If none of them are blocked, the zero time is returned.
+func (m LoginThrottleModel) BlockedUntil(keys ...string) (time.Time, error) {
+	query := `
+		SELECT COALESCE(MAX(blocked_until), 'epoch')
+		FROM login_throttles
+		WHERE key = ANY($1) AND blocked_until > NOW()
+	`
+
+	var blockedUntil time.Time
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, pq.Array(keys)).Scan(&blockedUntil)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	if !blockedUntil.After(time.Now()) {
+		return time.Time{}, nil
+	}
+
+	return blockedUntil, nil
+}
+
+// The RecordFailure() method counts a failed login attempt against the key and blocks
+// further attempts according to the policy. The second return value is true if this
+// failure is the one which caused the key to be locked out, so that the caller can
+// send a notification exactly once.
+func (m LoginThrottleModel) RecordFailure(key string, policy ThrottlePolicy) (*LoginThrottle, bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, false, err
+	}
+	defer tx.Rollback()
+
+	// Increment the failure count, starting again from 1 if the previous failure
+	// happened outside of the window (or if a previous lockout has already expired).
+	query := `
+		INSERT INTO login_throttles (key, failures, last_failure_at)
+		VALUES ($1, 1, NOW())
+		ON CONFLICT (key) DO UPDATE
+		SET failures = CASE
+				WHEN login_throttles.last_failure_at < $2 THEN 1
+				WHEN login_throttles.locked AND login_throttles.blocked_until <= NOW() THEN 1
+				ELSE login_throttles.failures + 1
+			END,
+			locked = CASE
+				WHEN login_throttles.locked AND login_throttles.blocked_until <= NOW() THEN false
+				ELSE login_throttles.locked
+			END,
+			last_failure_at = NOW()
+		RETURNING failures, last_failure_at, locked
+	`
+
+	throttle := LoginThrottle{Key: key}
+
+	err = tx.QueryRowContext(ctx, query, key, time.Now().Add(-policy.Window)).Scan(
+		&throttle.Failures,
+		&throttle.LastFailureAt,
+		&throttle.Locked,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+
+	wasLocked := throttle.Locked
+
+	throttle.BlockedUntil = time.Now().Add(policy.delay(throttle.Failures))
+	throttle.Locked = throttle.Failures >= policy.MaxFailures
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE login_throttles
+		SET blocked_until = $2, locked = $3
+		WHERE key = $1
+	`, key, throttle.BlockedUntil, throttle.Locked)
+	if err != nil {
+		return nil, false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, false, err
+	}
+
+	return &throttle, throttle.Locked && !wasLocked, nil
+}
+
+// The Reset() method forgets all failed login attempts for a key. It's called after a
+// successful login, and by the admin unlock endpoint.
+func (m LoginThrottleModel) Reset(key string) error {
+	query := `
+		DELETE FROM login_throttles
+		WHERE key = $1
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, key)
+	return err
+}
@@ -6,6 +6,7 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"encoding/base32"
+	"errors"
 	"time"
 
 	"github.com/thecodephilic-guy/greenlight/internal/validator"
@@ -16,6 +17,8 @@ import (
 const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
+	ScopeTwoFactor      = "two-factor"
+	ScopeMagicLink      = "magic-link"
 )
 
 // Define a Token struct to hold the data for an individual token. This includes the
@@ -84,19 +87,19 @@ type TokenModel struct {
 
 // The New() method is a shortcut which creates a new Token struct and then inserts the
 // data in the tokens table.
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
 	//right at the moment it is generated insert in DB
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
 		INSERT INTO tokens (hash, user_id, expiry, scope)
 		VALUES ($1, $2, $3, $4)
@@ -108,23 +111,66 @@ func (m TokenModel) Insert(token *Token) error {
 		token.Scope,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "TokenModel.Insert", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
+	span.RecordError(err)
 
 	return err
 }
 
 // DeleteAllForUser() deletes all tokens for a specific user and scope.
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
 		DELETE FROM tokens
 		WHERE user_id = $1 AND scope = $2
 	`
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "TokenModel.DeleteAllForUser", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, userID, scope)
+	span.RecordError(err)
 	return err
 }
+
+// The Use() method deletes an unexpired token and returns the ID of the user it belonged
+// to. Because the lookup and the delete happen in a single statement, two requests
+// racing to use the same token can't both succeed. ErrRecordNotFound is returned if
+// there is no matching token.
+func (m TokenModel) Use(ctx context.Context, scope, tokenPlaintext string) (int64, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	query := `
+		DELETE FROM tokens
+		WHERE hash = $1 AND scope = $2 AND expiry > $3
+		RETURNING user_id
+	`
+
+	ctx, span := startSpan(ctx, "TokenModel.Use", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	var userID int64
+
+	err := m.DB.QueryRowContext(ctx, query, tokenHash[:], scope, time.Now()).Scan(&userID)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, ErrRecordNotFound
+		default:
+			span.RecordError(err)
+			return 0, err
+		}
+	}
+
+	return userID, nil
+}
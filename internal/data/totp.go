@@ -0,0 +1,298 @@
+package data
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/thecodephilic-guy/greenlight/internal/validator"
+)
+
+var (
+	ErrTOTPAlreadyEnabled = errors.New("totp already enabled")
+)
+
+// The number of single-use recovery codes that are issued when two-factor
+// authentication is enabled.
+const recoveryCodeCount = 10
+
+// Define a TOTP struct to hold a user's TOTP enrolment. The secret is needed in
+// plaintext to calculate codes, so unlike tokens it can't be stored as a hash.
+type TOTP struct {
+	UserID       int64
+	CreatedAt    time.Time
+	Secret       []byte
+	Enabled      bool
+	LastUsedStep int64
+}
+
+// Check that a TOTP code has been provided and is made up of exactly 6 digits.
+func ValidateTOTPCode(v *validator.Validator, code string) {
+	v.Check(code != "", "code", "must be provided")
+	v.Check(len(code) == 6, "code", "must be 6 digits long")
+}
+
+// generateRecoveryCodes returns a set of plaintext recovery codes in the format
+// XXXX-XXXX-XXXX-XXXX, along with their SHA-256 hashes.
+func generateRecoveryCodes() ([]string, [][]byte, error) {
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][]byte, recoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 10)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+		hashes[i] = hashRecoveryCode(codes[i])
+	}
+
+	return codes, hashes, nil
+}
+
+// hashRecoveryCode normalizes a recovery code before hashing it, so that users can
+// type it in lower case and with or without the dashes.
+func hashRecoveryCode(code string) []byte {
+	code = strings.ToUpper(code)
+	code = strings.NewReplacer("-", "", " ", "").Replace(code)
+
+	hash := sha256.Sum256([]byte(code))
+	return hash[:]
+}
+
+// Define the TOTPModel type.
+type TOTPModel struct {
+	DB *sql.DB
+}
+
+// The Get() method returns the TOTP enrolment for a user, whether or not it has been
+// confirmed yet.
+func (m TOTPModel) Get(userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, created_at, secret, enabled, last_used_step
+		FROM totp_secrets
+		WHERE user_id = $1
+	`
+
+	var totp TOTP
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&totp.UserID,
+		&totp.CreatedAt,
+		&totp.Secret,
+		&totp.Enabled,
+		&totp.LastUsedStep,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &totp, nil
+}
+
+// The IsEnabled() method reports whether a user has confirmed their TOTP enrolment.
+func (m TOTPModel) IsEnabled(userID int64) (bool, error) {
+	query := `
+		SELECT EXISTS (SELECT 1 FROM totp_secrets WHERE user_id = $1 AND enabled)
+	`
+
+	var enabled bool
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&enabled)
+	return enabled, err
+}
+
+// The Enroll() method stores a new, unconfirmed secret for the user. If the user has a
+// pending enrolment it is replaced, but an enabled one is left alone and
+// ErrTOTPAlreadyEnabled is returned instead.
+func (m TOTPModel) Enroll(userID int64, secret []byte) error {
+	query := `
+		INSERT INTO totp_secrets (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE
+		SET secret = EXCLUDED.secret, created_at = NOW(), last_used_step = 0
+		WHERE NOT totp_secrets.enabled
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTOTPAlreadyEnabled
+	}
+
+	return nil
+}
+
+// The Enable() method confirms a pending enrolment and replaces the user's recovery
+// codes, returning the new plaintext codes. The step that was used to confirm the
+// enrolment is recorded so that the same code can't be used again to log in.
+func (m TOTPModel) Enable(userID int64, step int64) ([]string, error) {
+	codes, hashes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `
+		UPDATE totp_secrets
+		SET enabled = true, last_used_step = $2
+		WHERE user_id = $1
+	`, userID, step)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, hash := range hashes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO totp_recovery_codes (hash, user_id) VALUES ($1, $2)`, hash, userID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// The UseStep() method records that the code for a time step has been used. It returns
+// false if that step (or a later one) has already been used, which stops a code that
+// has been observed by an attacker from being replayed within its validity window.
+func (m TOTPModel) UseStep(userID int64, step int64) (bool, error) {
+	query := `
+		UPDATE totp_secrets
+		SET last_used_step = $2
+		WHERE user_id = $1 AND enabled AND last_used_step < $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// The UseRecoveryCode() method deletes a matching recovery code, returning true if one
+// was found. Deleting the code is what makes it single-use.
+func (m TOTPModel) UseRecoveryCode(userID int64, code string) (bool, error) {
+	query := `
+		DELETE FROM totp_recovery_codes
+		WHERE user_id = $1 AND hash = $2
+	`
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, hashRecoveryCode(code))
+	if err != nil {
+		return false, err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
+
+// The Delete() method removes a user's TOTP enrolment and recovery codes, turning
+// two-factor authentication off. API keys and OAuth tokens are trusted to have passed
+// the two-factor check because their owner had it enabled when they were issued, so
+// the ones which carry any of the gated permissions are deleted too. Otherwise they
+// would carry on passing the check without a second factor.
+func (m TOTPModel) Delete(userID int64, gatedPermissions []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_secrets WHERE user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM api_keys WHERE user_id = $1 AND permissions && $2`, userID, pq.Array(gatedPermissions))
+	if err != nil {
+		return err
+	}
+
+	// OAuth authorization codes and access tokens are the tokens with a client.
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND client_id IS NOT NULL AND permissions && $2
+	`
+
+	_, err = tx.ExecContext(ctx, query, userID, pq.Array(gatedPermissions))
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,21 @@
+package data
+
+import (
+	"context"
+	"strings"
+
+	"github.com/thecodephilic-guy/greenlight/internal/tracing"
+)
+
+// The startSpan() helper starts a span for a model method, as a child of the span in
+// ctx (if there is one). The SQL statement is recorded with its whitespace collapsed so
+// that it reads well on a single line.
+func startSpan(ctx context.Context, name, query string) (context.Context, *tracing.Span) {
+	attributes := []tracing.Attribute{tracing.Attr("db.system", "postgresql")}
+
+	if query != "" {
+		attributes = append(attributes, tracing.Attr("db.statement", strings.Join(strings.Fields(query), " ")))
+	}
+
+	return tracing.StartKind(ctx, tracing.KindClient, name, attributes...)
+}
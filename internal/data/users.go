@@ -2,13 +2,16 @@ package data
 
 import (
 	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
+	"sync"
 	"time"
 
+	"github.com/thecodephilic-guy/greenlight/internal/tracing"
 	"github.com/thecodephilic-guy/greenlight/internal/validator"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
@@ -25,6 +28,7 @@ type User struct {
 	Email     string    `json:"email"`
 	Password  password  `json:"-"`
 	Activated bool      `json:"activated"`
+	Blocked   bool      `json:"blocked"`
 	Version   int       `json:"-"`
 }
 
@@ -42,11 +46,16 @@ type password struct {
 	hash      []byte
 }
 
-// The Set() method calculates the bcrypt hash of a plaintext password, and stores both
-// the hash and the plaintext versions in the struct.
-func (p *password) Set(plaintextPassword string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(plaintextPassword), 12)
+// The Set() method calculates the hash of a plaintext password using the configured
+// PasswordHasher, and stores both the hash and the plaintext versions in the struct.
+// Hashing is deliberately slow, so it gets a span of its own.
+func (p *password) Set(ctx context.Context, plaintextPassword string) error {
+	_, span := tracing.Start(ctx, "password.Set")
+	defer span.End()
+
+	hash, err := passwordHasher.Hash(plaintextPassword)
 	if err != nil {
+		span.RecordError(err)
 		return err
 	}
 
@@ -58,19 +67,49 @@ func (p *password) Set(plaintextPassword string) error {
 
 // The Matches() method checks whether the provided plaintext password matches the
 // hashed password stored in the struct, returning true if it matches and false
-// otherwise.
-func (p *password) Matches(plaintextPassword string) (bool, error) {
-	err := bcrypt.CompareHashAndPassword(p.hash, []byte(plaintextPassword))
+// otherwise. The hash is checked with whichever algorithm it was created with, which
+// isn't necessarily the one that is configured now.
+func (p *password) Matches(ctx context.Context, plaintextPassword string) (bool, error) {
+	_, span := tracing.Start(ctx, "password.Matches")
+	defer span.End()
+
+	hasher, err := hasherFor(p.hash)
 	if err != nil {
-		switch {
-		case errors.Is(err, bcrypt.ErrMismatchedHashAndPassword):
-			return false, nil
-		default:
-			return false, err
-		}
+		span.RecordError(err)
+		return false, err
 	}
 
-	return true, nil
+	match, err := hasher.Matches(p.hash, plaintextPassword)
+	span.RecordError(err)
+
+	return match, err
+}
+
+// The NeedsRehash() method reports whether the stored hash was created with a
+// different algorithm, or different parameters, to the configured PasswordHasher. If
+// it was, the password should be rehashed the next time we see the plaintext.
+func (p *password) NeedsRehash() bool {
+	return !passwordHasher.Recognizes(p.hash) || passwordHasher.NeedsRehash(p.hash)
+}
+
+// dummyPassword is a password which nobody knows, lazily hashed the first time it's
+// needed. Checking a plaintext password against it takes the same time as checking it
+// against a real user's password.
+var dummyPassword = sync.OnceValue(func() *password {
+	var p password
+	err := p.Set(context.Background(), rand.Text())
+	if err != nil {
+		panic(err)
+	}
+	return &p
+})
+
+// The SimulatePasswordCheck() function does the same amount of work as checking a real
+// password, and is used when there is no matching user. Without it, a login request
+// for an unknown email address would return noticeably faster than one for a real
+// account, which would let anyone find out which email addresses are registered.
+func SimulatePasswordCheck(ctx context.Context, plaintextPassword string) {
+	dummyPassword().Matches(ctx, plaintextPassword)
 }
 
 // both Email and Password validation would be used independently later
@@ -80,10 +119,30 @@ func ValidateEmail(v *validator.Validator, email string) {
 	v.Check(validator.Matches(email, validator.EmailRX), "email", "must be a valid email address")
 }
 
+// The ValidatePasswordPlaintext() function checks a password which is being checked
+// against a hash, like when logging in. The hasher's own limit doesn't apply here,
+// because the hash may have been made with a different hasher which allowed longer
+// passwords, and those users must still be able to log in. The 500 byte limit is
+// just there to stop clients sending enormous passwords to be hashed.
 func ValidatePasswordPlaintext(v *validator.Validator, password string) {
-	v.Check(password != "", "password", "must be provided")
-	v.Check(len(password) >= 8, "password", "must be at least 8 bytes long")
-	v.Check(len(password) <= 72, "password", "must not be more than 500 bytes long")
+	validatePasswordPlaintext(v, "password", password)
+}
+
+// The ValidateNewPasswordPlaintext() function checks a password which is about to be
+// hashed and saved. On top of the usual checks, it must be short enough for the
+// current hasher. Any errors are added under the given key, so that they line up with
+// the field the client sent the password in.
+func ValidateNewPasswordPlaintext(v *validator.Validator, key, password string) {
+	validatePasswordPlaintext(v, key, password)
+
+	maxLength := passwordHasher.MaxLength()
+	v.Check(len(password) <= maxLength, key, fmt.Sprintf("must not be more than %d bytes long", maxLength))
+}
+
+func validatePasswordPlaintext(v *validator.Validator, key, password string) {
+	v.Check(password != "", key, "must be provided")
+	v.Check(len(password) >= 8, key, "must be at least 8 bytes long")
+	v.Check(len(password) <= 500, key, "must not be more than 500 bytes long")
 }
 
 func ValidateUser(v *validator.Validator, user *User) {
@@ -93,7 +152,7 @@ func ValidateUser(v *validator.Validator, user *User) {
 	ValidateEmail(v, user.Email)
 
 	if user.Password.plaintext != nil {
-		ValidatePasswordPlaintext(v, *user.Password.plaintext)
+		ValidateNewPasswordPlaintext(v, "password", *user.Password.plaintext)
 	}
 
 	// If the password hash is ever nil, this will be due to a logic error in our
@@ -114,7 +173,7 @@ type UserModel struct {
 // version fields are all automatically generated by our database, so we use the
 // RETURNING clause to read them into the User struct after the insert, in the same way
 // that we did when creating a movie.
-func (m UserModel) Insert(user *User) error {
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
 		INSERT INTO users (name, email, password_hash, activated)
 		VALUES ($1, $2, $3, $4)
@@ -127,7 +186,10 @@ func (m UserModel) Insert(user *User) error {
 		user.Activated,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "UserModel.Insert", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	// If the table already contains a record with this email address, then when we try
@@ -140,6 +202,7 @@ func (m UserModel) Insert(user *User) error {
 		case err.Error() == `pq: duplicate key value violates unique constraint "User_email_key"`:
 			return ErrDuplicateEmail
 		default:
+			span.RecordError(err)
 			return err
 		}
 	}
@@ -150,15 +213,18 @@ func (m UserModel) Insert(user *User) error {
 // Retrieve the User details from the database based on the user's email address.
 // Because we have a UNIQUE constraint on the email column, this SQL query will only
 // return one record (or none at all, in which case we return a ErrRecordNotFound error).
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
-		SELECT *
+		SELECT id, created_at, name, email, password_hash, activated, blocked, version
 		FROM users
 		WHERE email = $1
 	`
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "UserModel.GetByEmail", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -168,6 +234,7 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Blocked,
 		&user.Version,
 	)
 
@@ -176,6 +243,50 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
+			span.RecordError(err)
+			return nil, err
+		}
+	}
+
+	return &user, nil
+}
+
+// Retrieve the User details from the database based on the user's ID.
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, created_at, name, email, password_hash, activated, blocked, version
+		FROM users
+		WHERE id = $1
+	`
+	var user User
+
+	ctx, span := startSpan(ctx, "UserModel.Get", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.CreatedAt,
+		&user.Name,
+		&user.Email,
+		&user.Password.hash,
+		&user.Activated,
+		&user.Blocked,
+		&user.Version,
+	)
+
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			span.RecordError(err)
 			return nil, err
 		}
 	}
@@ -188,27 +299,93 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 // when updating a movie. And we also check for a violation of the "User_email_key"
 // constraint when performing the update, just like we did when inserting the user
 // record originally.
-func (m UserModel) Update(user *User) error {
-	query := `
-		UPDATE users
-		SET name = $1, email = $2, password_hash = $3, activated = $4, version = version + 1
-		WHERE id = $5 AND version = $6
-		RETURNING version
-	`
+func (m UserModel) Update(ctx context.Context, user *User) error {
+	ctx, span := startSpan(ctx, "UserModel.Update", updateUserQuery)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	err := updateUser(ctx, m.DB, user)
+	if err != nil && !errors.Is(err, ErrDuplicateEmail) && !errors.Is(err, ErrEditConflict) {
+		span.RecordError(err)
+	}
+
+	return err
+}
+
+// The AdminUpdate() method saves the changes that an administrator made to a user, and
+// records them in the audit trail. If revoke is true, all of the user's tokens and API
+// keys are deleted as well, so that they are signed out straight away. Everything
+// happens in a single transaction, so a user is never blocked without their
+// credentials being revoked, and no change is ever made without being audited.
+func (m UserModel) AdminUpdate(ctx context.Context, user *User, revoke bool, event *AuditEvent) error {
+	ctx, span := startSpan(ctx, "UserModel.AdminUpdate", updateUserQuery)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	defer tx.Rollback()
 
+	err = updateUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	if revoke {
+		// Every kind of token goes, whatever its scope, so that nothing issued before
+		// the user was blocked comes back to life if they are unblocked later.
+		_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1`, user.ID)
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
+
+		_, err = tx.ExecContext(ctx, `DELETE FROM api_keys WHERE user_id = $1`, user.ID)
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
+	}
+
+	if event != nil {
+		err = insertAuditEvent(ctx, tx, event)
+		if err != nil {
+			span.RecordError(err)
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+const updateUserQuery = `
+	UPDATE users
+	SET name = $1, email = $2, password_hash = $3, activated = $4, blocked = $5, version = version + 1
+	WHERE id = $6 AND version = $7
+	RETURNING version
+`
+
+// The updateUser() helper runs the query for Update() and AdminUpdate(), either on its
+// own or as part of a transaction.
+func updateUser(ctx context.Context, q queryRower, user *User) error {
 	args := []any{
 		user.Name,
 		user.Email,
 		user.Password.hash,
 		user.Activated,
+		user.Blocked,
 		user.ID,
 		user.Version,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
-
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	err := q.QueryRowContext(ctx, updateUserQuery, args...).Scan(&user.Version)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "User_email_key"`:
@@ -225,19 +402,20 @@ func (m UserModel) Update(user *User) error {
 
 // Get the user details associated with a particular token and it's scope
 // First function to perform joins
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	// Calculate the SHA-256 hash of the plaintext token provided by the client.
 	// Remember that this returns a byte *array* with length 32, not a slice.
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
 	query := `
-		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.version
+		SELECT users.id, users.created_at, users.name, users.email, users.password_hash, users.activated, users.blocked, users.version
         FROM users
         INNER JOIN tokens
         ON users.id = tokens.user_id
         WHERE tokens.hash = $1
         AND tokens.scope = $2 
         AND tokens.expiry > $3
+        AND NOT users.blocked
 	`
 
 	// Create a slice containing the query arguments. Notice how we use the [:] operator
@@ -248,7 +426,10 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, span := startSpan(ctx, "UserModel.GetForToken", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -258,6 +439,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.Email,
 		&user.Password.hash,
 		&user.Activated,
+		&user.Blocked,
 		&user.Version,
 	)
 
@@ -266,9 +448,124 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
+			span.RecordError(err)
 			return nil, err
 		}
 	}
 
 	return &user, nil
 }
+
+// The GetAll() method returns a page of users. The search string is matched against
+// both the name and the email address, ignoring case, and the activated and blocked
+// filters are skipped when they are nil.
+func (m UserModel) GetAll(ctx context.Context, search string, activated, blocked *bool, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, created_at, name, email, password_hash, activated, blocked, version
+		FROM users
+		WHERE (strpos(lower(name), lower($1)) > 0 OR strpos(lower(email::text), lower($1)) > 0 OR $1 = '')
+		AND (activated = $2 OR $2 IS NULL)
+		AND (blocked = $3 OR $3 IS NULL)
+		ORDER BY %s %s, id ASC
+		LIMIT $4 OFFSET $5
+	`, filters.sortColumn(), filters.sortDirection())
+
+	ctx, span := startSpan(ctx, "UserModel.GetAll", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	args := []any{search, activated, blocked, filters.limit(), filters.offset()}
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		span.RecordError(err)
+		return nil, Metadata{}, err
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.CreatedAt,
+			&user.Name,
+			&user.Email,
+			&user.Password.hash,
+			&user.Activated,
+			&user.Blocked,
+			&user.Version,
+		)
+		if err != nil {
+			span.RecordError(err)
+			return nil, Metadata{}, err
+		}
+
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		span.RecordError(err)
+		return nil, Metadata{}, err
+	}
+
+	metadata := calculateMetaData(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+// The AdminDelete() method deletes a user on behalf of an administrator, and records
+// it in the audit trail, in a single transaction. Their tokens, API keys, permissions
+// and roles are all removed along with them by the ON DELETE CASCADE foreign keys.
+func (m UserModel) AdminDelete(ctx context.Context, id int64, event *AuditEvent) error {
+	if id < 1 {
+		return ErrRecordNotFound
+	}
+
+	query := `
+		DELETE FROM users
+		WHERE id = $1
+	`
+
+	ctx, span := startSpan(ctx, "UserModel.AdminDelete", query)
+	defer span.End()
+
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.ExecContext(ctx, query, id)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	err = insertAuditEvent(ctx, tx, event)
+	if err != nil {
+		span.RecordError(err)
+		return err
+	}
+
+	return tx.Commit()
+}
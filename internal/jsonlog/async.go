@@ -0,0 +1,94 @@
+package jsonlog
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Define an AsyncSink type which writes entries to another sink from a background
+// goroutine, so that logging never waits for a slow disk or syslog daemon. Entries are
+// queued in a bounded buffer, and if it fills up new entries are dropped (and counted)
+// rather than blocking the caller. FATAL entries are the exception: they're always
+// queued, since they're the last thing written before the program exits.
+type AsyncSink struct {
+	sink    Sink
+	queue   chan *Entry
+	done    chan struct{}
+	dropped atomic.Uint64
+
+	// The mutex guards against writing to the queue after it has been closed.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Return a new AsyncSink which buffers up to size entries for sink.
+func NewAsyncSink(sink Sink, size int) *AsyncSink {
+	s := &AsyncSink{
+		sink:  sink,
+		queue: make(chan *Entry, size),
+		done:  make(chan struct{}),
+	}
+
+	go s.run()
+
+	return s
+}
+
+func (s *AsyncSink) run() {
+	defer close(s.done)
+
+	// There's nowhere to report errors from the underlying sink, short of logging them,
+	// so they're ignored.
+	for entry := range s.queue {
+		s.sink.Write(entry)
+	}
+}
+
+// The Write() method queues the entry, or drops it if the buffer is full. It only
+// returns an error if the sink has been closed.
+func (s *AsyncSink) Write(entry *Entry) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		s.dropped.Add(1)
+		return errSinkClosed
+	}
+
+	if entry.Level >= LevelFatal {
+		s.queue <- entry
+		return nil
+	}
+
+	select {
+	case s.queue <- entry:
+	default:
+		s.dropped.Add(1)
+	}
+
+	return nil
+}
+
+// The Close() method waits for the queued entries to be written, and then closes the
+// underlying sink. It's safe to call more than once.
+func (s *AsyncSink) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		<-s.done
+		return nil
+	}
+	s.closed = true
+	close(s.queue)
+	s.mu.Unlock()
+
+	<-s.done
+
+	return s.sink.Close()
+}
+
+// The Dropped() method returns the number of entries that have been dropped because
+// the buffer was full (or the sink was closed).
+func (s *AsyncSink) Dropped() uint64 {
+	return s.dropped.Load()
+}
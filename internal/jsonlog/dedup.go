@@ -0,0 +1,383 @@
+package jsonlog
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StackMode decides which ERROR entries include a stack trace.
+type StackMode int
+
+const (
+	// StackAlways includes a stack trace in every ERROR entry.
+	StackAlways StackMode = iota
+	// StackFirst only includes a stack trace in the first entry for each error in each
+	// rate-limiting window (or the first entry ever, if there's no window), since the
+	// rest would be the same.
+	StackFirst
+	// StackOff never includes a stack trace in ERROR entries. FATAL entries always have
+	// one.
+	StackOff
+)
+
+// Return the name of the stack mode.
+func (m StackMode) String() string {
+	switch m {
+	case StackAlways:
+		return "always"
+	case StackFirst:
+		return "first"
+	case StackOff:
+		return "off"
+	default:
+		return ""
+	}
+}
+
+// ParseStackMode returns the stack mode with the given name ("always", "first" or
+// "off").
+func ParseStackMode(s string) (StackMode, error) {
+	switch s {
+	case "always":
+		return StackAlways, nil
+	case "first":
+		return StackFirst, nil
+	case "off":
+		return StackOff, nil
+	}
+
+	return 0, fmt.Errorf("jsonlog: unknown stack mode %q", s)
+}
+
+// Define an ErrorPolicy struct to control how ERROR entries are written. Errors are
+// grouped by fingerprint, which is made from the message (with numbers, quoted strings
+// and IDs taken out, so that "user 1 not found" and "user 2 not found" match) and the
+// place in the code where the error was logged.
+type ErrorPolicy struct {
+	// Stack decides which entries include a stack trace.
+	Stack StackMode
+	// At most Burst entries are written for each fingerprint in each Window. The rest
+	// are counted, and a single "N similar errors suppressed" entry is written once the
+	// window is over. A Burst of zero turns rate limiting off.
+	Window time.Duration
+	Burst  int
+	// MaxFingerprints limits how many fingerprints are remembered. When it's reached,
+	// the one that was seen least recently is forgotten. Defaults to 1000.
+	MaxFingerprints int
+	// Helpers lists functions (by their full name, like "main.(*application).logError")
+	// which log errors on behalf of their callers. They're skipped when working out
+	// where an error was logged, so that errors which all pass through the same helper
+	// aren't lumped together.
+	Helpers []string
+}
+
+// Define an ErrorStats struct to hold what we know about one fingerprint.
+type ErrorStats struct {
+	Fingerprint string    `json:"fingerprint"`
+	Template    string    `json:"template"`
+	Function    string    `json:"function"`
+	Caller      string    `json:"caller"`
+	Count       uint64    `json:"count"`
+	Suppressed  uint64    `json:"suppressed"`
+	FirstSeen   time.Time `json:"first_seen"`
+	LastSeen    time.Time `json:"last_seen"`
+	LastMessage string    `json:"last_message"`
+}
+
+// The default limit on the number of fingerprints that are remembered.
+const defaultMaxFingerprints = 1000
+
+// Define an errorTracker type to hold the fingerprints seen by a logger, and every
+// logger derived from it.
+type errorTracker struct {
+	policy atomic.Pointer[ErrorPolicy]
+
+	mu        sync.Mutex
+	errors    map[string]*trackedError
+	lastSweep time.Time
+}
+
+type trackedError struct {
+	ErrorStats
+
+	// The start of the current rate-limiting window, and the number of entries written
+	// and suppressed in it.
+	windowStart      time.Time
+	windowCount      int
+	windowSuppressed uint64
+}
+
+func newErrorTracker() *errorTracker {
+	t := &errorTracker{errors: make(map[string]*trackedError)}
+	t.policy.Store(&ErrorPolicy{})
+	return t
+}
+
+// The patterns which are replaced by a "?" to make a message template. The order
+// matters: quoted strings go first, so that the numbers inside them aren't replaced on
+// their own.
+var templatePatterns = []*regexp.Regexp{
+	regexp.MustCompile(`"[^"]*"`),
+	regexp.MustCompile(`'[^']*'`),
+	regexp.MustCompile(`[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}`),
+	regexp.MustCompile(`\b0x[0-9a-fA-F]+\b`),
+	regexp.MustCompile(`\b[0-9a-fA-F]{8,}\b`),
+	regexp.MustCompile(`[0-9]+(\.[0-9]+)*`),
+}
+
+// The messageTemplate() helper returns the message with the parts that vary from one
+// occurrence of an error to the next replaced by "?".
+func messageTemplate(message string) string {
+	for _, re := range templatePatterns {
+		message = re.ReplaceAllStringFunc(message, func(s string) string {
+			switch s[0] {
+			case '"':
+				return `"?"`
+			case '\'':
+				return `'?'`
+			}
+			return "?"
+		})
+	}
+
+	return message
+}
+
+// The name of this package, as it appears in function names, so that its own frames
+// can be skipped when looking for the caller.
+var packagePrefix = func() string {
+	pc, _, _, _ := runtime.Caller(0)
+	name := runtime.FuncForPC(pc).Name()
+	slash := strings.LastIndex(name, "/")
+	return name[:slash+strings.Index(name[slash:], ".")+1]
+}()
+
+// The caller() method returns the function, file and line which logged an error,
+// skipping frames in this package, in the standard library's loggers, and in helpers.
+func (t *errorTracker) caller(helpers []string) (function, file string, line int) {
+	pcs := make([]uintptr, 32)
+	n := runtime.Callers(3, pcs)
+	frames := runtime.CallersFrames(pcs[:n])
+
+	for {
+		frame, more := frames.Next()
+
+		skip := strings.HasPrefix(frame.Function, packagePrefix) ||
+			strings.HasPrefix(frame.Function, "log.") ||
+			strings.HasPrefix(frame.Function, "log/slog.") ||
+			slices.Contains(helpers, frame.Function)
+
+		if !skip || !more {
+			return frame.Function, frame.File, frame.Line
+		}
+	}
+}
+
+// The observe() method records an occurrence of an error. It returns the error's
+// fingerprint, whether the entry should be written and whether it should include a
+// stack trace, along with any summaries of suppressed errors which are due to be
+// written first.
+func (t *errorTracker) observe(message string, now time.Time) (fingerprint string, write, stack bool, summaries []*Entry) {
+	policy := t.policy.Load()
+
+	function, file, line := t.caller(policy.Helpers)
+	template := messageTemplate(message)
+
+	h := fnv.New64a()
+	fmt.Fprintf(h, "%s\x00%s\x00%d", template, function, line)
+	fingerprint = fmt.Sprintf("%016x", h.Sum64())
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// Every so often, look for other fingerprints whose windows have ended with errors
+	// suppressed, so that their summaries are written even if the error has stopped.
+	if policy.Window > 0 && now.Sub(t.lastSweep) >= policy.Window {
+		t.lastSweep = now
+		summaries = t.sweep(policy, now, false)
+	}
+
+	e, ok := t.errors[fingerprint]
+	if !ok {
+		summaries = append(summaries, t.evict(policy)...)
+
+		e = &trackedError{
+			ErrorStats: ErrorStats{
+				Fingerprint: fingerprint,
+				Template:    template,
+				Function:    function,
+				Caller:      fmt.Sprintf("%s:%d", filepath.Base(file), line),
+				FirstSeen:   now,
+			},
+			windowStart: now,
+		}
+		t.errors[fingerprint] = e
+	}
+
+	if policy.Window > 0 && now.Sub(e.windowStart) >= policy.Window {
+		if summary := e.summary(policy); summary != nil {
+			summaries = append(summaries, summary)
+		}
+		e.windowStart = now
+		e.windowCount = 0
+	}
+
+	e.Count++
+	e.LastSeen = now
+	e.LastMessage = message
+	e.windowCount++
+
+	if policy.Burst > 0 && e.windowCount > policy.Burst {
+		e.Suppressed++
+		e.windowSuppressed++
+		return fingerprint, false, false, summaries
+	}
+
+	switch policy.Stack {
+	case StackAlways:
+		stack = true
+	case StackFirst:
+		stack = e.windowCount == 1
+	}
+
+	return fingerprint, true, stack, summaries
+}
+
+// The summary() method returns an entry saying how many errors were suppressed in the
+// current window, and resets the count. It returns nil if none were.
+func (e *trackedError) summary(policy *ErrorPolicy) *Entry {
+	if e.windowSuppressed == 0 {
+		return nil
+	}
+
+	entry := &Entry{
+		Level:   LevelError,
+		Time:    time.Now(),
+		Message: fmt.Sprintf("%d similar errors suppressed", e.windowSuppressed),
+		Properties: map[string]any{
+			"fingerprint": e.Fingerprint,
+			"template":    e.Template,
+			"caller":      e.Caller,
+			"suppressed":  e.windowSuppressed,
+			"window":      policy.Window.String(),
+		},
+	}
+	e.windowSuppressed = 0
+
+	return entry
+}
+
+// The sweep() method returns the summaries for fingerprints whose windows have ended
+// (or all of them, if all is set). It must be called with the mutex held.
+func (t *errorTracker) sweep(policy *ErrorPolicy, now time.Time, all bool) []*Entry {
+	var summaries []*Entry
+
+	for _, e := range t.errors {
+		if !all && now.Sub(e.windowStart) < policy.Window {
+			continue
+		}
+		if summary := e.summary(policy); summary != nil {
+			summaries = append(summaries, summary)
+		}
+	}
+
+	return summaries
+}
+
+// The evict() method makes room for a new fingerprint, if the limit has been reached,
+// by forgetting the one that was seen least recently. Errors which were suppressed in
+// its current window would never be reported otherwise, so their summaries are
+// returned to be written. It must be called with the mutex held.
+func (t *errorTracker) evict(policy *ErrorPolicy) []*Entry {
+	var summaries []*Entry
+
+	limit := policy.MaxFingerprints
+	if limit <= 0 {
+		limit = defaultMaxFingerprints
+	}
+
+	for len(t.errors) >= limit {
+		var oldest *trackedError
+		for _, e := range t.errors {
+			if oldest == nil || e.LastSeen.Before(oldest.LastSeen) {
+				oldest = e
+			}
+		}
+		if summary := oldest.summary(policy); summary != nil {
+			summaries = append(summaries, summary)
+		}
+		delete(t.errors, oldest.Fingerprint)
+	}
+
+	return summaries
+}
+
+// The SetErrorPolicy() method changes how ERROR entries are written, for this logger
+// and every logger that shares its output.
+func (l *Logger) SetErrorPolicy(policy ErrorPolicy) error {
+	if policy.Burst < 0 || policy.Window < 0 {
+		return errors.New("jsonlog: error burst and window must not be negative")
+	}
+	if policy.Burst > 0 && policy.Window == 0 {
+		return errors.New("jsonlog: error rate limiting needs a window")
+	}
+
+	policy.Helpers = slices.Clone(policy.Helpers)
+	l.errors.policy.Store(&policy)
+
+	return nil
+}
+
+// The TopErrors() method returns the n fingerprints which have been seen the most
+// since since, most first.
+func (l *Logger) TopErrors(n int, since time.Time) []ErrorStats {
+	t := l.errors
+
+	t.mu.Lock()
+	stats := make([]ErrorStats, 0, len(t.errors))
+	for _, e := range t.errors {
+		if !e.LastSeen.Before(since) {
+			stats = append(stats, e.ErrorStats)
+		}
+	}
+	t.mu.Unlock()
+
+	slices.SortFunc(stats, func(a, b ErrorStats) int {
+		if a.Count != b.Count {
+			if a.Count > b.Count {
+				return -1
+			}
+			return 1
+		}
+		return b.LastSeen.Compare(a.LastSeen)
+	})
+
+	if len(stats) > n {
+		stats = stats[:n]
+	}
+
+	return stats
+}
+
+// The flushSuppressed() method writes the summaries of any errors which have been
+// suppressed, without waiting for their windows to end.
+func (l *Logger) flushSuppressed() {
+	t := l.errors
+
+	t.mu.Lock()
+	summaries := t.sweep(t.policy.Load(), time.Now(), true)
+	t.mu.Unlock()
+
+	for _, summary := range summaries {
+		l.sink.Write(summary)
+	}
+}
@@ -1,11 +1,14 @@
 package jsonlog
 
 import (
-	"encoding/json"
+	"fmt"
 	"io"
+	"maps"
 	"os"
 	"runtime/debug"
-	"sync"
+	"slices"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -13,112 +16,298 @@ import (
 type Level int8
 
 // Initialize constants which represent a specific severity level. We use the iota
-// keyword as a shortcut to assign successive integer values to the constants.
+// keyword as a shortcut to assign successive integer values to the constants. Debug
+// comes before Info, so we start counting from -1 to keep Info at the zero value.
 const (
-	LevelInfo  Level = iota // Has the value 0.
-	LevelError              // Has the value 1.
-	LevelFatal              // Has the value 2.
-	LevelOff                // Has the value 3.
+	LevelDebug Level = iota - 1 // Has the value -1.
+	LevelInfo                   // Has the value 0.
+	LevelWarn                   // Has the value 1.
+	LevelError                  // Has the value 2.
+	LevelFatal                  // Has the value 3.
+	LevelOff                    // Has the value 4.
 )
 
 // Return a human-friendly string for the severity level.
 func (l Level) String() string {
 	switch l {
+	case LevelDebug:
+		return "DEBUG"
 	case LevelInfo:
 		return "INFO"
+	case LevelWarn:
+		return "WARN"
 	case LevelError:
 		return "ERROR"
 	case LevelFatal:
 		return "FATAL"
+	case LevelOff:
+		return "OFF"
 	default:
 		return ""
 	}
 }
 
-// Define a custom Logger type. This holds the output destination that the log entries
-// will be written to, the minimum severity level that log entries will be written for,
-// plus a mutex for coordinating the writes.
+// ParseLevel returns the level with the given name, ignoring case.
+func ParseLevel(s string) (Level, error) {
+	for l := LevelDebug; l <= LevelOff; l++ {
+		if strings.EqualFold(s, l.String()) {
+			return l, nil
+		}
+	}
+
+	return 0, fmt.Errorf("jsonlog: unknown level %q", s)
+}
+
+// An Attr is a typed property attached to a log entry. Use the constructors below to
+// create them.
+type Attr struct {
+	Key   string
+	Value any
+}
+
+// String returns an Attr for a string value.
+func String(key, value string) Attr { return Attr{key, value} }
+
+// Int returns an Attr for an int value.
+func Int(key string, value int) Attr { return Attr{key, value} }
+
+// Int64 returns an Attr for an int64 value.
+func Int64(key string, value int64) Attr { return Attr{key, value} }
+
+// Float64 returns an Attr for a float64 value.
+func Float64(key string, value float64) Attr { return Attr{key, value} }
+
+// Bool returns an Attr for a bool value.
+func Bool(key string, value bool) Attr { return Attr{key, value} }
+
+// Duration returns an Attr for a time.Duration, which is written in a human-friendly
+// form like "1.5s".
+func Duration(key string, value time.Duration) Attr { return Attr{key, value.String()} }
+
+// Time returns an Attr for a time.Time, which is written in RFC 3339 format in UTC.
+func Time(key string, value time.Time) Attr {
+	return Attr{key, value.UTC().Format(time.RFC3339Nano)}
+}
+
+// Any returns an Attr for any value which can be encoded as JSON.
+func Any(key string, value any) Attr { return Attr{key, value} }
+
+// Group returns an Attr which is written as a nested object holding the given attrs.
+func Group(key string, attrs ...Attr) Attr { return Attr{key, group(attrs)} }
+
+type group []Attr
+
+// The attrsToMap() helper converts attrs into a map for encoding. Groups become nested
+// maps, and groups with the same key are merged. Later attrs win over earlier ones.
+func attrsToMap(dst map[string]any, attrs []Attr) map[string]any {
+	for _, attr := range attrs {
+		g, ok := attr.Value.(group)
+		if !ok {
+			dst[attr.Key] = attr.Value
+			continue
+		}
+
+		nested, ok := dst[attr.Key].(map[string]any)
+		if !ok {
+			nested = make(map[string]any, len(g))
+		}
+		dst[attr.Key] = attrsToMap(nested, g)
+	}
+
+	return dst
+}
+
+// The propertiesToAttrs() helper converts the string properties used by the Print*()
+// methods into attrs, sorted by key so that the output is stable.
+func propertiesToAttrs(properties map[string]string) []Attr {
+	attrs := make([]Attr, 0, len(properties))
+	for _, key := range slices.Sorted(maps.Keys(properties)) {
+		attrs = append(attrs, String(key, properties[key]))
+	}
+	return attrs
+}
+
+// Define a custom Logger type. This holds the sink that the log entries will be
+// written to and the minimum severity level that log entries will be written for. The
+// attrs are added to every entry (see the With() method). The minimum level is a
+// pointer so that it's shared by every logger derived from the same one, so changing
+// the level with SetLevel() affects them all. The same goes for the errors tracker,
+// which fingerprints ERROR entries (see dedup.go).
 type Logger struct {
-	out      io.Writer
-	minLevel Level
-	mu       sync.Mutex
+	sink     Sink
+	minLevel *atomic.Int32
+	errors   *errorTracker
+	attrs    []Attr
 }
 
 // Return a new Logger instance which writes log entries at or above a minimum severity
-// level to a specific output destination.
+// level to a specific output destination, as JSON.
 func New(out io.Writer, minLevel Level) *Logger {
+	return NewWithSink(NewWriterSink(out, FormatJSON, LevelDebug), minLevel)
+}
+
+// Return a new Logger instance which writes log entries at or above a minimum severity
+// level to a sink. Sinks can have minimum levels of their own, which are applied on
+// top of the logger's.
+func NewWithSink(sink Sink, minLevel Level) *Logger {
+	l := &Logger{
+		sink:     sink,
+		minLevel: new(atomic.Int32),
+		errors:   newErrorTracker(),
+	}
+	l.minLevel.Store(int32(minLevel))
+
+	return l
+}
+
+// The Level() method returns the current minimum severity level.
+func (l *Logger) Level() Level {
+	return Level(l.minLevel.Load())
+}
+
+// The SetLevel() method changes the minimum severity level, for this logger and every
+// logger that shares its output.
+func (l *Logger) SetLevel(level Level) {
+	l.minLevel.Store(int32(level))
+}
+
+// The With() method returns a new Logger which writes to the same destination, and
+// adds the given attrs to every entry, along with any that this logger already adds.
+// Attrs passed when writing an entry take precedence over them.
+func (l *Logger) With(attrs ...Attr) *Logger {
 	return &Logger{
-		out:      out,
-		minLevel: minLevel,
+		sink:     l.sink,
+		minLevel: l.minLevel,
+		errors:   l.errors,
+		attrs:    slices.Concat(l.attrs, attrs),
 	}
 }
 
 // Declare some helper methods for writing log entries at the different levels. Notice
 // that these all accept a map as the second parameter which can contain any arbitrary
 // 'properties' that you want to appear in the log entry.
+func (l *Logger) PrintDebug(message string, properties map[string]string) {
+	l.print(LevelDebug, message, propertiesToAttrs(properties))
+}
+
 func (l *Logger) PrintInfo(message string, properties map[string]string) {
-	l.print(LevelInfo, message, properties)
+	l.print(LevelInfo, message, propertiesToAttrs(properties))
+}
+
+func (l *Logger) PrintWarn(message string, properties map[string]string) {
+	l.print(LevelWarn, message, propertiesToAttrs(properties))
 }
 
 func (l *Logger) PrintError(err error, properties map[string]string) {
-	l.print(LevelError, err.Error(), properties)
+	l.print(LevelError, err.Error(), propertiesToAttrs(properties))
 }
 
 func (l *Logger) PrintFatal(err error, properties map[string]string) {
-	l.print(LevelFatal, err.Error(), properties)
+	l.print(LevelFatal, err.Error(), propertiesToAttrs(properties))
+	l.Close()  // Write out anything that's still buffered before exiting.
 	os.Exit(1) // For entries at the FATAL level, we also terminate the application.
 }
 
+// The following methods are like the Print*() ones, but take typed attrs instead of a
+// map of strings, so that numbers, durations and nested objects keep their shape in
+// the output.
+func (l *Logger) Debug(message string, attrs ...Attr) {
+	l.print(LevelDebug, message, attrs)
+}
+
+func (l *Logger) Info(message string, attrs ...Attr) {
+	l.print(LevelInfo, message, attrs)
+}
+
+func (l *Logger) Warn(message string, attrs ...Attr) {
+	l.print(LevelWarn, message, attrs)
+}
+
+func (l *Logger) Error(err error, attrs ...Attr) {
+	l.print(LevelError, err.Error(), attrs)
+}
+
+// The Enabled() method reports whether entries at the given level are being written,
+// which can be used to skip expensive work for entries that would be thrown away.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.Level() && level < LevelOff
+}
+
 // Print is an internal method for writing the log entry.
-func (l *Logger) print(level Level, message string, properties map[string]string) (int, error) {
+func (l *Logger) print(level Level, message string, attrs []Attr) error {
 	// If the severity level of the log entry is below the minimum severity for the
 	// logger, then return with no further action.
-	if level < l.minLevel {
-		return 0, nil
+	if !l.Enabled(level) {
+		return nil
 	}
 
-	// Declare an anonymous struct holding the data for the log entry.
-	aux := struct {
-		Level      string            `json:"level"`
-		Time       string            `json:"time"`
-		Message    string            `json:"message"`
-		Properties map[string]string `json:"properties,omitempty"`
-		Trace      string            `json:"trace,omitempty"`
-	}{
-		Level:      level.String(),
-		Time:       time.Now().UTC().Format(time.RFC3339),
-		Message:    message,
-		Properties: properties,
+	entry := &Entry{
+		Level:   level,
+		Time:    time.Now(),
+		Message: message,
 	}
 
-	// Include a stack trace for entries at the ERROR and FATAL levels.
-	if level >= LevelError {
-		aux.Trace = string(debug.Stack())
+	// Combine the logger's own attrs with the entry's.
+	if len(l.attrs)+len(attrs) > 0 {
+		entry.Properties = attrsToMap(make(map[string]any, len(l.attrs)+len(attrs)), slices.Concat(l.attrs, attrs))
 	}
 
-	// Declare a line variable for holding the actual log entry text.
-	var line []byte
+	switch {
+	case level == LevelError:
+		// ERROR entries are fingerprinted, so that repeats of the same error can be
+		// rate limited, and so that their stack traces can be left out once we've seen
+		// one. Summaries of errors that were suppressed earlier are written first.
+		fingerprint, write, stack, summaries := l.errors.observe(message, entry.Time)
 
-	// Marshal the anonymous struct to JSON and store it in the line variable. If there
-	// was a problem creating the JSON, set the contents of the log entry to be that
-	// plain-text error message instead.
-	line, err := json.Marshal(aux)
-	if err != nil {
-		line = []byte(LevelError.String() + ": unable to marshal log message:" + err.Error())
+		for _, summary := range summaries {
+			l.sink.Write(summary)
+		}
+
+		if !write {
+			return nil
+		}
+
+		if entry.Properties == nil {
+			entry.Properties = make(map[string]any, 1)
+		}
+		entry.Properties["fingerprint"] = fingerprint
+
+		if stack {
+			entry.Trace = string(debug.Stack())
+		}
+	case level >= LevelFatal:
+		// FATAL entries always include a stack trace.
+		entry.Trace = string(debug.Stack())
 	}
-	// Lock the mutex so that no two writes to the output destination cannot happen
-	// concurrently. If we don't do this, it's possible that the text for two or more
-	// log entries will be intermingled in the output.
-	l.mu.Lock()
-	defer l.mu.Unlock()
 
-	// Write the log entry followed by a newline.
-	return l.out.Write(append(line, '\n'))
+	// Hand the entry to the sink, which formats it and writes it out.
+	return l.sink.Write(entry)
 }
 
 // We also implement a Write() method on our Logger type so that it satisfies the
 // io.Writer interface. This writes a log entry at the ERROR level with no additional
 // properties.
 func (l *Logger) Write(message []byte) (n int, err error) {
-	return l.print(LevelError, string(message), nil)
+	err = l.print(LevelError, string(message), nil)
+	if err != nil {
+		return 0, err
+	}
+	return len(message), nil
+}
+
+// The Close() method writes the summaries of any suppressed errors, and closes the
+// logger's sink, which writes out any buffered entries. Nothing can be logged through
+// the logger, or any logger derived from it, afterwards.
+func (l *Logger) Close() error {
+	l.flushSuppressed()
+	return l.sink.Close()
+}
+
+// The Dropped() method returns the number of entries which were thrown away because an
+// asynchronous sink's buffer was full. It's always zero for synchronous sinks.
+func (l *Logger) Dropped() uint64 {
+	if d, ok := l.sink.(interface{ Dropped() uint64 }); ok {
+		return d.Dropped()
+	}
+	return 0
 }
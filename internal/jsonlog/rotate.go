@@ -0,0 +1,295 @@
+package jsonlog
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define a RotateConfig struct to hold the settings for a RotatingFile.
+type RotateConfig struct {
+	// Path is the file that entries are written to. Rotated files are kept next to it,
+	// with the time of the rotation added to their names.
+	Path string
+	// The file is rotated when writing to it would take it over MaxSize bytes, and at
+	// every multiple of Interval (so an Interval of 24 hours rotates at midnight UTC).
+	// Zero disables either kind of rotation.
+	MaxSize  int64
+	Interval time.Duration
+	// Rotated files beyond the newest MaxBackups, or older than MaxAge, are deleted.
+	// Zero keeps them all.
+	MaxBackups int
+	MaxAge     time.Duration
+	// If Compress is set, rotated files are compressed with gzip.
+	Compress bool
+}
+
+// Define a RotatingFile type which is an io.WriteCloser that writes to a file, and
+// rotates it based on its size and age. Compressing and deleting old files happens in
+// the background, so that writes aren't held up by it.
+type RotatingFile struct {
+	cfg RotateConfig
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	rotateAt time.Time
+
+	// The WaitGroup tracks the background clean-up, so that Close() can wait for it.
+	wg sync.WaitGroup
+}
+
+// The layout of the timestamp in the names of rotated files. It sorts in time order.
+const rotateTimeLayout = "20060102T150405.000"
+
+// OpenRotatingFile opens (or creates) the file at cfg.Path for appending.
+func OpenRotatingFile(cfg RotateConfig) (*RotatingFile, error) {
+	if cfg.Path == "" {
+		return nil, errors.New("jsonlog: rotating file needs a path")
+	}
+
+	f := &RotatingFile{cfg: cfg}
+
+	err := f.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
+
+// The open() method opens the log file, and works out when it's next due to rotate.
+func (f *RotatingFile) open() error {
+	file, size, err := f.openFile()
+	if err != nil {
+		return err
+	}
+
+	f.file = file
+	f.size = size
+	f.scheduleRotation()
+
+	return nil
+}
+
+// The openFile() method opens (or creates) the file at the configured path for
+// appending, and returns it along with its current size.
+func (f *RotatingFile) openFile() (*os.File, int64, error) {
+	err := os.MkdirAll(filepath.Dir(f.cfg.Path), 0o755)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	file, err := os.OpenFile(f.cfg.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+
+	return file, info.Size(), nil
+}
+
+// The scheduleRotation() method works out when the file is next due to rotate by age.
+func (f *RotatingFile) scheduleRotation() {
+	if f.cfg.Interval > 0 {
+		f.rotateAt = time.Now().Truncate(f.cfg.Interval).Add(f.cfg.Interval)
+	}
+}
+
+// The Write() method writes p to the file, rotating it first if it's due.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return 0, os.ErrClosed
+	}
+
+	// A write bigger than MaxSize on its own still goes in a file of its own, rather
+	// than rotating forever.
+	tooBig := f.cfg.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.cfg.MaxSize
+	tooOld := !f.rotateAt.IsZero() && !time.Now().Before(f.rotateAt)
+
+	// If the rotation fails, the current file is still open, so we carry on writing
+	// to it rather than losing the entry. Rotation is tried again on a later write
+	// (or at the next interval), and Rotate() reports the error to anyone who asks.
+	if tooBig || tooOld {
+		f.rotate()
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+
+	return n, err
+}
+
+// The Rotate() method rotates the file straight away.
+func (f *RotatingFile) Rotate() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return os.ErrClosed
+	}
+
+	return f.rotate()
+}
+
+// The rotate() method renames the current file, opens a new one, and starts the
+// clean-up of old files in the background. It must be called with the mutex held.
+//
+// The current file is only closed once the new one is open. If anything goes wrong
+// before then, the rename is undone and the current file stays in use, so that a full
+// disk or a missing directory doesn't stop logging altogether.
+func (f *RotatingFile) rotate() error {
+	// Whatever happens, don't try to rotate by age again until the next interval.
+	f.scheduleRotation()
+
+	ext := filepath.Ext(f.cfg.Path)
+	backup := strings.TrimSuffix(f.cfg.Path, ext) + "-" + time.Now().UTC().Format(rotateTimeLayout) + ext
+
+	// The open file follows the rename, so entries keep going to it (under its new
+	// name) until it's swapped for the new file.
+	err := os.Rename(f.cfg.Path, backup)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	file, size, err := f.openFile()
+	if err != nil {
+		os.Rename(backup, f.cfg.Path)
+		return err
+	}
+
+	old := f.file
+	f.file = file
+	f.size = size
+
+	closeErr := old.Close()
+
+	f.wg.Add(1)
+	go func() {
+		defer f.wg.Done()
+
+		if f.cfg.Compress {
+			compressFile(backup)
+		}
+		f.prune()
+	}()
+
+	return closeErr
+}
+
+// The compressFile() helper replaces a file with a gzipped copy. If anything goes
+// wrong the original is left alone.
+func compressFile(path string) error {
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(path+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(dst)
+
+	_, err = io.Copy(zw, src)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+
+	return os.Remove(path)
+}
+
+// The prune() method deletes rotated files beyond the newest MaxBackups, and any older
+// than MaxAge. Rotated files are found by their names, which sort in time order.
+func (f *RotatingFile) prune() {
+	if f.cfg.MaxBackups <= 0 && f.cfg.MaxAge <= 0 {
+		return
+	}
+
+	ext := filepath.Ext(f.cfg.Path)
+	prefix := filepath.Base(strings.TrimSuffix(f.cfg.Path, ext)) + "-"
+	dir := filepath.Dir(f.cfg.Path)
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+
+	type backup struct {
+		name string
+		time time.Time
+	}
+
+	var backups []backup
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		stamp := strings.TrimSuffix(strings.TrimSuffix(strings.TrimPrefix(name, prefix), ".gz"), ext)
+
+		t, err := time.Parse(rotateTimeLayout, stamp)
+		if err != nil {
+			continue
+		}
+
+		backups = append(backups, backup{name, t})
+	}
+
+	// Newest first.
+	slices.SortFunc(backups, func(a, b backup) int {
+		return b.time.Compare(a.time)
+	})
+
+	for i, b := range backups {
+		tooMany := f.cfg.MaxBackups > 0 && i >= f.cfg.MaxBackups
+		tooOld := f.cfg.MaxAge > 0 && time.Since(b.time) > f.cfg.MaxAge
+
+		if tooMany || tooOld {
+			os.Remove(filepath.Join(dir, b.name))
+		}
+	}
+}
+
+// The Close() method closes the file, after waiting for any background clean-up to
+// finish.
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.wg.Wait()
+
+	if f.file == nil {
+		return nil
+	}
+
+	err := f.file.Close()
+	f.file = nil
+
+	return err
+}
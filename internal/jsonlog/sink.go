@@ -0,0 +1,238 @@
+package jsonlog
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Define an Entry struct to hold a single log entry on its way to a sink.
+type Entry struct {
+	Level      Level
+	Time       time.Time
+	Message    string
+	Properties map[string]any
+	Trace      string
+}
+
+// A Sink is somewhere that log entries are written to. Sinks must be safe for
+// concurrent use. Entries are never changed once they've been written, so a sink may
+// hang on to them after Write() returns (the AsyncSink does).
+type Sink interface {
+	Write(entry *Entry) error
+	Close() error
+}
+
+// Format is the way a WriterSink turns entries into text.
+type Format int
+
+const (
+	// FormatJSON writes each entry as a line of JSON, which is easy for machines to
+	// read.
+	FormatJSON Format = iota
+	// FormatConsole writes each entry as a line of text, which is easier for people
+	// to read while developing.
+	FormatConsole
+)
+
+// Return the name of the format.
+func (f Format) String() string {
+	switch f {
+	case FormatJSON:
+		return "json"
+	case FormatConsole:
+		return "console"
+	default:
+		return ""
+	}
+}
+
+// ParseFormat returns the format with the given name ("json" or "console").
+func ParseFormat(s string) (Format, error) {
+	switch s {
+	case "json":
+		return FormatJSON, nil
+	case "console":
+		return FormatConsole, nil
+	}
+
+	return 0, fmt.Errorf("jsonlog: unknown format %q", s)
+}
+
+var errSinkClosed = errors.New("jsonlog: sink is closed")
+
+// Define a WriterSink type which formats entries at or above a minimum level and
+// writes them to an io.Writer, plus a mutex for coordinating the writes.
+type WriterSink struct {
+	out      io.Writer
+	closer   io.Closer
+	format   Format
+	minLevel Level
+	mu       sync.Mutex
+}
+
+// Return a new WriterSink. The writer isn't closed when the sink is, which is what we
+// want for os.Stdout.
+func NewWriterSink(out io.Writer, format Format, minLevel Level) *WriterSink {
+	return &WriterSink{out: out, format: format, minLevel: minLevel}
+}
+
+// Return a new WriterSink which closes out when the sink is closed, for writers which
+// belong to the sink (like a RotatingFile).
+func NewWriteCloserSink(out io.WriteCloser, format Format, minLevel Level) *WriterSink {
+	return &WriterSink{out: out, closer: out, format: format, minLevel: minLevel}
+}
+
+// The Write() method formats the entry and writes it.
+func (s *WriterSink) Write(entry *Entry) error {
+	if entry.Level < s.minLevel {
+		return nil
+	}
+
+	var line []byte
+	switch s.format {
+	case FormatConsole:
+		line = formatConsole(entry)
+	default:
+		line = formatJSON(entry)
+	}
+
+	// Lock the mutex so that no two writes to the output destination cannot happen
+	// concurrently. If we don't do this, it's possible that the text for two or more
+	// log entries will be intermingled in the output.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.out.Write(line)
+	return err
+}
+
+// The Close() method closes the writer, if it belongs to the sink.
+func (s *WriterSink) Close() error {
+	if s.closer == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closer.Close()
+}
+
+// The formatJSON() helper returns an entry as a line of JSON.
+func formatJSON(entry *Entry) []byte {
+	// Declare an anonymous struct holding the data for the log entry.
+	aux := struct {
+		Level      string         `json:"level"`
+		Time       string         `json:"time"`
+		Message    string         `json:"message"`
+		Properties map[string]any `json:"properties,omitempty"`
+		Trace      string         `json:"trace,omitempty"`
+	}{
+		Level:      entry.Level.String(),
+		Time:       entry.Time.UTC().Format(time.RFC3339),
+		Message:    entry.Message,
+		Properties: entry.Properties,
+		Trace:      entry.Trace,
+	}
+
+	// Marshal the anonymous struct to JSON. If there was a problem creating the JSON,
+	// set the contents of the log entry to be that plain-text error message instead.
+	line, err := json.Marshal(aux)
+	if err != nil {
+		line = []byte(LevelError.String() + ": unable to marshal log message:" + err.Error())
+	}
+
+	return append(line, '\n')
+}
+
+// The formatConsole() helper returns an entry as text, like:
+//
+//	2026-01-02T15:04:05Z INFO  starting server addr=:4000 env=development
+//
+// Properties are sorted by key, and nested objects are written as JSON. The stack
+// trace, if there is one, follows on the next lines.
+func formatConsole(entry *Entry) []byte {
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, "%s %-5s %s", entry.Time.UTC().Format(time.RFC3339), entry.Level, entry.Message)
+
+	for _, key := range slices.Sorted(maps.Keys(entry.Properties)) {
+		b.WriteByte(' ')
+		b.WriteString(key)
+		b.WriteByte('=')
+
+		switch v := entry.Properties[key].(type) {
+		case string:
+			// Quote strings which would otherwise be hard to tell apart.
+			if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+				b.WriteString(fmt.Sprintf("%q", v))
+			} else {
+				b.WriteString(v)
+			}
+		default:
+			js, err := json.Marshal(v)
+			if err != nil {
+				js = []byte(fmt.Sprint(v))
+			}
+			b.Write(js)
+		}
+	}
+
+	b.WriteByte('\n')
+
+	if entry.Trace != "" {
+		b.WriteString(entry.Trace)
+		if !strings.HasSuffix(entry.Trace, "\n") {
+			b.WriteByte('\n')
+		}
+	}
+
+	return b.Bytes()
+}
+
+// Define a multiSink type which writes every entry to several sinks.
+type multiSink []Sink
+
+// Multi returns a sink which writes every entry to all of the sinks. Each sink applies
+// its own minimum level.
+func Multi(sinks ...Sink) Sink {
+	return multiSink(sinks)
+}
+
+// The Write() method writes the entry to every sink, even if some of them fail, and
+// returns all the errors together.
+func (m multiSink) Write(entry *Entry) error {
+	var errs []error
+	for _, sink := range m {
+		errs = append(errs, sink.Write(entry))
+	}
+	return errors.Join(errs...)
+}
+
+// The Close() method closes every sink.
+func (m multiSink) Close() error {
+	var errs []error
+	for _, sink := range m {
+		errs = append(errs, sink.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// The Dropped() method adds up the dropped entries of any asynchronous sinks.
+func (m multiSink) Dropped() uint64 {
+	var n uint64
+	for _, sink := range m {
+		if d, ok := sink.(interface{ Dropped() uint64 }); ok {
+			n += d.Dropped()
+		}
+	}
+	return n
+}
@@ -0,0 +1,124 @@
+package jsonlog
+
+import (
+	"context"
+	"log/slog"
+	"slices"
+)
+
+// Define a Handler type which implements slog.Handler by writing records through a
+// Logger. This lets libraries which log with the standard log/slog package write to
+// the same place, in the same format, as the rest of the application.
+type Handler struct {
+	logger *Logger
+	groups []string
+}
+
+// The Handler() method returns a slog.Handler which writes through the logger. Records
+// are subject to the logger's minimum level, and include its attrs.
+func (l *Logger) Handler() *Handler {
+	return &Handler{logger: l}
+}
+
+// The levelFromSlog() helper maps slog's levels to ours. slog levels are integers with
+// gaps between the named ones, so each of our levels covers a range of them.
+func levelFromSlog(level slog.Level) Level {
+	switch {
+	case level < slog.LevelInfo:
+		return LevelDebug
+	case level < slog.LevelWarn:
+		return LevelInfo
+	case level < slog.LevelError:
+		return LevelWarn
+	default:
+		return LevelError
+	}
+}
+
+// The Enabled() method reports whether records at the level will be written.
+func (h *Handler) Enabled(_ context.Context, level slog.Level) bool {
+	return h.logger.Enabled(levelFromSlog(level))
+}
+
+// The Handle() method writes a record.
+func (h *Handler) Handle(_ context.Context, record slog.Record) error {
+	attrs := make([]Attr, 0, record.NumAttrs())
+	record.Attrs(func(a slog.Attr) bool {
+		attrs = appendSlogAttr(attrs, a)
+		return true
+	})
+
+	return h.logger.print(levelFromSlog(record.Level), record.Message, h.nest(attrs))
+}
+
+// The WithAttrs() method returns a Handler which adds attrs to every record.
+func (h *Handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	converted := make([]Attr, 0, len(attrs))
+	for _, a := range attrs {
+		converted = appendSlogAttr(converted, a)
+	}
+
+	return &Handler{logger: h.logger.With(h.nest(converted)...), groups: h.groups}
+}
+
+// The WithGroup() method returns a Handler which puts the attrs added after it in a
+// nested object.
+func (h *Handler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+
+	return &Handler{logger: h.logger, groups: append(slices.Clip(h.groups), name)}
+}
+
+// The nest() method wraps attrs in the handler's groups, innermost last.
+func (h *Handler) nest(attrs []Attr) []Attr {
+	if len(attrs) == 0 {
+		return attrs
+	}
+
+	for i := len(h.groups) - 1; i >= 0; i-- {
+		attrs = []Attr{Group(h.groups[i], attrs...)}
+	}
+
+	return attrs
+}
+
+// The appendSlogAttr() helper converts a slog.Attr and appends it to attrs, following
+// the rules for handlers: empty attrs are dropped, and groups without a key are
+// inlined.
+func appendSlogAttr(attrs []Attr, a slog.Attr) []Attr {
+	a.Value = a.Value.Resolve()
+
+	if a.Equal(slog.Attr{}) {
+		return attrs
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		var members []Attr
+		for _, member := range a.Value.Group() {
+			members = appendSlogAttr(members, member)
+		}
+
+		if len(members) == 0 {
+			return attrs
+		}
+		if a.Key == "" {
+			return append(attrs, members...)
+		}
+		return append(attrs, Group(a.Key, members...))
+	case slog.KindDuration:
+		return append(attrs, Duration(a.Key, a.Value.Duration()))
+	case slog.KindTime:
+		return append(attrs, Time(a.Key, a.Value.Time()))
+	case slog.KindAny:
+		// Errors don't encode to anything useful as JSON, so use their message.
+		if err, ok := a.Value.Any().(error); ok {
+			return append(attrs, String(a.Key, err.Error()))
+		}
+		return append(attrs, Any(a.Key, a.Value.Any()))
+	default:
+		return append(attrs, Any(a.Key, a.Value.Any()))
+	}
+}
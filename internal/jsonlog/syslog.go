@@ -0,0 +1,136 @@
+package jsonlog
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// The addresses that the local syslog daemon usually listens on, on Linux, macOS and
+// the BSDs.
+var syslogAddresses = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// The facility that entries are logged under. 3 is "daemon", for system daemons.
+const syslogFacility = 3
+
+// Define a SyslogSink type which writes entries at or above a minimum level to the
+// local syslog daemon over a unix socket. The message of each entry is the same JSON
+// that a WriterSink writes, so that it can still be parsed by machines.
+type SyslogSink struct {
+	address  string
+	tag      string
+	minLevel Level
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// Return a new SyslogSink connected to the syslog daemon. If address is empty, the
+// usual places are tried in turn. The tag is written in front of each message, and is
+// normally the name of the program.
+func NewSyslogSink(address, tag string, minLevel Level) (*SyslogSink, error) {
+	s := &SyslogSink{address: address, tag: tag, minLevel: minLevel}
+
+	err := s.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// The connect() method dials the syslog daemon. Most daemons listen on a datagram
+// socket, but some use a stream socket, so both are tried.
+func (s *SyslogSink) connect() error {
+	addresses := syslogAddresses
+	if s.address != "" {
+		addresses = []string{s.address}
+	}
+
+	for _, network := range []string{"unixgram", "unix"} {
+		for _, address := range addresses {
+			conn, err := net.Dial(network, address)
+			if err == nil {
+				s.conn = conn
+				return nil
+			}
+		}
+	}
+
+	return errors.New("jsonlog: unable to connect to syslog")
+}
+
+// The severity() helper maps our levels to syslog's severities.
+func severity(level Level) int {
+	switch {
+	case level <= LevelDebug:
+		return 7 // debug
+	case level == LevelInfo:
+		return 6 // informational
+	case level == LevelWarn:
+		return 4 // warning
+	case level == LevelError:
+		return 3 // err
+	default:
+		return 2 // crit
+	}
+}
+
+// The Write() method writes the entry to syslog, in the traditional BSD format that
+// local daemons expect. If the write fails, perhaps because the daemon restarted, we
+// reconnect and try once more.
+func (s *SyslogSink) Write(entry *Entry) error {
+	if entry.Level < s.minLevel {
+		return nil
+	}
+
+	line := formatJSON(entry)
+	msg := fmt.Sprintf("<%d>%s %s[%d]: %s",
+		syslogFacility*8+severity(entry.Level),
+		entry.Time.Format(time.Stamp),
+		s.tag,
+		os.Getpid(),
+		line,
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return errSinkClosed
+	}
+
+	_, err := s.conn.Write([]byte(msg))
+	if err == nil {
+		return nil
+	}
+
+	s.conn.Close()
+	s.conn = nil
+
+	err = s.connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.conn.Write([]byte(msg))
+	return err
+}
+
+// The Close() method closes the connection to the syslog daemon.
+func (s *SyslogSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+
+	return err
+}
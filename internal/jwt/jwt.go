@@ -0,0 +1,373 @@
+package jwt
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// Define the algorithms that we know how to sign and verify with. EdDSA keys are
+// asymmetric, so their public half can be published in a JWKS document. HS256 keys are
+// shared secrets and are never published. RS256 and ES256 are only supported for
+// verifying tokens issued by someone else (such as an OpenID Connect provider), using
+// public keys from their JWKS document.
+const (
+	AlgEdDSA = "EdDSA"
+	AlgHS256 = "HS256"
+	AlgRS256 = "RS256"
+	AlgES256 = "ES256"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrExpiredToken = errors.New("token has expired")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+// Because the same base64url alphabet (without padding) is used for every part of a
+// token, we keep a single encoding around.
+var b64 = base64.RawURLEncoding
+
+// Key holds a single signing key along with the key ID (kid) that is written into the
+// header of every token it signs. Only one of the private/public or secret fields is
+// set, depending on the algorithm.
+type Key struct {
+	ID        string
+	Algorithm string
+	private   ed25519.PrivateKey
+	public    ed25519.PublicKey
+	secret    []byte
+	rsa       *rsa.PublicKey
+	ecdsa     *ecdsa.PublicKey
+}
+
+// ParseKey parses a key in the format "<kid>:<alg>:<base64 material>". For EdDSA the
+// material is the 32-byte private key seed, and for HS256 it is the shared secret,
+// which must be at least 32 bytes long.
+func ParseKey(spec string) (*Key, error) {
+	parts := strings.SplitN(spec, ":", 3)
+	if len(parts) != 3 || parts[0] == "" {
+		return nil, fmt.Errorf("jwt: key must be in the format kid:alg:base64")
+	}
+
+	material, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("jwt: key %q: %w", parts[0], err)
+	}
+
+	key := &Key{ID: parts[0], Algorithm: parts[1]}
+
+	switch key.Algorithm {
+	case AlgEdDSA:
+		if len(material) != ed25519.SeedSize {
+			return nil, fmt.Errorf("jwt: key %q: EdDSA seed must be %d bytes", key.ID, ed25519.SeedSize)
+		}
+		key.private = ed25519.NewKeyFromSeed(material)
+		key.public = key.private.Public().(ed25519.PublicKey)
+	case AlgHS256:
+		if len(material) < 32 {
+			return nil, fmt.Errorf("jwt: key %q: HS256 secret must be at least 32 bytes", key.ID)
+		}
+		key.secret = material
+	default:
+		return nil, fmt.Errorf("jwt: key %q: unsupported algorithm %q", key.ID, key.Algorithm)
+	}
+
+	return key, nil
+}
+
+func (k *Key) sign(input []byte) ([]byte, error) {
+	switch k.Algorithm {
+	case AlgEdDSA:
+		if k.private == nil {
+			return nil, fmt.Errorf("jwt: key %q cannot be used for signing", k.ID)
+		}
+		return ed25519.Sign(k.private, input), nil
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return mac.Sum(nil), nil
+	case AlgRS256, AlgES256:
+		return nil, fmt.Errorf("jwt: key %q cannot be used for signing", k.ID)
+	}
+
+	return nil, fmt.Errorf("jwt: unsupported algorithm %q", k.Algorithm)
+}
+
+func (k *Key) verify(input, signature []byte) bool {
+	switch k.Algorithm {
+	case AlgEdDSA:
+		return ed25519.Verify(k.public, input, signature)
+	case AlgHS256:
+		mac := hmac.New(sha256.New, k.secret)
+		mac.Write(input)
+		return hmac.Equal(mac.Sum(nil), signature)
+	case AlgRS256:
+		digest := sha256.Sum256(input)
+		return rsa.VerifyPKCS1v15(k.rsa, crypto.SHA256, digest[:], signature) == nil
+	case AlgES256:
+		// ES256 signatures are the r and s values concatenated as two 32-byte
+		// big-endian integers, rather than the ASN.1 encoding used by crypto/ecdsa.
+		if len(signature) != 64 {
+			return false
+		}
+		digest := sha256.Sum256(input)
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(k.ecdsa, digest[:], r, s)
+	}
+
+	return false
+}
+
+// KeySet holds every key that tokens may be verified with, indexed by kid. The first
+// key passed to NewKeySet is the one used to sign new tokens; the rest are kept so that
+// tokens signed before a key rotation remain valid until they expire.
+type KeySet struct {
+	signing *Key
+	list    []*Key
+	keys    map[string]*Key
+}
+
+func NewKeySet(keys ...*Key) (*KeySet, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("jwt: at least one key must be provided")
+	}
+
+	ks := &KeySet{
+		signing: keys[0],
+		list:    keys,
+		keys:    make(map[string]*Key, len(keys)),
+	}
+
+	for _, key := range keys {
+		if _, exists := ks.keys[key.ID]; exists {
+			return nil, fmt.Errorf("jwt: duplicate key id %q", key.ID)
+		}
+		ks.keys[key.ID] = key
+	}
+
+	return ks, nil
+}
+
+type header struct {
+	Algorithm string `json:"alg"`
+	Type      string `json:"typ,omitempty"`
+	KeyID     string `json:"kid,omitempty"`
+}
+
+// Sign encodes the claims as the token payload and signs it with the current signing
+// key, returning the compact serialization of the token.
+func (ks *KeySet) Sign(claims any) (string, error) {
+	h, err := json.Marshal(header{Algorithm: ks.signing.Algorithm, Type: "JWT", KeyID: ks.signing.ID})
+	if err != nil {
+		return "", err
+	}
+
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	input := b64.EncodeToString(h) + "." + b64.EncodeToString(payload)
+
+	signature, err := ks.signing.sign([]byte(input))
+	if err != nil {
+		return "", err
+	}
+
+	return input + "." + b64.EncodeToString(signature), nil
+}
+
+// Verify checks the token signature against the key named in its kid header and then
+// decodes the payload into dst. Note that Verify doesn't look at any claims, so callers
+// must check the expiry themselves (for example with RegisteredClaims.Valid).
+func (ks *KeySet) Verify(token string, dst any) error {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return ErrInvalidToken
+	}
+
+	rawHeader, err := b64.DecodeString(parts[0])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	var h header
+	if err := json.Unmarshal(rawHeader, &h); err != nil {
+		return ErrInvalidToken
+	}
+
+	key, ok := ks.keys[h.KeyID]
+	if !ok {
+		return ErrUnknownKey
+	}
+
+	// Never trust the alg header on its own. It must match the algorithm of the key
+	// that we have on file for that kid, otherwise an attacker could, for example,
+	// present an HS256 token "signed" with a public key.
+	if h.Algorithm != key.Algorithm {
+		return ErrInvalidToken
+	}
+
+	signature, err := b64.DecodeString(parts[2])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if !key.verify([]byte(parts[0]+"."+parts[1]), signature) {
+		return ErrInvalidToken
+	}
+
+	payload, err := b64.DecodeString(parts[1])
+	if err != nil {
+		return ErrInvalidToken
+	}
+
+	if err := json.Unmarshal(payload, dst); err != nil {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// RegisteredClaims holds the standard claims from RFC 7519. It's intended to be
+// embedded in an application-specific claims struct.
+type RegisteredClaims struct {
+	Issuer    string `json:"iss,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+	NotBefore int64  `json:"nbf,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	ID        string `json:"jti,omitempty"`
+}
+
+// Valid checks the time-based claims against the provided time. A token without an
+// exp claim is treated as invalid, because we never issue tokens that live forever.
+func (c RegisteredClaims) Valid(now time.Time) error {
+	if c.ExpiresAt == 0 || now.Unix() >= c.ExpiresAt {
+		return ErrExpiredToken
+	}
+
+	if c.NotBefore != 0 && now.Unix() < c.NotBefore {
+		return ErrInvalidToken
+	}
+
+	return nil
+}
+
+// JWK is the JSON representation of a single public key, as described in RFC 7517.
+// OKP and EC keys use the crv, x (and for EC, y) members, and RSA keys use n and e.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	Curve     string `json:"crv,omitempty"`
+	X         string `json:"x,omitempty"`
+	Y         string `json:"y,omitempty"`
+	N         string `json:"n,omitempty"`
+	E         string `json:"e,omitempty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use,omitempty"`
+	Algorithm string `json:"alg,omitempty"`
+}
+
+// ParseJWK returns a verification-only key for a public JWK. If the JWK doesn't name
+// an algorithm, it is inferred from the key type.
+func ParseJWK(jwk JWK) (*Key, error) {
+	key := &Key{ID: jwk.KeyID, Algorithm: jwk.Algorithm}
+
+	switch {
+	case jwk.KeyType == "OKP" && jwk.Curve == "Ed25519":
+		x, err := b64.DecodeString(jwk.X)
+		if err != nil || len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("jwt: key %q: invalid Ed25519 public key", jwk.KeyID)
+		}
+		key.public = ed25519.PublicKey(x)
+		if key.Algorithm == "" {
+			key.Algorithm = AlgEdDSA
+		}
+	case jwk.KeyType == "RSA":
+		n, err := b64.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: key %q: invalid RSA modulus", jwk.KeyID)
+		}
+		e, err := b64.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, fmt.Errorf("jwt: key %q: invalid RSA exponent", jwk.KeyID)
+		}
+		key.rsa = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+		if key.rsa.N.BitLen() < 2048 {
+			return nil, fmt.Errorf("jwt: key %q: RSA keys must be at least 2048 bits", jwk.KeyID)
+		}
+		if key.Algorithm == "" {
+			key.Algorithm = AlgRS256
+		}
+	case jwk.KeyType == "EC" && jwk.Curve == "P-256":
+		x, errX := b64.DecodeString(jwk.X)
+		y, errY := b64.DecodeString(jwk.Y)
+		if errX != nil || errY != nil || len(x) != 32 || len(y) != 32 {
+			return nil, fmt.Errorf("jwt: key %q: invalid EC public key", jwk.KeyID)
+		}
+		// The point is checked to be on the curve as it is parsed.
+		point := append([]byte{4}, append(x, y...)...)
+		public, err := ecdsa.ParseUncompressedPublicKey(elliptic.P256(), point)
+		if err != nil {
+			return nil, fmt.Errorf("jwt: key %q: %w", jwk.KeyID, err)
+		}
+		key.ecdsa = public
+		if key.Algorithm == "" {
+			key.Algorithm = AlgES256
+		}
+	default:
+		return nil, fmt.Errorf("jwt: key %q: unsupported key type %q", jwk.KeyID, jwk.KeyType)
+	}
+
+	// Make sure that the algorithm matches the key type, so that, for example, an RSA
+	// key can't be used with the EdDSA verification code.
+	expected := map[string]string{"OKP": AlgEdDSA, "RSA": AlgRS256, "EC": AlgES256}[jwk.KeyType]
+	if key.Algorithm != expected {
+		return nil, fmt.Errorf("jwt: key %q: algorithm %q doesn't match key type %q", jwk.KeyID, key.Algorithm, jwk.KeyType)
+	}
+
+	return key, nil
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWKS returns the public keys in the set. HS256 secrets are skipped, so if only HMAC
+// keys are configured the document will contain an empty list.
+func (ks *KeySet) JWKS() JWKS {
+	jwks := JWKS{Keys: []JWK{}}
+
+	for _, key := range ks.list {
+		if key.Algorithm != AlgEdDSA {
+			continue
+		}
+
+		jwks.Keys = append(jwks.Keys, JWK{
+			KeyType:   "OKP",
+			Curve:     "Ed25519",
+			X:         b64.EncodeToString(key.public),
+			KeyID:     key.ID,
+			Use:       "sig",
+			Algorithm: key.Algorithm,
+		})
+	}
+
+	return jwks
+}
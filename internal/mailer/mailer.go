@@ -2,11 +2,13 @@ package mailer
 
 import (
 	"bytes"
+	"context"
 	"embed"
 	"html/template"
 	"time"
 
 	"github.com/go-mail/mail"
+	"github.com/thecodephilic-guy/greenlight/internal/tracing"
 )
 
 // Below we declare a new variable with the type embed.FS (embedded file system) to hold
@@ -41,8 +43,14 @@ func New(host string, port int, username, password, sender string) Mailer {
 
 // Define a Send() method on the Mailer type. This takes the receipient email address
 // as the first param, the name of the file containing the templates, and any dynamic data for the
-// templates as an interface{} param.
-func (m Mailer) Send(recipient, templateFile string, data any) error {
+// templates as an interface{} param. The context is only used as the parent of the send's
+// span, so it's fine to pass the context of a request which has already finished.
+func (m Mailer) Send(ctx context.Context, recipient, templateFile string, data any) error {
+	// Start a span covering the whole send, including any retries. Talking to the SMTP
+	// server is often the slowest part of a request which sends an email.
+	_, span := tracing.StartKind(ctx, tracing.KindClient, "mailer.Send", tracing.Attr("email.template", templateFile))
+	defer span.End()
+
 	// Use the ParseFS() method to parse the required template file from the
 	// embedded file system.
 	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
@@ -102,5 +110,7 @@ func (m Mailer) Send(recipient, templateFile string, data any) error {
 		time.Sleep(500 * time.Millisecond)
 	}
 
+	span.RecordError(err)
+
 	return nil
 }
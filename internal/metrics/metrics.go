@@ -0,0 +1,260 @@
+// Package metrics is a small implementation of the Prometheus text exposition format.
+// It supports just what the API needs: histograms with labels, and gauges and counters
+// whose values are read from a function when the metrics are scraped.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultBuckets are the default histogram buckets for durations in seconds, from 5ms
+// to 10s. They are the same as the Prometheus client libraries use.
+var DefaultBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// ExponentialBuckets returns count buckets, where the first is start and each one after
+// that is factor times the one before.
+func ExponentialBuckets(start, factor float64, count int) []float64 {
+	buckets := make([]float64, count)
+	for i := range buckets {
+		buckets[i] = start
+		start *= factor
+	}
+	return buckets
+}
+
+// A Label is a name and value pair attached to a metric.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// A collector writes one metric family in the text format.
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+// Define a Registry type which holds the metrics to expose. It is safe for concurrent
+// use.
+type Registry struct {
+	mu         sync.Mutex
+	collectors []collector
+}
+
+// Return a new, empty Registry.
+func New() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.collectors = append(r.collectors, c)
+}
+
+// The WriteTo() method writes every metric in the text exposition format, in the order
+// that they were registered.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	collectors := slices.Clone(r.collectors)
+	r.mu.Unlock()
+
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+
+	for _, c := range collectors {
+		c.write(bw)
+	}
+
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// The Handler() method returns a http.Handler which serves the metrics to a Prometheus
+// server.
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.WriteTo(w)
+	})
+}
+
+// The NewGaugeFunc() method registers a gauge whose value is read from fn on every
+// scrape.
+func (r *Registry) NewGaugeFunc(name, help string, fn func() float64, labels ...Label) {
+	r.register(&funcMetric{name: name, help: help, kind: "gauge", fn: fn, labels: labels})
+}
+
+// The NewCounterFunc() method registers a counter whose value is read from fn on every
+// scrape. The value must only ever go up.
+func (r *Registry) NewCounterFunc(name, help string, fn func() float64, labels ...Label) {
+	r.register(&funcMetric{name: name, help: help, kind: "counter", fn: fn, labels: labels})
+}
+
+type funcMetric struct {
+	name   string
+	help   string
+	kind   string
+	fn     func() float64
+	labels []Label
+}
+
+func (m *funcMetric) write(w *bufio.Writer) {
+	writeHeader(w, m.name, m.help, m.kind)
+	writeSample(w, m.name, m.labels, m.fn())
+}
+
+// Define a HistogramVec type which holds a histogram for each combination of label
+// values.
+type HistogramVec struct {
+	name       string
+	help       string
+	buckets    []float64
+	labelNames []string
+
+	mu     sync.Mutex
+	series map[string]*histogram
+}
+
+type histogram struct {
+	labelValues []string
+	counts      []uint64
+	count       uint64
+	sum         float64
+}
+
+// The NewHistogramVec() method registers a histogram with the given buckets, which must
+// be sorted in increasing order, and label names.
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	h := &HistogramVec{
+		name:       name,
+		help:       help,
+		buckets:    buckets,
+		labelNames: labelNames,
+		series:     make(map[string]*histogram),
+	}
+
+	r.register(h)
+
+	return h
+}
+
+// The Observe() method records a value in the histogram for the label values, which
+// must be given in the same order as the label names.
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(h.labelNames) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", h.name, len(h.labelNames), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{
+			labelValues: slices.Clone(labelValues),
+			counts:      make([]uint64, len(h.buckets)),
+		}
+		h.series[key] = s
+	}
+
+	// Only the first bucket that the value fits in is incremented here. The buckets
+	// are cumulative in the output, so the counts are added up when they're written.
+	if i, _ := slices.BinarySearch(h.buckets, value); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += value
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	// Sort the series so that the output is stable from one scrape to the next.
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	for _, key := range keys {
+		s := h.series[key]
+
+		labels := make([]Label, len(h.labelNames), len(h.labelNames)+1)
+		for i, name := range h.labelNames {
+			labels[i] = Label{Name: name, Value: s.labelValues[i]}
+		}
+
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.counts[i]
+			writeSample(w, h.name+"_bucket", append(labels, Label{"le", formatFloat(upper)}), float64(cumulative))
+		}
+		writeSample(w, h.name+"_bucket", append(labels, Label{"le", "+Inf"}), float64(s.count))
+		writeSample(w, h.name+"_sum", labels, s.sum)
+		writeSample(w, h.name+"_count", labels, float64(s.count))
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, kind string) {
+	help = strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func writeSample(w *bufio.Writer, name string, labels []Label, value float64) {
+	w.WriteString(name)
+
+	if len(labels) > 0 {
+		w.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			fmt.Fprintf(w, `%s="%s"`, label.Name, labelValueEscaper.Replace(label.Value))
+		}
+		w.WriteByte('}')
+	}
+
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(value))
+	w.WriteByte('\n')
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	cw.n += int64(n)
+	return n, err
+}
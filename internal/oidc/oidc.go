@@ -0,0 +1,388 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/jwt"
+)
+
+var (
+	ErrInvalidIDToken = errors.New("oidc: invalid id token")
+)
+
+// How far the clocks of the provider and this server may drift apart before the time
+// claims in an ID token are rejected.
+const clockSkew = time.Minute
+
+// How often the provider's JWKS document may be fetched again when a token is signed
+// with a key that we haven't seen. This stops a flood of forged tokens with random key
+// IDs from turning into a flood of requests to the provider.
+const jwksRefreshInterval = time.Minute
+
+// Define a Config struct to hold the settings for a relying party. The issuer is the
+// provider's base URL, which the discovery document is fetched from, and must match
+// the iss claim in every ID token. If HTTPClient is nil, a client with a 10-second
+// timeout is used.
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+	Scopes       []string
+	HTTPClient   *http.Client
+}
+
+// Metadata holds the parts of the provider's discovery document that we use.
+type Metadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// Claims holds the claims from an ID token that we use. Some providers send
+// email_verified as the string "true" rather than a boolean, which flexibleBool deals
+// with.
+type Claims struct {
+	Issuer        string       `json:"iss"`
+	Subject       string       `json:"sub"`
+	Audience      audience     `json:"aud"`
+	AuthorizedBy  string       `json:"azp"`
+	ExpiresAt     int64        `json:"exp"`
+	IssuedAt      int64        `json:"iat"`
+	NotBefore     int64        `json:"nbf"`
+	Nonce         string       `json:"nonce"`
+	Email         string       `json:"email"`
+	EmailVerified flexibleBool `json:"email_verified"`
+	Name          string       `json:"name"`
+}
+
+// The aud claim may be either a single string or an array of strings.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+
+	var multiple []string
+	if err := json.Unmarshal(b, &multiple); err != nil {
+		return err
+	}
+
+	*a = multiple
+	return nil
+}
+
+type flexibleBool bool
+
+func (f *flexibleBool) UnmarshalJSON(b []byte) error {
+	switch string(b) {
+	case "true", `"true"`:
+		*f = true
+	default:
+		*f = false
+	}
+
+	return nil
+}
+
+// Define a Provider type which runs the authorization code flow against a single
+// OpenID Connect provider. The discovery document and signing keys are fetched the
+// first time they're needed and then cached, so an unreachable provider doesn't stop
+// the server from starting. A Provider is safe for concurrent use.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	mu          sync.Mutex
+	metadata    *Metadata
+	keys        *jwt.KeySet
+	keysFetched time.Time
+}
+
+// Return a new Provider for the configuration.
+func New(config Config) *Provider {
+	client := config.HTTPClient
+	if client == nil {
+		client = &http.Client{Timeout: 10 * time.Second}
+	}
+
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "email", "profile"}
+	}
+
+	return &Provider{
+		config: config,
+		client: client,
+	}
+}
+
+// GenerateVerifier returns a new random PKCE code verifier (RFC 7636). It's also a good
+// source of values for the state and nonce parameters.
+func GenerateVerifier() (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(randomBytes), nil
+}
+
+// Challenge returns the S256 PKCE code challenge for a verifier.
+func Challenge(verifier string) string {
+	hash := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
+
+// The AuthCodeURL() method returns the URL of the provider's authorization endpoint
+// that the user should be sent to in order to log in.
+func (p *Provider) AuthCodeURL(ctx context.Context, state, nonce, verifier string) (string, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	authURL, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("oidc: invalid authorization endpoint: %w", err)
+	}
+
+	qs := authURL.Query()
+	qs.Set("response_type", "code")
+	qs.Set("client_id", p.config.ClientID)
+	qs.Set("redirect_uri", p.config.RedirectURL)
+	qs.Set("scope", strings.Join(p.config.Scopes, " "))
+	qs.Set("state", state)
+	qs.Set("nonce", nonce)
+	qs.Set("code_challenge", Challenge(verifier))
+	qs.Set("code_challenge_method", "S256")
+	authURL.RawQuery = qs.Encode()
+
+	return authURL.String(), nil
+}
+
+// The Exchange() method swaps an authorization code for the provider's tokens and
+// returns the verified claims from the ID token. The nonce must be the one that was
+// sent in the authorization request.
+func (p *Provider) Exchange(ctx context.Context, code, verifier, nonce string) (*Claims, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectURL)
+	form.Set("code_verifier", verifier)
+
+	// Public clients (without a secret) just identify themselves, and rely on PKCE.
+	if p.config.ClientSecret == "" {
+		form.Set("client_id", p.config.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+
+	// Confidential clients authenticate with HTTP basic auth (client_secret_basic).
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+
+	err = p.doJSON(req, &tokens)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: token exchange: %w", err)
+	}
+
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("oidc: token response has no id_token")
+	}
+
+	return p.VerifyIDToken(ctx, tokens.IDToken, nonce)
+}
+
+// The VerifyIDToken() method checks the signature of an ID token against the
+// provider's published keys, and then checks its issuer, audience, time claims and
+// nonce.
+func (p *Provider) VerifyIDToken(ctx context.Context, token, nonce string) (*Claims, error) {
+	var claims Claims
+
+	keys, err := p.jwks(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	err = keys.Verify(token, &claims)
+	if errors.Is(err, jwt.ErrUnknownKey) {
+		// The provider may have rotated its keys since we last fetched them.
+		keys, err = p.jwks(ctx, true)
+		if err != nil {
+			return nil, err
+		}
+		err = keys.Verify(token, &claims)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIDToken, err)
+	}
+
+	now := time.Now()
+
+	switch {
+	case claims.Issuer != p.config.Issuer:
+		return nil, fmt.Errorf("%w: unexpected issuer %q", ErrInvalidIDToken, claims.Issuer)
+	case !slices.Contains(claims.Audience, p.config.ClientID):
+		return nil, fmt.Errorf("%w: not issued for this client", ErrInvalidIDToken)
+	case len(claims.Audience) > 1 && claims.AuthorizedBy != p.config.ClientID:
+		return nil, fmt.Errorf("%w: not authorized for this client", ErrInvalidIDToken)
+	case claims.Subject == "":
+		return nil, fmt.Errorf("%w: missing subject", ErrInvalidIDToken)
+	case claims.ExpiresAt == 0 || now.Add(-clockSkew).Unix() >= claims.ExpiresAt:
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIDToken, jwt.ErrExpiredToken)
+	case claims.NotBefore != 0 && now.Add(clockSkew).Unix() < claims.NotBefore:
+		return nil, fmt.Errorf("%w: not valid yet", ErrInvalidIDToken)
+	case claims.IssuedAt > now.Add(clockSkew).Unix():
+		return nil, fmt.Errorf("%w: issued in the future", ErrInvalidIDToken)
+	case claims.Nonce != nonce:
+		return nil, fmt.Errorf("%w: nonce mismatch", ErrInvalidIDToken)
+	}
+
+	return &claims, nil
+}
+
+// The discover() method returns the provider's discovery document, fetching it the
+// first time. The issuer in the document must exactly match the configured issuer.
+func (p *Provider) discover(ctx context.Context) (*Metadata, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.metadata != nil {
+		return p.metadata, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(p.config.Issuer, "/") + "/.well-known/openid-configuration"
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, discoveryURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var metadata Metadata
+
+	err = p.doJSON(req, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: discovery: %w", err)
+	}
+
+	if metadata.Issuer != p.config.Issuer {
+		return nil, fmt.Errorf("oidc: discovery document is for issuer %q, expected %q", metadata.Issuer, p.config.Issuer)
+	}
+
+	if metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JWKSURI == "" {
+		return nil, errors.New("oidc: discovery document is missing required endpoints")
+	}
+
+	p.metadata = &metadata
+
+	return p.metadata, nil
+}
+
+// The jwks() method returns the provider's signing keys, fetching them the first time.
+// If refresh is true they are fetched again, unless that already happened recently.
+func (p *Provider) jwks(ctx context.Context, refresh bool) (*jwt.KeySet, error) {
+	metadata, err := p.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.keys != nil && (!refresh || time.Since(p.keysFetched) < jwksRefreshInterval) {
+		return p.keys, nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, metadata.JWKSURI, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var jwks jwt.JWKS
+
+	err = p.doJSON(req, &jwks)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: fetching jwks: %w", err)
+	}
+
+	// Skip keys that aren't for signatures, or that we can't use, rather than failing
+	// outright. Providers often publish keys for other purposes alongside them.
+	var keys []*jwt.Key
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		key, err := jwt.ParseJWK(jwk)
+		if err != nil {
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+
+	keySet, err := jwt.NewKeySet(keys...)
+	if err != nil {
+		return nil, fmt.Errorf("oidc: no usable signing keys: %w", err)
+	}
+
+	p.keys = keySet
+	p.keysFetched = time.Now()
+
+	return p.keys, nil
+}
+
+// doJSON sends a request and decodes a JSON response body into dst. Any status other
+// than 200 OK is treated as an error.
+func (p *Provider) doJSON(req *http.Request, dst any) error {
+	res, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s: %s", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	return json.Unmarshal(body, dst)
+}
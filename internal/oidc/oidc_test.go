@@ -0,0 +1,372 @@
+package oidc
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thecodephilic-guy/greenlight/internal/jwt"
+)
+
+// Define a stubProvider type to stand in for an OpenID Connect provider. It serves the
+// discovery document, an authorization endpoint which logs the user straight in, a
+// token endpoint which checks the PKCE code verifier, and the signing keys.
+type stubProvider struct {
+	*httptest.Server
+
+	// The keys which sign ID tokens, and the keys which are published. They're the
+	// same unless a test wants a token signed with a key the provider doesn't publish.
+	signing   *jwt.KeySet
+	published *jwt.KeySet
+
+	// The issuer in the discovery document, if it should be something other than the
+	// server's URL.
+	issuer string
+
+	// The claims of the ID token are changed by this function, if it's set, before the
+	// token is signed.
+	claims func(map[string]any)
+
+	// The code challenge and nonce sent to the authorization endpoint, which the token
+	// endpoint checks the code verifier against and puts in the ID token.
+	challenge string
+	nonce     string
+}
+
+const (
+	testClientID = "greenlight"
+	testCode     = "authorization-code"
+)
+
+func newTestKeySet(t *testing.T, kid string, seed byte) *jwt.KeySet {
+	t.Helper()
+
+	material := make([]byte, 32)
+	for i := range material {
+		material[i] = seed
+	}
+
+	key, err := jwt.ParseKey(kid + ":" + jwt.AlgEdDSA + ":" + base64.StdEncoding.EncodeToString(material))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keySet, err := jwt.NewKeySet(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return keySet
+}
+
+func newStubProvider(t *testing.T) *stubProvider {
+	t.Helper()
+
+	keys := newTestKeySet(t, "provider-key", 1)
+	p := &stubProvider{signing: keys, published: keys}
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		issuer := p.issuer
+		if issuer == "" {
+			issuer = p.URL
+		}
+
+		json.NewEncoder(w).Encode(Metadata{
+			Issuer:                issuer,
+			AuthorizationEndpoint: p.URL + "/authorize",
+			TokenEndpoint:         p.URL + "/token",
+			JWKSURI:               p.URL + "/jwks",
+		})
+	})
+
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		qs := r.URL.Query()
+
+		if qs.Get("code_challenge_method") != "S256" {
+			http.Error(w, "unsupported code challenge method", http.StatusBadRequest)
+			return
+		}
+
+		p.challenge = qs.Get("code_challenge")
+		p.nonce = qs.Get("nonce")
+
+		redirect, _ := url.Parse(qs.Get("redirect_uri"))
+		redirect.RawQuery = url.Values{"code": {testCode}, "state": {qs.Get("state")}}.Encode()
+
+		http.Redirect(w, r, redirect.String(), http.StatusFound)
+	})
+
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("code") != testCode || Challenge(r.PostFormValue("code_verifier")) != p.challenge {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+
+		now := time.Now()
+
+		claims := map[string]any{
+			"iss":            p.URL,
+			"sub":            "user-1",
+			"aud":            testClientID,
+			"exp":            now.Add(time.Hour).Unix(),
+			"iat":            now.Unix(),
+			"nonce":          p.nonce,
+			"email":          "alice@example.com",
+			"email_verified": "true",
+		}
+		if p.claims != nil {
+			p.claims(claims)
+		}
+
+		idToken, err := p.signing.Sign(claims)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idToken})
+	})
+
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(p.published.JWKS())
+	})
+
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+
+	return p
+}
+
+// The login() method runs the authorization code flow against the stub provider, in
+// the same way as the login and callback handlers do, and returns the result of the
+// code exchange.
+func (p *stubProvider) login(t *testing.T, provider *Provider) (*Claims, error) {
+	t.Helper()
+
+	ctx := context.Background()
+
+	state, err := GenerateVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce, err := GenerateVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+	verifier, err := GenerateVerifier()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authURL, err := provider.AuthCodeURL(ctx, state, nonce, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client := &http.Client{
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Get(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	callback, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The provider must send the state back unchanged, since it's what ties the
+	// callback to the login that was started.
+	if got := callback.Query().Get("state"); got != state {
+		t.Fatalf("state = %q, want %q", got, state)
+	}
+
+	return provider.Exchange(ctx, callback.Query().Get("code"), verifier, nonce)
+}
+
+func (p *stubProvider) provider() *Provider {
+	return New(Config{
+		Issuer:      p.URL,
+		ClientID:    testClientID,
+		RedirectURL: "https://greenlight.example.com/v1/oidc/callback",
+		HTTPClient:  p.Client(),
+	})
+}
+
+func TestDiscovery(t *testing.T) {
+	p := newStubProvider(t)
+
+	authURL, err := p.provider().AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(authURL, p.URL+"/authorize?") {
+		t.Errorf("authorization URL = %q, want the discovered endpoint", authURL)
+	}
+
+	// A discovery document for a different issuer must be refused, or a provider could
+	// vouch for identities at another one.
+	p.issuer = "https://evil.example.com"
+
+	_, err = p.provider().AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err == nil {
+		t.Fatal("expected an error for a discovery document with the wrong issuer")
+	}
+}
+
+func TestAuthCodeURL(t *testing.T) {
+	p := newStubProvider(t)
+
+	authURL, err := p.provider().AuthCodeURL(context.Background(), "the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{
+		"response_type":         "code",
+		"client_id":             testClientID,
+		"state":                 "the-state",
+		"nonce":                 "the-nonce",
+		"code_challenge":        Challenge("the-verifier"),
+		"code_challenge_method": "S256",
+	}
+
+	for name, value := range want {
+		if got := u.Query().Get(name); got != value {
+			t.Errorf("%s = %q, want %q", name, got, value)
+		}
+	}
+
+	// The verifier itself must never be sent to the authorization endpoint.
+	if strings.Contains(authURL, "the-verifier") {
+		t.Error("authorization URL contains the code verifier")
+	}
+}
+
+func TestChallenge(t *testing.T) {
+	// The example from RFC 7636, appendix B.
+	got := Challenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	want := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if got != want {
+		t.Errorf("Challenge() = %q, want %q", got, want)
+	}
+}
+
+func TestLogin(t *testing.T) {
+	p := newStubProvider(t)
+
+	claims, err := p.login(t, p.provider())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if claims.Subject != "user-1" || claims.Email != "alice@example.com" || !claims.EmailVerified {
+		t.Errorf("unexpected claims: %+v", claims)
+	}
+}
+
+func TestExchangeWrongVerifier(t *testing.T) {
+	p := newStubProvider(t)
+	provider := p.provider()
+
+	_, err := provider.AuthCodeURL(context.Background(), "state", "nonce", "verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.challenge = Challenge("verifier")
+
+	// Somebody who intercepted the code, but doesn't know the verifier, can't redeem it.
+	_, err = provider.Exchange(context.Background(), testCode, "another-verifier", "nonce")
+	if err == nil {
+		t.Fatal("expected an error when the code verifier doesn't match the challenge")
+	}
+}
+
+func TestIDTokenChecks(t *testing.T) {
+	tests := []struct {
+		name   string
+		claims func(map[string]any)
+		keys   func(t *testing.T) *jwt.KeySet
+	}{
+		{
+			name:   "wrong nonce",
+			claims: func(c map[string]any) { c["nonce"] = "replayed" },
+		},
+		{
+			name:   "expired",
+			claims: func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+		},
+		{
+			name:   "not valid yet",
+			claims: func(c map[string]any) { c["nbf"] = time.Now().Add(time.Hour).Unix() },
+		},
+		{
+			name:   "wrong issuer",
+			claims: func(c map[string]any) { c["iss"] = "https://evil.example.com" },
+		},
+		{
+			name:   "wrong audience",
+			claims: func(c map[string]any) { c["aud"] = "another-client" },
+		},
+		{
+			name:   "missing subject",
+			claims: func(c map[string]any) { delete(c, "sub") },
+		},
+		{
+			// Signed with a key which has the same ID as the provider's, but isn't it.
+			name: "bad signature",
+			keys: func(t *testing.T) *jwt.KeySet { return newTestKeySet(t, "provider-key", 2) },
+		},
+		{
+			name: "unknown key",
+			keys: func(t *testing.T) *jwt.KeySet { return newTestKeySet(t, "other-key", 2) },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newStubProvider(t)
+			p.claims = tt.claims
+			if tt.keys != nil {
+				p.signing = tt.keys(t)
+			}
+
+			_, err := p.login(t, p.provider())
+			if !errors.Is(err, ErrInvalidIDToken) {
+				t.Fatalf("err = %v, want ErrInvalidIDToken", err)
+			}
+		})
+	}
+}
+
+func TestIDTokenExpiryError(t *testing.T) {
+	p := newStubProvider(t)
+	p.claims = func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() }
+
+	_, err := p.login(t, p.provider())
+	if !errors.Is(err, jwt.ErrExpiredToken) {
+		t.Fatalf("err = %v, want jwt.ErrExpiredToken", err)
+	}
+}
@@ -0,0 +1,248 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Define a StdoutExporter type which writes each span as a line of JSON. Despite the
+// name, it can write to any io.Writer.
+type StdoutExporter struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// Return a new StdoutExporter which writes to out.
+func NewStdoutExporter(out io.Writer) *StdoutExporter {
+	return &StdoutExporter{out: out}
+}
+
+// The Export() method writes the spans, one per line.
+func (e *StdoutExporter) Export(_ context.Context, serviceName string, spans []*Span) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	for _, span := range spans {
+		d := span.Data()
+
+		line := map[string]any{
+			"service":     serviceName,
+			"trace_id":    d.Context.TraceID.String(),
+			"span_id":     d.Context.SpanID.String(),
+			"name":        d.Name,
+			"kind":        kindNames[d.Kind],
+			"start":       d.Start.UTC().Format(time.RFC3339Nano),
+			"duration_ms": float64(d.End.Sub(d.Start).Microseconds()) / 1000,
+		}
+
+		if d.Parent != (SpanID{}) {
+			line["parent_span_id"] = d.Parent.String()
+		}
+
+		if len(d.Attributes) > 0 {
+			attributes := make(map[string]any, len(d.Attributes))
+			for _, attr := range d.Attributes {
+				attributes[attr.Key] = attr.Value
+			}
+			line["attributes"] = attributes
+		}
+
+		if d.Error != "" {
+			line["error"] = d.Error
+		}
+
+		js, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+
+		_, err = e.out.Write(append(js, '\n'))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// The Shutdown() method does nothing, as every span is written straight away.
+func (e *StdoutExporter) Shutdown(context.Context) error {
+	return nil
+}
+
+var kindNames = map[SpanKind]string{
+	KindInternal: "internal",
+	KindServer:   "server",
+	KindClient:   "client",
+}
+
+// Define an OTLPExporter type which sends spans to an OpenTelemetry collector, using
+// the JSON encoding of OTLP over HTTP.
+type OTLPExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+// Return a new OTLPExporter which posts spans to endpoint, which is usually something
+// like http://localhost:4318/v1/traces.
+func NewOTLPExporter(endpoint string) *OTLPExporter {
+	return &OTLPExporter{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// These types are the parts of the OTLP trace request that we use. The field names are
+// fixed by the protocol. Note that IDs are hex encoded in the JSON encoding, and that
+// the 64-bit times are sent as strings.
+type (
+	otlpRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              SpanKind       `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+
+	otlpStatus struct {
+		Code    int    `json:"code,omitempty"`
+		Message string `json:"message,omitempty"`
+	}
+
+	otlpKeyValue struct {
+		Key   string         `json:"key"`
+		Value map[string]any `json:"value"`
+	}
+)
+
+// The OTLP status code for a failed span.
+const otlpStatusError = 2
+
+// The otlpValue() helper converts an attribute value to an OTLP AnyValue.
+func otlpValue(v any) map[string]any {
+	switch v := v.(type) {
+	case string:
+		return map[string]any{"stringValue": v}
+	case bool:
+		return map[string]any{"boolValue": v}
+	case int:
+		return map[string]any{"intValue": strconv.Itoa(v)}
+	case int64:
+		return map[string]any{"intValue": strconv.FormatInt(v, 10)}
+	case float64:
+		return map[string]any{"doubleValue": v}
+	default:
+		return map[string]any{"stringValue": fmt.Sprint(v)}
+	}
+}
+
+func otlpAttributes(attributes []Attribute) []otlpKeyValue {
+	kvs := make([]otlpKeyValue, len(attributes))
+	for i, attr := range attributes {
+		kvs[i] = otlpKeyValue{Key: attr.Key, Value: otlpValue(attr.Value)}
+	}
+	return kvs
+}
+
+// The Export() method sends the spans to the collector in a single request.
+func (e *OTLPExporter) Export(ctx context.Context, serviceName string, spans []*Span) error {
+	scopeSpans := otlpScopeSpans{
+		Scope: otlpScope{Name: "github.com/thecodephilic-guy/greenlight"},
+		Spans: make([]otlpSpan, len(spans)),
+	}
+
+	for i, span := range spans {
+		d := span.Data()
+
+		s := otlpSpan{
+			TraceID:           d.Context.TraceID.String(),
+			SpanID:            d.Context.SpanID.String(),
+			Name:              d.Name,
+			Kind:              d.Kind,
+			StartTimeUnixNano: strconv.FormatInt(d.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(d.End.UnixNano(), 10),
+			Attributes:        otlpAttributes(d.Attributes),
+		}
+
+		if d.Parent != (SpanID{}) {
+			s.ParentSpanID = d.Parent.String()
+		}
+
+		if d.Error != "" {
+			s.Status = otlpStatus{Code: otlpStatusError, Message: d.Error}
+		}
+
+		scopeSpans.Spans[i] = s
+	}
+
+	body := otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource:   otlpResource{Attributes: otlpAttributes([]Attribute{Attr("service.name", serviceName)})},
+			ScopeSpans: []otlpScopeSpans{scopeSpans},
+		}},
+	}
+
+	js, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(js))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	io.Copy(io.Discard, res.Body)
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("tracing: collector returned status %d", res.StatusCode)
+	}
+
+	return nil
+}
+
+// The Shutdown() method closes any idle connections to the collector.
+func (e *OTLPExporter) Shutdown(context.Context) error {
+	e.client.CloseIdleConnections()
+	return nil
+}
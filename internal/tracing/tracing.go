@@ -0,0 +1,421 @@
+// Package tracing is a small implementation of distributed tracing. Trace context is
+// propagated with W3C traceparent headers, and finished spans are batched up and handed
+// to an Exporter, which can write them to stdout or send them to an OpenTelemetry
+// collector with OTLP over HTTP.
+//
+// Until Configure() is called, Start() does nothing and returns a nil *Span, whose
+// methods are all safe to call.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// TraceID identifies a trace, and SpanID identifies a span within it.
+type (
+	TraceID [16]byte
+	SpanID  [8]byte
+)
+
+func (t TraceID) String() string { return hex.EncodeToString(t[:]) }
+func (s SpanID) String() string  { return hex.EncodeToString(s[:]) }
+
+// Define a SpanContext struct to hold the part of a span which is propagated to other
+// services: the IDs, and whether the trace is being recorded.
+type SpanContext struct {
+	TraceID TraceID
+	SpanID  SpanID
+	Sampled bool
+}
+
+// The IsValid() method reports whether both IDs are set. All-zero IDs are invalid.
+func (sc SpanContext) IsValid() bool {
+	return sc.TraceID != TraceID{} && sc.SpanID != SpanID{}
+}
+
+// The Traceparent() method formats the span context as a W3C traceparent header.
+func (sc SpanContext) Traceparent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+
+	return "00-" + sc.TraceID.String() + "-" + sc.SpanID.String() + "-" + flags
+}
+
+// ParseTraceparent parses a W3C traceparent header. The second return value is false
+// if the header is missing or malformed, in which case it should be ignored.
+func ParseTraceparent(header string) (SpanContext, bool) {
+	var sc SpanContext
+
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return sc, false
+	}
+
+	// Version ff is forbidden, and version 00 has exactly four fields. Later versions
+	// may add fields, which we ignore.
+	if parts[0] == "ff" || (parts[0] == "00" && len(parts) != 4) {
+		return sc, false
+	}
+
+	var flags [1]byte
+	if _, err := hex.Decode(sc.TraceID[:], []byte(parts[1])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(sc.SpanID[:], []byte(parts[2])); err != nil {
+		return sc, false
+	}
+	if _, err := hex.Decode(flags[:], []byte(parts[3])); err != nil {
+		return sc, false
+	}
+
+	sc.Sampled = flags[0]&1 == 1
+
+	return sc, sc.IsValid()
+}
+
+// SpanKind says what role a span plays in a trace. The values match OTLP.
+type SpanKind int
+
+const (
+	KindInternal SpanKind = 1
+	KindServer   SpanKind = 2
+	KindClient   SpanKind = 3
+)
+
+// An Attribute is a key and value attached to a span. Values should be strings, bools,
+// integers or floats.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+// Attr is a shortcut for creating an Attribute.
+func Attr(key string, value any) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// Define a Span type to hold a single timed operation. A span is only recorded (and
+// exported) if its trace is sampled, but even unsampled spans have IDs, so that the
+// trace context can still be propagated.
+type Span struct {
+	tracer *Tracer
+
+	mu         sync.Mutex
+	name       string
+	kind       SpanKind
+	context    SpanContext
+	parent     SpanID
+	start      time.Time
+	end        time.Time
+	attributes []Attribute
+	err        string
+	ended      bool
+}
+
+// The SpanContext() method returns the span's IDs. A nil span has an invalid context.
+func (s *Span) SpanContext() SpanContext {
+	if s == nil {
+		return SpanContext{}
+	}
+	return s.context
+}
+
+// The SetName() method replaces the span's name, which is useful when it isn't known
+// until the operation has finished.
+func (s *Span) SetName(name string) {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.name = name
+}
+
+// The SetAttributes() method adds attributes to the span.
+func (s *Span) SetAttributes(attributes ...Attribute) {
+	if s == nil || !s.context.Sampled {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.attributes = append(s.attributes, attributes...)
+}
+
+// The RecordError() method marks the span as failed. A nil error is ignored, so it's
+// fine to call this with whatever error an operation returned.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.err = err.Error()
+}
+
+// The End() method finishes the span and, if it's sampled, queues it for export.
+// Calling End() more than once has no effect.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	if s.context.Sampled {
+		s.tracer.enqueue(s)
+	}
+}
+
+// Spans are kept in the context under these keys. A remote parent is a span context
+// read from an incoming traceparent header.
+type contextKey int
+
+const (
+	spanKey contextKey = iota
+	remoteParentKey
+)
+
+// SpanFromContext returns the current span, or nil if there isn't one.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// ContextWithRemoteParent returns a copy of ctx in which new spans will be children of
+// a span in another service.
+func ContextWithRemoteParent(ctx context.Context, sc SpanContext) context.Context {
+	return context.WithValue(ctx, remoteParentKey, sc)
+}
+
+// Define a Tracer type which samples new traces and exports finished spans in batches
+// in the background.
+type Tracer struct {
+	exporter    Exporter
+	serviceName string
+	threshold   uint64
+
+	queue chan *Span
+	done  chan struct{}
+	once  sync.Once
+
+	// The mutex guards against queueing a span after the queue has been closed. Spans
+	// which were started before Shutdown() may still end after it.
+	mu     sync.RWMutex
+	closed bool
+}
+
+// The batching settings. Spans are dropped, rather than slowing requests down, if the
+// queue fills up because the exporter can't keep up.
+const (
+	queueSize     = 2048
+	batchSize     = 512
+	flushInterval = 5 * time.Second
+)
+
+var global atomic.Pointer[Tracer]
+
+// Configure sets up tracing with an exporter. New traces are sampled with the given
+// probability (between 0 and 1), and traces continued from another service follow that
+// service's decision. It returns the Tracer, which should be shut down before the
+// program exits so that the last spans are exported.
+func Configure(exporter Exporter, serviceName string, sampleRatio float64) *Tracer {
+	t := &Tracer{
+		exporter:    exporter,
+		serviceName: serviceName,
+		queue:       make(chan *Span, queueSize),
+		done:        make(chan struct{}),
+	}
+
+	switch {
+	case sampleRatio >= 1:
+		t.threshold = math.MaxUint64
+	case sampleRatio > 0:
+		t.threshold = uint64(sampleRatio * math.MaxUint64)
+	}
+
+	go t.run()
+
+	global.Store(t)
+
+	return t
+}
+
+// Start starts a new internal span as a child of the current span in ctx (if any), and
+// returns a copy of ctx containing the new span.
+func Start(ctx context.Context, name string, attributes ...Attribute) (context.Context, *Span) {
+	return StartKind(ctx, KindInternal, name, attributes...)
+}
+
+// StartKind is like Start, but for spans of other kinds.
+func StartKind(ctx context.Context, kind SpanKind, name string, attributes ...Attribute) (context.Context, *Span) {
+	t := global.Load()
+	if t == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		tracer: t,
+		name:   name,
+		kind:   kind,
+		start:  time.Now(),
+	}
+
+	// Continue the trace of the parent span, or start a new one.
+	var parent SpanContext
+	if p := SpanFromContext(ctx); p != nil {
+		parent = p.context
+	} else if p, ok := ctx.Value(remoteParentKey).(SpanContext); ok {
+		parent = p
+	}
+
+	if parent.IsValid() {
+		span.context.TraceID = parent.TraceID
+		span.context.Sampled = parent.Sampled
+		span.parent = parent.SpanID
+	} else {
+		rand.Read(span.context.TraceID[:])
+		span.context.Sampled = binary.BigEndian.Uint64(span.context.TraceID[8:]) < t.threshold
+	}
+
+	rand.Read(span.context.SpanID[:])
+
+	if span.context.Sampled {
+		span.attributes = attributes
+	}
+
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+func (t *Tracer) enqueue(span *Span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	if t.closed {
+		return
+	}
+
+	select {
+	case t.queue <- span:
+	default:
+	}
+}
+
+// The run() method collects finished spans into batches and exports them, until the
+// queue is closed by Shutdown().
+func (t *Tracer) run() {
+	defer close(t.done)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	batch := make([]*Span, 0, batchSize)
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+
+		// There's no caller to return an export error to, and retrying could let the
+		// queue back up, so a batch which fails to export is simply dropped.
+		t.exporter.Export(ctx, t.serviceName, batch)
+		batch = make([]*Span, 0, batchSize)
+	}
+
+	for {
+		select {
+		case span, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+
+			batch = append(batch, span)
+			if len(batch) == batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// The Shutdown() method stops tracing, and exports any spans which are still queued.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.once.Do(func() {
+		global.CompareAndSwap(t, nil)
+
+		t.mu.Lock()
+		t.closed = true
+		close(t.queue)
+		t.mu.Unlock()
+	})
+
+	select {
+	case <-t.done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+
+	return t.exporter.Shutdown(ctx)
+}
+
+// The SpanData struct is a read-only copy of a finished span, for exporters.
+type SpanData struct {
+	Name       string
+	Kind       SpanKind
+	Context    SpanContext
+	Parent     SpanID
+	Start      time.Time
+	End        time.Time
+	Attributes []Attribute
+	Error      string
+}
+
+// The Data() method returns a copy of a finished span's data.
+func (s *Span) Data() SpanData {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return SpanData{
+		Name:       s.name,
+		Kind:       s.kind,
+		Context:    s.context,
+		Parent:     s.parent,
+		Start:      s.start,
+		End:        s.end,
+		Attributes: s.attributes,
+		Error:      s.err,
+	}
+}
+
+// An Exporter sends finished spans somewhere.
+type Exporter interface {
+	Export(ctx context.Context, serviceName string, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
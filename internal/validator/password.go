@@ -0,0 +1,498 @@
+package validator
+
+import (
+	"bufio"
+	"crypto/sha1"
+	_ "embed"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Below we embed a list of the most commonly used passwords, most common first. The
+// position of a password in the list is used as its rank when estimating how many
+// guesses it would take to crack a password built from it.
+//
+//go:embed "common_passwords.txt"
+var commonPasswordsFile string
+
+var commonPasswords = func() map[string]int {
+	ranks := make(map[string]int)
+
+	for i, line := range strings.Split(commonPasswordsFile, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if _, exists := ranks[line]; !exists {
+			ranks[line] = i + 1
+		}
+	}
+
+	return ranks
+}()
+
+// Define a PasswordPolicy type which holds the rules that new passwords are checked
+// against. MinScore is on the same 0-4 scale used by zxcvbn, where 0 is "too guessable"
+// and 4 is "very unguessable". PwnedDir is the path to a directory of Have I Been Pwned
+// range files (see CheckPwned), and the check is skipped if it is empty.
+type PasswordPolicy struct {
+	MinScore int
+	PwnedDir string
+}
+
+// Check runs every rule in the policy against a password and returns a human-readable
+// reason for the first one that fails, or an empty string if the password is
+// acceptable. The userInputs are values such as the user's name and email address,
+// which make a password much easier to guess if it is based on them.
+func (p PasswordPolicy) Check(password string, userInputs ...string) (string, error) {
+	if _, common := commonPasswords[strings.ToLower(password)]; common {
+		return "must not be a commonly used password", nil
+	}
+
+	if p.PwnedDir != "" {
+		count, err := CheckPwned(p.PwnedDir, password)
+		if err != nil {
+			return "", err
+		}
+		if count > 0 {
+			return "has appeared in a data breach and must not be used", nil
+		}
+	}
+
+	strength := EstimateStrength(password, userInputs...)
+	if strength.Score < p.MinScore {
+		return "is too easy to guess: " + strength.Feedback, nil
+	}
+
+	return "", nil
+}
+
+// Validate is a convenience wrapper around Check which records the reason in the
+// validator's error map under the given key.
+func (p PasswordPolicy) Validate(v *Validator, key, password string, userInputs ...string) error {
+	reason, err := p.Check(password, userInputs...)
+	if err != nil {
+		return err
+	}
+
+	v.Check(reason == "", key, reason)
+	return nil
+}
+
+// CheckPwned looks up a password in a local copy of the Have I Been Pwned password
+// list, and returns the number of times it has been seen in a breach. The directory
+// must be laid out in the same k-anonymity format as the range API: one file per
+// 5-character SHA-1 prefix (named "ABCDE" or "ABCDE.txt"), containing lines of the
+// form "<35-character suffix>:<count>". This is the format produced by the official
+// downloader, and it means only one small file is read per check.
+func CheckPwned(dir, password string) (int, error) {
+	sum := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(sum[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	f, err := os.Open(filepath.Join(dir, prefix))
+	if errors.Is(err, fs.ErrNotExist) {
+		f, err = os.Open(filepath.Join(dir, prefix+".txt"))
+	}
+	if err != nil {
+		// A missing range file simply means that no breached password has this
+		// prefix.
+		if errors.Is(err, fs.ErrNotExist) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+
+		lineSuffix, count, found := strings.Cut(line, ":")
+		if !found || !strings.EqualFold(lineSuffix, suffix) {
+			continue
+		}
+
+		n, err := strconv.Atoi(count)
+		if err != nil {
+			return 0, err
+		}
+		return n, nil
+	}
+
+	return 0, scanner.Err()
+}
+
+// Strength holds the result of estimating how hard a password is to guess.
+type Strength struct {
+	Guesses  float64
+	Score    int
+	Feedback string
+}
+
+// passwordMatch is a substring of the password which matches a known pattern, along
+// with an estimate of how many guesses an attacker would need to find it.
+type passwordMatch struct {
+	i, j     int
+	guesses  float64
+	feedback string
+}
+
+// Keyboard rows and other common character runs that people treat as patterns.
+var keyboardRows = []string{
+	"`1234567890-=",
+	"qwertyuiop[]\\",
+	"asdfghjkl;'",
+	"zxcvbnm,./",
+	"qazwsxedcrfvtgbyhnujmikolp",
+	"1qaz2wsx3edc4rfv5tgb6yhn7ujm8ik9ol0p",
+}
+
+var leetSubstitutions = strings.NewReplacer(
+	"4", "a", "@", "a", "8", "b", "(", "c", "3", "e", "6", "g", "1", "l",
+	"!", "i", "0", "o", "$", "s", "5", "s", "7", "t", "+", "t", "2", "z",
+)
+
+// EstimateStrength estimates the number of guesses needed to crack a password, in the
+// spirit of Dropbox's zxcvbn. The password is matched against a set of patterns
+// (common passwords, the user's own details, keyboard runs, sequences, repeats and
+// years), and the cheapest way of building the whole password out of those matches
+// and brute-forced characters is used as the estimate. It is deliberately simpler
+// than zxcvbn, but errs on the side of caution in the same way.
+func EstimateStrength(password string, userInputs ...string) Strength {
+	// We only look at the first maxEstimateLength characters. Anything longer is
+	// unguessable anyway, and the matching below looks at every substring, so this
+	// keeps the cost of checking a password small and fixed.
+	runes := []rune(password)
+	if len(runes) > maxEstimateLength {
+		runes = runes[:maxEstimateLength]
+	}
+
+	return estimate(runes, userInputs, true)
+}
+
+// The number of characters of a password that EstimateStrength looks at.
+const maxEstimateLength = 64
+
+// estimate does the work for EstimateStrength. Repeats are only matched if repeats is
+// set, so that scoring the unit of a repeat can't go on to look for repeats inside it.
+func estimate(runes []rune, userInputs []string, repeats bool) Strength {
+	n := len(runes)
+
+	if n == 0 {
+		return Strength{Guesses: 1, Score: 0, Feedback: "add more words or characters"}
+	}
+
+	matches := findMatches(runes, userInputs, repeats)
+
+	// best[k] holds the fewest guesses needed to produce the first k characters, and
+	// why[k] the match that was used to get there (or nil for brute force).
+	best := make([]float64, n+1)
+	why := make([]*passwordMatch, n+1)
+
+	best[0] = 1
+	for k := 1; k <= n; k++ {
+		best[k] = math.Inf(1)
+	}
+
+	for k := 1; k <= n; k++ {
+		// Brute force a single character on top of the best result so far. We use a
+		// cardinality of 10 per character, which is what zxcvbn uses too.
+		if g := best[k-1] * 10; g < best[k] {
+			best[k] = g
+			why[k] = nil
+		}
+
+		for idx := range matches {
+			m := &matches[idx]
+			if m.j+1 != k {
+				continue
+			}
+
+			if g := best[m.i] * m.guesses; g < best[k] {
+				best[k] = g
+				why[k] = m
+			}
+		}
+	}
+
+	strength := Strength{Guesses: math.Max(best[n], 1)}
+
+	switch {
+	case strength.Guesses < 1e3+5:
+		strength.Score = 0
+	case strength.Guesses < 1e6+5:
+		strength.Score = 1
+	case strength.Guesses < 1e8+5:
+		strength.Score = 2
+	case strength.Guesses < 1e10+5:
+		strength.Score = 3
+	default:
+		strength.Score = 4
+	}
+
+	// Use the feedback from the longest pattern that made it into the estimate, as
+	// that's the one doing the most damage.
+	var longest *passwordMatch
+	for k := n; k > 0; {
+		m := why[k]
+		if m == nil {
+			k--
+			continue
+		}
+		if longest == nil || m.j-m.i > longest.j-longest.i {
+			longest = m
+		}
+		k = m.i
+	}
+
+	switch {
+	case longest != nil:
+		strength.Feedback = longest.feedback
+	default:
+		strength.Feedback = "add more words or characters"
+	}
+
+	return strength
+}
+
+func findMatches(runes []rune, userInputs []string, repeats bool) []passwordMatch {
+	var matches []passwordMatch
+
+	// Lower-case rune by rune, so that the indexes line up with the original password.
+	n := len(runes)
+	lower := make([]rune, n)
+	for i, r := range runes {
+		lower[i] = unicode.ToLower(r)
+	}
+
+	// Build the dictionary of user inputs, splitting email addresses into their parts
+	// so that "alice" is found in a password for alice@example.com.
+	inputs := make(map[string]int)
+	for _, input := range userInputs {
+		fields := strings.FieldsFunc(strings.ToLower(input), func(r rune) bool {
+			return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+		})
+		for _, field := range fields {
+			if len(field) >= 3 {
+				inputs[field] = 1
+			}
+		}
+	}
+
+	for i := 0; i < n; i++ {
+		for j := i; j < n; j++ {
+			word := string(lower[i : j+1])
+			length := j - i + 1
+
+			// Dictionary matches, including reversed words and l33t substitutions.
+			if length >= 3 {
+				variations := uppercaseVariations(runes[i : j+1])
+
+				if rank, ok := lookupWord(word, inputs); ok {
+					matches = append(matches, passwordMatch{i, j, float64(rank) * variations, dictionaryFeedback(word, inputs)})
+				}
+
+				if rank, ok := lookupWord(reverse(word), inputs); ok {
+					matches = append(matches, passwordMatch{i, j, float64(rank) * variations * 2, "reversed words are easy to guess"})
+				}
+
+				if unleet := leetSubstitutions.Replace(word); unleet != word {
+					if rank, ok := lookupWord(unleet, inputs); ok {
+						matches = append(matches, passwordMatch{i, j, float64(rank) * variations * 2, "predictable substitutions like '@' instead of 'a' don't help very much"})
+					}
+				}
+			}
+
+			// Years between 1900 and 2099 are common in passwords.
+			if length == 4 {
+				if year, err := strconv.Atoi(word); err == nil && year >= 1900 && year <= 2099 {
+					matches = append(matches, passwordMatch{i, j, 200, "avoid years that are associated with you"})
+				}
+			}
+		}
+	}
+
+	matches = append(matches, sequenceMatches(lower)...)
+	matches = append(matches, keyboardMatches(lower)...)
+	if repeats {
+		matches = append(matches, repeatMatches(lower)...)
+	}
+
+	return matches
+}
+
+// lookupWord returns the rank of a word in the user inputs (always rank 1, because an
+// attacker would try those first) or in the common passwords list.
+func lookupWord(word string, inputs map[string]int) (int, bool) {
+	if rank, ok := inputs[word]; ok {
+		return rank, true
+	}
+
+	rank, ok := commonPasswords[word]
+	return rank, ok
+}
+
+func dictionaryFeedback(word string, inputs map[string]int) string {
+	if _, ok := inputs[word]; ok {
+		return "avoid using your name or email address in your password"
+	}
+	return "avoid common words and passwords"
+}
+
+// uppercaseVariations estimates the extra guesses added by capital letters. An all
+// lower-case word or one with only the first letter capitalized adds very little.
+func uppercaseVariations(word []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range word {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+
+	switch {
+	case upper == 0:
+		return 1
+	case upper == 1 && unicode.IsUpper(word[0]), lower == 0:
+		return 2
+	}
+
+	variations := 0.0
+	for k := 1; k <= min(upper, lower); k++ {
+		variations += binomial(upper+lower, k)
+	}
+
+	return math.Max(variations, 1)
+}
+
+func binomial(n, k int) float64 {
+	result := 1.0
+	for d := 1; d <= k; d++ {
+		result *= float64(n - k + d)
+		result /= float64(d)
+	}
+	return result
+}
+
+// sequenceMatches finds runs of three or more characters which go up or down by a
+// constant step, such as "abc", "7531" or "zyx".
+func sequenceMatches(runes []rune) []passwordMatch {
+	var matches []passwordMatch
+
+	n := len(runes)
+	i := 0
+
+	for i < n-2 {
+		delta := runes[i+1] - runes[i]
+		if delta == 0 || delta > 5 || delta < -5 {
+			i++
+			continue
+		}
+
+		j := i + 1
+		for j+1 < n && runes[j+1]-runes[j] == delta {
+			j++
+		}
+
+		if j-i >= 2 {
+			base := 26.0
+			switch {
+			case strings.ContainsRune("aAzZ019", runes[i]):
+				base = 4
+			case unicode.IsDigit(runes[i]):
+				base = 10
+			}
+			if delta < 0 {
+				base *= 2
+			}
+
+			matches = append(matches, passwordMatch{i, j, base * float64(j-i+1), "avoid sequences like abc or 6543"})
+		}
+
+		i = j
+	}
+
+	return matches
+}
+
+// keyboardMatches finds runs of three or more characters that are next to each other
+// on a keyboard row, such as "qwerty" or "asdf".
+func keyboardMatches(runes []rune) []passwordMatch {
+	var matches []passwordMatch
+
+	n := len(runes)
+
+	for i := 0; i < n-2; i++ {
+		for j := n - 1; j >= i+2; j-- {
+			run := string(runes[i : j+1])
+
+			found := false
+			for _, row := range keyboardRows {
+				if strings.Contains(row, run) || strings.Contains(row, reverse(run)) {
+					found = true
+					break
+				}
+			}
+
+			if found {
+				matches = append(matches, passwordMatch{i, j, 40 * float64(j-i+1), "avoid straight rows of keys like qwerty"})
+				break
+			}
+		}
+	}
+
+	return matches
+}
+
+// repeatMatches finds characters or groups of characters that repeat, such as "aaa"
+// or "abcabc". The guesses for a repeat are the guesses for the repeated unit
+// multiplied by the number of repeats. The unit is scored without looking for repeats
+// inside it, and each distinct unit is only scored once.
+func repeatMatches(runes []rune) []passwordMatch {
+	var matches []passwordMatch
+
+	unitGuesses := make(map[string]float64)
+
+	n := len(runes)
+
+	for i := 0; i < n; i++ {
+		for unit := 1; unit <= (n-i)/2; unit++ {
+			count := 1
+			for i+(count+1)*unit <= n && string(runes[i+count*unit:i+(count+1)*unit]) == string(runes[i:i+unit]) {
+				count++
+			}
+
+			if count < 2 || (unit == 1 && count < 3) {
+				continue
+			}
+
+			key := string(runes[i : i+unit])
+			base, ok := unitGuesses[key]
+			if !ok {
+				base = estimate(runes[i:i+unit], nil, false).Guesses
+				unitGuesses[key] = base
+			}
+			matches = append(matches, passwordMatch{i, i + count*unit - 1, base * float64(count), "avoid repeated words and characters"})
+		}
+	}
+
+	return matches
+}
+
+func reverse(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
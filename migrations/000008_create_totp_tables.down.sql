@@ -0,0 +1,2 @@
+DROP TABLE IF EXISTS totp_recovery_codes;
+DROP TABLE IF EXISTS totp_secrets;
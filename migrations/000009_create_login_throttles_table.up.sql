@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS login_throttles (
+    key text PRIMARY KEY,
+    failures integer NOT NULL DEFAULT 0,
+    last_failure_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    blocked_until timestamp(0) with time zone,
+    locked bool NOT NULL DEFAULT false
+);
+
+-- Add the permission for the admin endpoints.
+INSERT INTO permissions (code)
+VALUES
+    ('users:admin');
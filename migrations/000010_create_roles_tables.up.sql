@@ -0,0 +1,36 @@
+CREATE TABLE IF NOT EXISTS roles (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    name text UNIQUE NOT NULL,
+    is_default bool NOT NULL DEFAULT false
+);
+
+-- Only one role can be given to new users.
+CREATE UNIQUE INDEX IF NOT EXISTS roles_is_default_idx ON roles (is_default) WHERE is_default;
+
+CREATE TABLE IF NOT EXISTS roles_permissions (
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    permission_id bigint NOT NULL REFERENCES permissions ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS users_roles (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    role_id bigint NOT NULL REFERENCES roles ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+-- Add the built-in roles. New users get the "viewer" role, which matches the
+-- "movies:read" permission that used to be granted to them directly.
+INSERT INTO roles (name, is_default)
+VALUES
+    ('viewer', true),
+    ('editor', false),
+    ('admin', false);
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE (roles.name = 'viewer' AND permissions.code = 'movies:read')
+   OR (roles.name = 'editor' AND permissions.code IN ('movies:read', 'movies:write'))
+   OR (roles.name = 'admin');
@@ -0,0 +1,16 @@
+ALTER TABLE users ADD COLUMN IF NOT EXISTS blocked bool NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS audit_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    actor_id bigint REFERENCES users ON DELETE SET NULL,
+    action text NOT NULL,
+    target_user_id bigint,
+    ip_address text NOT NULL DEFAULT '',
+    details jsonb NOT NULL DEFAULT '{}'
+);
+
+-- The target_user_id column deliberately isn't a foreign key, so that the audit trail
+-- for a user survives the user being deleted.
+CREATE INDEX IF NOT EXISTS audit_events_target_user_id_idx ON audit_events (target_user_id);
+CREATE INDEX IF NOT EXISTS audit_events_actor_id_idx ON audit_events (actor_id);
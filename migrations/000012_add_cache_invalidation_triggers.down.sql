@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS permissions_cache_invalidation ON permissions;
+DROP TRIGGER IF EXISTS roles_permissions_cache_invalidation ON roles_permissions;
+DROP TRIGGER IF EXISTS users_roles_cache_invalidation ON users_roles;
+DROP TRIGGER IF EXISTS users_permissions_cache_invalidation ON users_permissions;
+DROP TRIGGER IF EXISTS tokens_cache_invalidation ON tokens;
+DROP TRIGGER IF EXISTS users_cache_invalidation ON users;
+DROP FUNCTION IF EXISTS notify_all_cache_invalidation();
+DROP FUNCTION IF EXISTS notify_user_cache_invalidation();
@@ -0,0 +1,55 @@
+-- The API keeps an in-process cache of authenticated users and their permissions.
+-- These triggers send a notification on the cache_invalidation channel whenever the
+-- data behind it changes, so that every running instance can drop its stale entries.
+-- The payload is either "user:<id>" for a single user, or "all".
+
+CREATE OR REPLACE FUNCTION notify_user_cache_invalidation() RETURNS trigger AS $$
+DECLARE
+    row record;
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        row := OLD;
+    ELSE
+        row := NEW;
+    END IF;
+
+    IF TG_TABLE_NAME = 'users' THEN
+        PERFORM pg_notify('cache_invalidation', 'user:' || row.id);
+    ELSE
+        PERFORM pg_notify('cache_invalidation', 'user:' || row.user_id);
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION notify_all_cache_invalidation() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('cache_invalidation', 'all');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER users_cache_invalidation
+AFTER UPDATE OR DELETE ON users
+FOR EACH ROW EXECUTE FUNCTION notify_user_cache_invalidation();
+
+CREATE TRIGGER tokens_cache_invalidation
+AFTER DELETE ON tokens
+FOR EACH ROW EXECUTE FUNCTION notify_user_cache_invalidation();
+
+CREATE TRIGGER users_permissions_cache_invalidation
+AFTER INSERT OR DELETE ON users_permissions
+FOR EACH ROW EXECUTE FUNCTION notify_user_cache_invalidation();
+
+CREATE TRIGGER users_roles_cache_invalidation
+AFTER INSERT OR DELETE ON users_roles
+FOR EACH ROW EXECUTE FUNCTION notify_user_cache_invalidation();
+
+CREATE TRIGGER roles_permissions_cache_invalidation
+AFTER INSERT OR DELETE ON roles_permissions
+FOR EACH STATEMENT EXECUTE FUNCTION notify_all_cache_invalidation();
+
+CREATE TRIGGER permissions_cache_invalidation
+AFTER UPDATE OR DELETE ON permissions
+FOR EACH STATEMENT EXECUTE FUNCTION notify_all_cache_invalidation();
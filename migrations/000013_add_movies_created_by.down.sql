@@ -0,0 +1,2 @@
+DELETE FROM permissions WHERE code = 'movies:write-any';
+ALTER TABLE movies DROP COLUMN IF EXISTS created_by;
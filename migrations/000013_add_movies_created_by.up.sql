@@ -0,0 +1,16 @@
+-- Movies which existed before ownership was tracked are left without an owner, and
+-- can still be changed by any user with the movies:write permission.
+ALTER TABLE movies ADD COLUMN IF NOT EXISTS created_by bigint REFERENCES users ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS movies_created_by_idx ON movies (created_by);
+
+-- Add the permission for changing movies created by other users, and grant it to the
+-- built-in editor and admin roles.
+INSERT INTO permissions (code)
+VALUES
+    ('movies:write-any');
+
+INSERT INTO roles_permissions
+SELECT roles.id, permissions.id
+FROM roles, permissions
+WHERE roles.name IN ('editor', 'admin') AND permissions.code = 'movies:write-any';
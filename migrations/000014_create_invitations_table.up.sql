@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS invitations (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    created_by bigint REFERENCES users ON DELETE SET NULL,
+    hash bytea UNIQUE NOT NULL,
+    email citext,
+    permissions text[] NOT NULL DEFAULT '{}',
+    expiry timestamp(0) with time zone,
+    max_uses integer,
+    uses integer NOT NULL DEFAULT 0
+);
@@ -0,0 +1,20 @@
+-- Links between users and the accounts they sign in with at an external OpenID
+-- Connect provider. A provider identifies an account by its issuer and subject.
+CREATE TABLE IF NOT EXISTS user_identities (
+    issuer text NOT NULL,
+    subject text NOT NULL,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (issuer, subject)
+);
+
+CREATE INDEX IF NOT EXISTS user_identities_user_id_idx ON user_identities (user_id);
+
+-- Logins which have been sent to the provider but haven't come back yet. The state
+-- parameter is stored hashed, just like tokens.
+CREATE TABLE IF NOT EXISTS oidc_logins (
+    hash bytea PRIMARY KEY,
+    nonce text NOT NULL,
+    code_verifier text NOT NULL,
+    expiry timestamp(0) with time zone NOT NULL
+);
@@ -0,0 +1,10 @@
+DELETE FROM tokens WHERE client_id IS NOT NULL;
+
+ALTER TABLE tokens
+    DROP COLUMN IF EXISTS redirect_uri,
+    DROP COLUMN IF EXISTS code_challenge,
+    DROP COLUMN IF EXISTS permissions,
+    DROP COLUMN IF EXISTS client_id;
+
+DROP TABLE IF EXISTS oauth_consents;
+DROP TABLE IF EXISTS oauth_clients;
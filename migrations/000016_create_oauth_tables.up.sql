@@ -0,0 +1,33 @@
+-- Third-party applications registered to use the API on behalf of users. Confidential
+-- clients have a secret (stored hashed, like tokens); public clients don't, and have
+-- to rely on PKCE. The scopes are the permission codes a client may ask for.
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    client_id text UNIQUE NOT NULL,
+    secret_hash bytea,
+    name text NOT NULL,
+    redirect_uris text[] NOT NULL,
+    scopes text[] NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS oauth_clients_user_id_idx ON oauth_clients (user_id);
+
+-- The scopes that each user has agreed to let each client use.
+CREATE TABLE IF NOT EXISTS oauth_consents (
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    client_id bigint NOT NULL REFERENCES oauth_clients ON DELETE CASCADE,
+    scopes text[] NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, client_id)
+);
+
+-- Authorization codes and access tokens live in the tokens table along with every
+-- other kind of token, with the extra details that they need.
+ALTER TABLE tokens
+    ADD COLUMN IF NOT EXISTS client_id bigint REFERENCES oauth_clients ON DELETE CASCADE,
+    ADD COLUMN IF NOT EXISTS permissions text[],
+    ADD COLUMN IF NOT EXISTS code_challenge text,
+    ADD COLUMN IF NOT EXISTS redirect_uri text;
@@ -0,0 +1,20 @@
+-- Every successful and failed attempt to log in. The email address is the one that was
+-- tried, which may not belong to any user. The session hash is the hash of the
+-- authentication token that a successful login was given, and the revoke hash is the
+-- hash of the code in the new-device email which ends that session.
+CREATE TABLE IF NOT EXISTS login_events (
+    id bigserial PRIMARY KEY,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    user_id bigint REFERENCES users ON DELETE CASCADE,
+    email citext NOT NULL DEFAULT '',
+    method text NOT NULL,
+    outcome text NOT NULL,
+    ip_address text NOT NULL,
+    network text NOT NULL,
+    user_agent text NOT NULL,
+    session_hash bytea,
+    revoke_hash bytea UNIQUE,
+    revoked_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS login_events_user_id_idx ON login_events (user_id, id DESC);